@@ -0,0 +1,172 @@
+package leoverse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultConcurrency is the number of prompts generated at the same time by
+// GenerateBatch when the given concurrency is not positive. The requests to
+// Leonardo are still serialized by the client rate limiter, so a small value
+// is enough to overlap the generations, polling and downloads.
+const DefaultConcurrency = 3
+
+// batchJob is a generation of a batch, stored in its own subdirectory.
+type batchJob struct {
+	prompt string
+	dir    string
+	seed   int64
+}
+
+// GenerateBatch generates the prompts with a bounded pool of workers sharing
+// one authenticated client. The images of each prompt are stored in its own
+// prompt_NNN subdirectory. The results are in the same order as the prompts;
+// the error joins the errors of the prompts that failed.
+func GenerateBatch(ctx context.Context, cfg *Config, prompts []string, concurrency int) ([]Result, error) {
+	if len(prompts) == 0 {
+		return nil, nil
+	}
+	client, err := startBatchClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Stop(context.WithoutCancel(ctx))
+	return GenerateBatchWithClient(ctx, cfg, client, prompts, concurrency)
+}
+
+// GenerateBatchWithClient is like GenerateBatch but uses an existing client.
+func GenerateBatchWithClient(ctx context.Context, cfg *Config, client GenerationClient, prompts []string, concurrency int) ([]Result, error) {
+	jobs := make([]batchJob, len(prompts))
+	for i, prompt := range prompts {
+		jobs[i] = batchJob{prompt: prompt, dir: fmt.Sprintf("prompt_%03d", i+1), seed: cfg.Seed}
+	}
+	results, errs := runBatch(ctx, cfg, client, jobs, concurrency)
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("prompt %d %q: %w", i+1, SanitizePrompt(prompts[i]), err))
+		}
+	}
+	return results, errors.Join(failed...)
+}
+
+// GenerateCount runs count separate generations of the prompt, each with its
+// own seed, unlike NumImages which generates several images in one job. The
+// images of each generation are stored in its own run_NNN subdirectory. If
+// cfg.Seed is set, the generations use consecutive seeds starting from it, so
+// they are reproducible. The results and error are like GenerateBatch.
+func GenerateCount(ctx context.Context, cfg *Config, prompt string, count, concurrency int) ([]Result, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	client, err := startBatchClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Stop(context.WithoutCancel(ctx))
+	return GenerateCountWithClient(ctx, cfg, client, prompt, count, concurrency)
+}
+
+// GenerateCountWithClient is like GenerateCount but uses an existing client.
+func GenerateCountWithClient(ctx context.Context, cfg *Config, client GenerationClient, prompt string, count, concurrency int) ([]Result, error) {
+	jobs := make([]batchJob, max(count, 0))
+	for i := range jobs {
+		jobs[i] = batchJob{prompt: prompt, dir: fmt.Sprintf("run_%03d", i+1)}
+		if cfg.Seed != 0 {
+			jobs[i].seed = cfg.Seed + int64(i)
+		}
+	}
+	results, errs := runBatch(ctx, cfg, client, jobs, concurrency)
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("run %d: %w", i+1, err))
+		}
+	}
+	return results, errors.Join(failed...)
+}
+
+// startBatchClient waits for cfg.StartDelay and starts the client of a batch,
+// rotating between the accounts if cfg.Cookies is set.
+func startBatchClient(ctx context.Context, cfg *Config) (GenerationClient, error) {
+	if err := cfg.delayStart(ctx); err != nil {
+		return nil, err
+	}
+	return StartGenerationClient(ctx, cfg)
+}
+
+// runBatch runs the jobs with a bounded pool of workers sharing the client,
+// and returns their results and errors in order. cfg.OnResult is called as
+// each job completes. If cfg.WriteManifest is set, one manifest of all the
+// downloaded images is written to the output directory once the jobs are
+// done, instead of one per subdirectory.
+func runBatch(ctx context.Context, cfg *Config, client GenerationClient, jobs []batchJob, concurrency int) ([]Result, []error) {
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	concurrency = min(concurrency, len(jobs))
+	start := time.Now()
+
+	results := make([]Result, len(jobs))
+	errs := make([]error, len(jobs))
+	// resultMu serializes the calls to OnResult
+	var resultMu sync.Mutex
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i], errs[i] = runJob(ctx, cfg, client, jobs[i], start.Add(time.Duration(i)*cfg.Stagger))
+				if cfg.OnResult != nil {
+					resultMu.Lock()
+					cfg.OnResult(i, &results[i], errs[i])
+					resultMu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	if cfg.WriteManifest {
+		var manifest []ManifestEntry
+		for _, result := range results {
+			manifest = append(manifest, result.manifest...)
+		}
+		// The images of the cancelled batches are still listed
+		if len(manifest) > 0 {
+			cfg.writeManifest(context.WithoutCancel(ctx), manifest)
+		}
+	}
+	return results, errs
+}
+
+// runJob waits until the start time of the job, which staggers the jobs, and
+// generates its images in its subdirectory.
+func runJob(ctx context.Context, cfg *Config, client GenerationClient, job batchJob, startAt time.Time) (Result, error) {
+	failed := Result{Prompt: job.prompt}
+	if err := sleep(ctx, time.Until(startAt)); err != nil {
+		return failed, err
+	}
+	jobCfg := cfg.Subdir(job.dir)
+	jobCfg.Seed = job.seed
+	jobCfg.WriteManifest = false
+	result, err := GenerateImageWithClient(ctx, jobCfg, client, job.prompt)
+	if err != nil {
+		return failed, err
+	}
+	return *result, nil
+}
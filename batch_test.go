@@ -0,0 +1,295 @@
+package leoverse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+)
+
+// fakeClient is a GenerationClient whose generations complete with an image
+// served by the test server, except for the prompts of fail.
+type fakeClient struct {
+	url  string
+	fail map[string]bool
+
+	mu      sync.Mutex
+	inputs  map[string]leonardo.GenerateImageInput
+	created []time.Time
+	deleted []string
+}
+
+func newFakeClient(t *testing.T, fail ...string) *fakeClient {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pngHeader)
+	}))
+	t.Cleanup(srv.Close)
+	c := &fakeClient{url: srv.URL, fail: make(map[string]bool), inputs: make(map[string]leonardo.GenerateImageInput)}
+	for _, prompt := range fail {
+		c.fail[prompt] = true
+	}
+	return c
+}
+
+func (c *fakeClient) CreateGeneration(ctx context.Context, input *leonardo.GenerateImageInput) (string, error) {
+	if c.fail[input.Prompt] {
+		return "", errors.New("rejected")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := fmt.Sprintf("generation%d", len(c.inputs)+1)
+	c.inputs[id] = *input
+	c.created = append(c.created, time.Now())
+	return id, nil
+}
+
+func (c *fakeClient) WaitForGeneration(ctx context.Context, generationID string) ([]leonardo.GeneratedImage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	input := c.inputs[generationID]
+	return []leonardo.GeneratedImage{{URL: c.url + "/" + generationID + ".png", Seed: input.Seed}}, nil
+}
+
+func (c *fakeClient) GetGeneration(ctx context.Context, generationID string) (*leonardo.Generation, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeClient) DeleteGeneration(ctx context.Context, generationID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deleted = append(c.deleted, generationID)
+	return nil
+}
+
+func (c *fakeClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+func TestGenerateBatch(t *testing.T) {
+	client := newFakeClient(t, "a bird")
+	dir := t.TempDir()
+	var reported []int
+	cfg := &Config{
+		OutputDir: dir,
+		Output:    io.Discard,
+		OnResult: func(index int, result *Result, err error) {
+			reported = append(reported, index)
+		},
+	}
+	prompts := []string{"a cat", "a bird", "a dog"}
+	results, err := GenerateBatchWithClient(context.Background(), cfg, client, prompts, 2)
+	if err == nil || !strings.Contains(err.Error(), `prompt 2 "a bird": generation failed: rejected`) || strings.Contains(err.Error(), "prompt 1") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(results) != len(prompts) {
+		t.Fatalf("got %d results, want %d", len(results), len(prompts))
+	}
+	for i, result := range results {
+		if result.Prompt != prompts[i] {
+			t.Errorf("result %d is for %q, want %q", i, result.Prompt, prompts[i])
+		}
+		if failed := result.GenerationID == ""; failed != (i == 1) {
+			t.Errorf("result %d: unexpected generation %q", i, result.GenerationID)
+		}
+	}
+	if want := filepath.Join(dir, "prompt_003"); len(results[2].Files) != 1 || filepath.Dir(results[2].Files[0]) != want {
+		t.Errorf("got files %v, want them in %s", results[2].Files, want)
+	}
+	if len(reported) != len(prompts) {
+		t.Errorf("OnResult called for %v, want every prompt", reported)
+	}
+}
+
+func TestGenerateCount(t *testing.T) {
+	client := newFakeClient(t)
+	dir := t.TempDir()
+	cfg := &Config{OutputDir: dir, Output: io.Discard, Seed: 100}
+	results, err := GenerateCountWithClient(context.Background(), cfg, client, "a cat", 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, result := range results {
+		if want := int64(100 + i); result.Seed != want {
+			t.Errorf("run %d: seed %d, want %d", i+1, result.Seed, want)
+		}
+		want := filepath.Join(dir, fmt.Sprintf("run_%03d", i+1))
+		if len(result.Files) != 1 || filepath.Dir(result.Files[0]) != want {
+			t.Errorf("run %d: got files %v, want them in %s", i+1, result.Files, want)
+		}
+	}
+	if cfg.Seed != 100 {
+		t.Error("the config seed was modified")
+	}
+
+	// Without a seed each generation gets a random one
+	cfg.Seed = 0
+	results, err = GenerateCountWithClient(context.Background(), cfg, client, "a cat", 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, result := range results {
+		if result.Seed != 0 {
+			t.Errorf("run %d: seed %d sent, want a random seed", i+1, result.Seed)
+		}
+	}
+}
+
+func TestStagger(t *testing.T) {
+	client := newFakeClient(t)
+	cfg := &Config{OutputDir: t.TempDir(), Output: io.Discard, Stagger: 30 * time.Millisecond}
+	start := time.Now()
+	if _, err := GenerateBatchWithClient(context.Background(), cfg, client, []string{"a cat", "a dog", "a bird"}, 3); err != nil {
+		t.Fatal(err)
+	}
+	slices.SortFunc(client.created, time.Time.Compare)
+	for i, created := range client.created {
+		if elapsed, want := created.Sub(start), time.Duration(i)*cfg.Stagger; elapsed < want {
+			t.Errorf("generation %d started after %s, want at least %s", i+1, elapsed, want)
+		}
+	}
+
+	// The stagger is interrupted by the cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	cfg.Stagger = time.Hour
+	start = time.Now()
+	results, err := GenerateBatchWithClient(ctx, cfg, client, []string{"a cat", "a dog"}, 2)
+	if !errors.Is(err, context.DeadlineExceeded) || results[1].GenerationID != "" {
+		t.Errorf("got %v, want the second prompt cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled batch took %s", elapsed)
+	}
+}
+
+func TestDelayStart(t *testing.T) {
+	cfg := &Config{Output: io.Discard, StartDelay: 20 * time.Millisecond}
+	start := time.Now()
+	if err := cfg.delayStart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.StartDelay {
+		t.Errorf("started after %s, want at least %s", elapsed, cfg.StartDelay)
+	}
+
+	// The delay is interrupted by the cancellation, before logging in
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg.StartDelay = time.Hour
+	if _, err := GenerateBatch(ctx, cfg, []string{"a cat"}, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the delay cancelled", err)
+	}
+	if _, err := GenerateImage(ctx, cfg, "a cat"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the delay cancelled", err)
+	}
+}
+
+func TestBatchManifest(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{OutputDir: dir, Output: io.Discard, WriteManifest: true}
+	prompts := []string{"a cat", "a dog", "a bird"}
+	if _, err := GenerateBatchWithClient(context.Background(), cfg, newFakeClient(t, "a dog"), prompts, 2); err == nil {
+		t.Fatal("expected the failed prompt to be reported")
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, entry := range m.Images {
+		got = append(got, entry.Prompt)
+	}
+	if want := []string{"a cat", "a bird"}; !slices.Equal(got, want) {
+		t.Errorf("got manifest of %q, want %q", got, want)
+	}
+	for _, sub := range []string{"prompt_001", "prompt_003"} {
+		if _, err := os.Stat(filepath.Join(dir, sub, ManifestName)); err == nil {
+			t.Errorf("unexpected manifest in %s", sub)
+		}
+	}
+}
+
+func TestSkipDownload(t *testing.T) {
+	client := newFakeClient(t)
+	dir := t.TempDir()
+	cfg := &Config{Sink: &LocalSink{Dir: dir}, Output: io.Discard, SkipDownload: true, DeleteAfterDownload: true, WriteManifest: true}
+	result, err := GenerateImageWithClient(context.Background(), cfg, client, "a cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{client.url + "/generation1.png"}; !slices.Equal(result.URLs, want) || len(result.Files) != 0 {
+		t.Errorf("got urls %v and files %v, want only the urls %v", result.URLs, result.Files, want)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("the sink was written to: %v, %v", entries, err)
+	}
+	// The generation isn't deleted as its images weren't stored
+	if len(client.deleted) != 0 {
+		t.Errorf("deleted %v", client.deleted)
+	}
+}
+
+// flakyClient is a fakeClient whose first generations fail.
+type flakyClient struct {
+	*fakeClient
+	failures int
+	err      error
+	waits    int
+}
+
+func (c *flakyClient) WaitForGeneration(ctx context.Context, generationID string) ([]leonardo.GeneratedImage, error) {
+	c.waits++
+	if c.waits <= c.failures {
+		return nil, c.err
+	}
+	return c.fakeClient.WaitForGeneration(ctx, generationID)
+}
+
+func TestRunGenerationRetry(t *testing.T) {
+	failed := fmt.Errorf("%w: status FAILED", leonardo.ErrGenerationFailed)
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		want     error
+		creates  int
+	}{
+		{"transient failure", 2, failed, nil, 3},
+		{"gives up", 3, failed, leonardo.ErrGenerationFailed, 3},
+		{"other error", 1, context.DeadlineExceeded, context.DeadlineExceeded, 1},
+	}
+	for _, tt := range tests {
+		client := &flakyClient{fakeClient: newFakeClient(t), failures: tt.failures, err: tt.err}
+		cfg := &Config{Output: io.Discard, MaxGenerationRetries: 2}
+		generationID, images, err := runGeneration(context.Background(), cfg, client, &leonardo.GenerateImageInput{Prompt: "a cat"})
+		if !errors.Is(err, tt.want) || (tt.want != nil) != (err != nil) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.want)
+		}
+		if len(client.created) != tt.creates {
+			t.Errorf("%s: got %d generations, want %d", tt.name, len(client.created), tt.creates)
+		}
+		if tt.want == nil && (generationID != "generation3" || len(images) != 1) {
+			t.Errorf("%s: got generation %q with %d images, want the last attempt", tt.name, generationID, len(images))
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"automation/leoverse/pkg/airtable"
+	"automation/leoverse/pkg/leonardo"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newAirtableCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("airtable", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	var accounts accountFlags
+	accounts.register(fs)
+	skipNSFW := fs.Bool("skip-nsfw", false, "Don't upload images flagged as NSFW")
+	cancelOnExit := fs.Bool("cancel-on-exit", false, "Cancel the running generation on Leonardo.ai when interrupted")
+	numImages := fs.Int("num-images", leoverse.DefaultNumImages, "Number of images generated and uploaded per record")
+	webhookURL := fs.String("webhook-url", "", "URL notified when each generation finishes (signed with LEOVERSE_WEBHOOK_SECRET)")
+	filter := fs.String("filter", "NOT({Generated})", "Airtable formula selecting the records to process")
+	view := fs.String("view", "", "Airtable view to read the records from")
+	replace := fs.Bool("replace", false, "Replace existing attachments instead of appending")
+	outputDir := fs.String("output-dir", "", "Directory keeping the images of each record in a subdirectory named after the record ID (default is a temporary directory, or output/airtable with --keep-files)")
+	keepFiles := fs.Bool("keep-files", false, "Keep the generated images after uploading them, implied by --output-dir")
+	uploadFiles := fs.Bool("upload-files", false, "Upload the downloaded images instead of attaching them from their Leonardo.ai URL (limited to 5MB per image)")
+	shrinkImages := fs.Bool("shrink-images", false, "Recompress and downscale the uploaded images larger than 5MB until they fit, instead of failing")
+	jpegQuality := fs.Int("jpeg-quality", airtable.DefaultJPEGQuality, "Initial JPEG quality of the shrunk images, lowered until they fit")
+	maxDimension := fs.Int("max-dimension", 0, "Longest side in pixels the shrunk images are first scaled down to (0 keeps their size)")
+	attachmentField := fs.String("attachment-field", airtable.DefaultAttachmentField, "Attachment field the images are added to")
+	checkpointFile := fs.String("checkpoint", "", "File recording the processed records, so an interrupted batch resumes without processing them again (default is a file per base and table in the user cache directory)")
+	noCheckpoint := fs.Bool("no-checkpoint", false, "Don't record the processed records in a checkpoint file")
+	blockedField := fs.String("blocked-field", "", "Checkbox field checked on the records whose prompt was blocked by moderation, so the filter can exclude them")
+	airtableTimeout := fs.Duration("airtable-timeout", airtable.DefaultTimeout, "Timeout of each request to Airtable, including the attachment uploads")
+	hashField := fs.String("hash-field", "", "Text field storing the image hashes, used to skip images already attached to the record")
+
+	return &ffcli.Command{
+		Name:       "airtable",
+		ShortUsage: "leoverse airtable [flags]",
+		ShortHelp:  "Generate images for the prompts in an Airtable table",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if err := checkShrinkFlags(fs, *uploadFiles && *shrinkImages, *jpegQuality, *maxDimension); err != nil {
+				return err
+			}
+
+			// Get Airtable configuration from environment variables
+			apiKey := os.Getenv("AIRTABLE_API_KEY")
+			baseID := os.Getenv("AIRTABLE_BASE_ID")
+			tableName := os.Getenv("AIRTABLE_TABLE_NAME")
+
+			if apiKey == "" || baseID == "" || tableName == "" {
+				return errors.New("please set AIRTABLE_API_KEY, AIRTABLE_BASE_ID, and AIRTABLE_TABLE_NAME environment variables")
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+			if err := accounts.apply(cfg); err != nil {
+				return err
+			}
+			cfg.SkipNSFW = *skipNSFW
+			cfg.CancelOnExit = *cancelOnExit
+			cfg.NumImages = *numImages
+			cfg.WebhookURL = *webhookURL
+			cfg.WebhookSecret = os.Getenv("LEOVERSE_WEBHOOK_SECRET")
+			// Images must be downloaded locally to be uploaded to Airtable
+			cfg.S3 = nil
+
+			// Log in once and reuse the client for every prompt
+			client, err := leoverse.StartGenerationClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer client.Stop(context.Background())
+
+			checkpoint := *checkpointFile
+			if *noCheckpoint {
+				checkpoint = ""
+			} else if checkpoint == "" {
+				if checkpoint, err = defaultCheckpoint(baseID, tableName); err != nil {
+					return err
+				}
+			}
+
+			// Initialize Airtable client, going through the proxy too
+			httpClient, err := leoverse.NewHTTPClient(cfg)
+			if err != nil {
+				return err
+			}
+			airtableClient := airtable.NewClient(apiKey, baseID, tableName,
+				airtable.WithHTTPClient(httpClient),
+				airtable.WithTimeout(*airtableTimeout),
+				airtable.WithReplaceAttachments(*replace),
+				airtable.WithFilterByFormula(*filter),
+				airtable.WithView(*view),
+				airtable.WithHashField(*hashField),
+				airtable.WithBlockedField(*blockedField),
+				airtable.WithAttachmentField(*attachmentField),
+				airtable.WithShrinkImages(*shrinkImages, *jpegQuality, *maxDimension),
+				airtable.WithCheckpoint(checkpoint),
+			)
+			log.Printf("Initialized Airtable client for base %s, table %s", baseID, tableName)
+
+			// Authentication and rate limit errors would fail every remaining
+			// prompt, so they abort the batch
+			ctx, abort := context.WithCancelCause(ctx)
+			defer abort(nil)
+
+			// The images of each record are stored in a directory named after
+			// the record, so they can be inspected if the upload fails
+			baseDir := *outputDir
+			switch {
+			case baseDir != "":
+			case *keepFiles:
+				baseDir = filepath.Join("output", "airtable")
+			default:
+				if baseDir, err = os.MkdirTemp("", "leoverse-airtable-*"); err != nil {
+					return fmt.Errorf("couldn't create temp directory: %w", err)
+				}
+				defer os.RemoveAll(baseDir)
+			}
+			cfg.OutputDir = baseDir
+
+			// Process prompts from Airtable
+			processFunc := func(recordID, prompt string) ([]airtable.Attachment, error) {
+				// Remove the images of previous runs, which would be uploaded
+				// again
+				dir := filepath.Join(baseDir, recordID)
+				if err := os.RemoveAll(dir); err != nil {
+					return nil, fmt.Errorf("couldn't clean output directory: %w", err)
+				}
+				log.Printf("Using output directory: %s", dir)
+				log.Printf("Processing prompt: %q", leoverse.SanitizePrompt(prompt))
+
+				// Generate image
+				recordCfg := cfg.Subdir(recordID)
+				result, err := leoverse.GenerateImageWithClient(ctx, recordCfg, client, prompt)
+				if err != nil {
+					log.Printf("Error generating image: %v", err)
+					if errors.Is(err, leonardo.ErrAuth) || errors.Is(err, leonardo.ErrRateLimited) {
+						abort(err)
+					}
+					if errors.Is(err, leonardo.ErrContentBlocked) {
+						return nil, fmt.Errorf("%w: %w", airtable.ErrBlocked, err)
+					}
+					return nil, fmt.Errorf("generation failed: %w", err)
+				}
+				log.Printf("Successfully generated image for prompt: %q", leoverse.SanitizePrompt(prompt))
+
+				// Airtable fetches the images from their URL, the files are
+				// only uploaded if requested
+				attachments := make([]airtable.Attachment, len(result.Files))
+				for i, f := range result.Files {
+					attachments[i].Path = f
+					if !*uploadFiles {
+						attachments[i].URL = result.Sources[i]
+					}
+				}
+				return attachments, nil
+			}
+
+			log.Println("Starting to process prompts from Airtable...")
+			result, err := airtableClient.ProcessPromptAttachments(ctx, processFunc)
+			if err != nil {
+				if cause := context.Cause(ctx); cause != nil && cause != err {
+					err = cause
+				}
+				log.Printf("Error processing prompts: %v", err)
+				return fmt.Errorf("couldn't process prompts: %w", err)
+			}
+			for _, rec := range result.Records {
+				if rec.Status == airtable.StatusBlocked {
+					fmt.Printf("Blocked record %s %q: %v\n", rec.RecordID, rec.Prompt, rec.Err)
+				}
+			}
+			if result.Failed > 0 {
+				for _, rec := range result.Records {
+					if rec.Status == airtable.StatusFailed {
+						fmt.Printf("Failed record %s %q: %v\n", rec.RecordID, rec.Prompt, rec.Err)
+					}
+				}
+				return fmt.Errorf("%d of %d records failed", result.Failed, len(result.Records))
+			}
+			log.Println("Successfully completed processing all prompts")
+			return nil
+		},
+	}
+}
+
+// checkShrinkFlags validates the flags of the image shrinking, which are only
+// used when shrinking the uploaded images.
+func checkShrinkFlags(fs *flag.FlagSet, shrink bool, jpegQuality, maxDimension int) error {
+	if jpegQuality < 1 || jpegQuality > 100 {
+		return fmt.Errorf("--jpeg-quality must be between 1 and 100, got %d", jpegQuality)
+	}
+	if maxDimension < 0 {
+		return fmt.Errorf("--max-dimension can't be negative, got %d", maxDimension)
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if !shrink && err == nil && (f.Name == "jpeg-quality" || f.Name == "max-dimension") {
+			err = fmt.Errorf("--%s requires --shrink-images and --upload-files", f.Name)
+		}
+	})
+	return err
+}
+
+// defaultCheckpoint returns the checkpoint file of the base and table in the
+// user cache directory.
+func defaultCheckpoint(baseID, tableName string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find the checkpoint directory, use --checkpoint or --no-checkpoint: %w", err)
+	}
+	name := fmt.Sprintf("airtable-%s-%s.jsonl", baseID, url.PathEscape(tableName))
+	return filepath.Join(dir, "leoverse", name), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestAirtableShrinkFlags(t *testing.T) {
+	// The valid flags fail later on the missing Airtable configuration
+	t.Setenv("AIRTABLE_API_KEY", "")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "AIRTABLE_API_KEY"},
+		{[]string{"--upload-files", "--shrink-images", "--jpeg-quality", "75", "--max-dimension", "2048"}, "AIRTABLE_API_KEY"},
+		{[]string{"--upload-files", "--shrink-images", "--jpeg-quality", "0"}, "--jpeg-quality must be between 1 and 100"},
+		{[]string{"--upload-files", "--shrink-images", "--jpeg-quality", "101"}, "--jpeg-quality must be between 1 and 100"},
+		{[]string{"--upload-files", "--shrink-images", "--max-dimension", "-1"}, "--max-dimension can't be negative"},
+		{[]string{"--jpeg-quality", "75"}, "--jpeg-quality requires"},
+		{[]string{"--shrink-images", "--max-dimension", "2048"}, "--max-dimension requires"},
+		{[]string{"--upload-files", "--jpeg-quality", "75"}, "--jpeg-quality requires"},
+	}
+	for _, tt := range tests {
+		cmd := newAirtableCommand()
+		if err := cmd.FlagSet.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		err := cmd.Exec(context.Background(), nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: got error %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
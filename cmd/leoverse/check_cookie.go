@@ -0,0 +1,86 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newCheckCookieCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("check-cookie", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	cookieFile := fs.String("cookie-file", "", "Cookie file to check (default is the cookie file used by the other commands)")
+	online := fs.Bool("online", false, "Also authenticate with Leonardo.ai to check the session is accepted")
+
+	return &ffcli.Command{
+		Name:       "check-cookie",
+		ShortUsage: "leoverse check-cookie [flags]",
+		ShortHelp:  "Validate the cookie file and print the session it contains",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			path := *cookieFile
+			if path == "" {
+				var err error
+				if path, err = findCookieFile(); err != nil {
+					return err
+				}
+			}
+			fmt.Printf("Cookie file: %s\n", path)
+
+			cookie, err := readCookieFile(path)
+			if err != nil {
+				return err
+			}
+			info, err := leonardo.InspectCookie(cookie)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Format: %s\n", info.Format)
+			fmt.Printf("Email: %s\n", orUnknown(info.Email))
+			fmt.Printf("Issued at: %s\n", formatTime(info.IssuedAt))
+			fmt.Printf("Expires at: %s\n", formatTime(info.ExpiresAt))
+			if info.Expired(time.Now()) {
+				return fmt.Errorf("the token expired at %s, export a new session", info.ExpiresAt.Format(time.RFC3339))
+			}
+
+			if !*online {
+				return nil
+			}
+			client, err := leoverse.StartClient(ctx, common.configWithCookie(cookie))
+			if err != nil {
+				return err
+			}
+			defer client.Stop(ctx)
+			user, err := client.WhoAmI(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Authenticated as: %s (%s plan)\n", user.Email, user.Plan)
+			return nil
+		},
+	}
+}
+
+// formatTime formats the time, which is unknown if zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// orUnknown returns s, or "unknown" if it's empty.
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
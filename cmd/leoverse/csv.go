@@ -0,0 +1,157 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newCSVCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("csv", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	var accounts accountFlags
+	accounts.register(fs)
+	in := fs.String("in", "", "Input CSV file with a prompt column")
+	out := fs.String("out", "results.csv", "Output CSV file")
+	skipNSFW := fs.Bool("skip-nsfw", false, "Don't download images flagged as NSFW")
+	cancelOnExit := fs.Bool("cancel-on-exit", false, "Cancel the running generation on Leonardo.ai when interrupted")
+
+	return &ffcli.Command{
+		Name:       "csv",
+		ShortUsage: "leoverse csv --in prompts.csv --out results.csv",
+		ShortHelp:  "Generate images for the prompts in a CSV file",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if *in == "" {
+				return errors.New("please provide the input file with --in")
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+			if err := accounts.apply(cfg); err != nil {
+				return err
+			}
+			cfg.SkipNSFW = *skipNSFW
+			cfg.CancelOnExit = *cancelOnExit
+
+			return generateCSV(ctx, cfg, *in, *out)
+		},
+	}
+}
+
+// generateCSV generates the prompts of the input CSV and writes its rows to
+// the output CSV with the image_paths and generation_id columns appended. The
+// prompts are templates whose {column} variables are replaced with the values
+// of the row.
+func generateCSV(ctx context.Context, cfg *leoverse.Config, inPath, outPath string) error {
+	inFile, err := os.Open(inPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open input file: %w", err)
+	}
+	defer inFile.Close()
+
+	r := csv.NewReader(inFile)
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("couldn't read csv header: %w", err)
+	}
+	promptCol := -1
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), "prompt") {
+			promptCol = i
+			break
+		}
+	}
+	if promptCol < 0 {
+		return fmt.Errorf("no prompt column in %s", inPath)
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return fmt.Errorf("couldn't create output file: %w", err)
+	}
+	defer outFile.Close()
+	w := csv.NewWriter(outFile)
+	if err := w.Write(append(header, "image_paths", "generation_id")); err != nil {
+		return err
+	}
+
+	client, err := leoverse.StartGenerationClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Stop(context.Background())
+
+	var failed, total int
+	for row := 1; ; row++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't read csv row %d: %w", row, err)
+		}
+
+		var paths, generationID string
+		if tmpl := strings.TrimSpace(record[promptCol]); tmpl != "" {
+			total++
+			// The prompt may use the other columns as {column} variables,
+			// other braces are kept as is
+			prompt := leoverse.ExpandKnownVariables(tmpl, rowValues(header, record))
+			// Keep the images of each row apart
+			dir := fmt.Sprintf("row_%03d", row)
+			result, err := leoverse.GenerateImageWithClient(ctx, cfg.Subdir(dir), client, prompt)
+			if err == nil {
+				paths = strings.Join(result.Files, ";")
+				generationID = result.GenerationID
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				failed++
+				fmt.Fprintf(os.Stderr, "Error generating row %d: %v\n", row, err)
+			}
+		}
+
+		// Flush each row so the results survive an interruption
+		if err := w.Write(append(record, paths, generationID)); err != nil {
+			return err
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("couldn't write output file: %w", err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d prompts failed", failed, total)
+	}
+	return nil
+}
+
+// rowValues maps the column names to the values of the row.
+func rowValues(header, record []string) map[string]string {
+	values := make(map[string]string, len(header))
+	for i, name := range header {
+		if i < len(record) {
+			values[strings.TrimSpace(name)] = record[i]
+		}
+	}
+	return values
+}
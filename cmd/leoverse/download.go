@@ -0,0 +1,50 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newDownloadCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+
+	proxy := fs.String("proxy", "", "Proxy URL (http, https or socks5)")
+	concurrency := fs.Int("concurrency", leoverse.DefaultConcurrency, "Number of images downloaded at the same time")
+	noProgress := fs.Bool("no-progress", false, "Log each download instead of showing a progress bar on terminals")
+	timeout := fs.Duration("timeout", leoverse.DefaultDownloadTimeout, "Timeout of each download, negative disables it")
+
+	return &ffcli.Command{
+		Name:       "download",
+		ShortUsage: "leoverse download [flags] <url>...",
+		ShortHelp:  "Download images to the output directory",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return errors.New("please provide the image urls")
+			}
+			// Downloads don't need the Leonardo cookie
+			cfg := &leoverse.Config{
+				Proxy:           *proxy,
+				ProxyUsername:   os.Getenv("LEOVERSE_PROXY_USERNAME"),
+				ProxyPassword:   os.Getenv("LEOVERSE_PROXY_PASSWORD"),
+				S3:              s3Config(),
+				DownloadTimeout: *timeout,
+			}
+			// The progress bar is redrawn in place, which only works on
+			// terminals
+			if !*noProgress && isTerminal(os.Stdout) {
+				bar := newProgressBar(os.Stdout, "downloaded")
+				defer bar.Finish()
+				cfg.Output = bar
+				cfg.OnDownload = bar.Update
+			}
+			_, err := leoverse.DownloadURLs(ctx, cfg, args, *concurrency)
+			return err
+		},
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newFetchCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+
+	return &ffcli.Command{
+		Name:       "fetch",
+		ShortUsage: "leoverse fetch [flags] <generation-id>",
+		ShortHelp:  "Download the images of a previous generation",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) < 1 {
+				return errors.New("please provide a generation id")
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			return leoverse.FetchGeneration(ctx, cfg, args[0])
+		},
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"automation/leoverse"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newGenerateCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	var accounts accountFlags
+	accounts.register(fs)
+	prompt := fs.String("prompt", "", "Prompt for image generation")
+	promptFile := fs.String("prompt-file", "", "File with one prompt per line, blank lines and lines starting with # are skipped")
+	concurrency := fs.Int("concurrency", leoverse.DefaultConcurrency, "Number of prompts of --prompt-file, or runs of --count, generated at the same time")
+	startDelay := fs.Duration("start-delay", 0, "Wait before starting the generation, or the batch")
+	stagger := fs.Duration("stagger", 0, "Minimum delay between the starts of the generations of --prompt-file or --count")
+	count := fs.Int("count", 1, "Number of separate generations of the prompt, each with its own seed, saved in run_NNN subdirectories")
+	varsFile := fs.String("vars", "", "JSON file mapping template variables to lists of values, expanding each {variable} of the prompts into every combination")
+	maxPrompts := fs.Int("max-prompts", leoverse.DefaultMaxPrompts, "Maximum total number of prompts expanded from the templates")
+	presetName := fs.String("preset", leoverse.DefaultPreset, "Preset with the model, style and size (default, cinematic, anime, photoreal or a user preset)")
+	presetsFile := fs.String("presets-file", "", "JSON file with user presets (default is presets.json in the leoverse config directory)")
+	numImages := fs.Int("num-images", leoverse.DefaultNumImages, "Number of images generated per prompt")
+	steps := fs.Int("steps", 0, "Number of inference steps, overrides the preset")
+	width := fs.Int("width", 0, "Image width, overrides the preset")
+	height := fs.Int("height", 0, "Image height, overrides the preset")
+	aspect := fs.String("aspect", "", "Aspect ratio such as 16:9, overrides width and height")
+	negativePrompt := fs.String("negative-prompt", "", "Negative prompt for image generation")
+	seed := fs.Int64("seed", 0, "Seed for reproducible generations (0 means random)")
+	tiling := fs.Bool("tiling", false, "Generate seamless textures")
+	elements := fs.String("elements", "", "Comma-separated elements (LoRAs) as akUUID:weight, with weights between -1 and 2")
+	photoReal := fs.Bool("photoreal", false, "Generate with PhotoReal instead of the default model")
+	retries := fs.Int("retries", 0, "Number of times a failed generation is re-submitted")
+	downloadRetries := fs.Int("download-retries", leoverse.DefaultDownloadRetries, "Number of times the image URLs are re-fetched when they expire before the download, negative disables it")
+	pollInterval := fs.Duration("poll-interval", 2*time.Second, "Initial delay between generation status checks")
+	maxPollInterval := fs.Duration("max-poll-interval", 15*time.Second, "Maximum delay between generation status checks")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Abort the generation after this duration (0 means no timeout)")
+	requestTimeout := fs.Duration("request-timeout", time.Minute, "Timeout of each request to Leonardo.ai")
+	downloadTimeout := fs.Duration("download-timeout", leoverse.DefaultDownloadTimeout, "Timeout of each image download, negative disables it")
+	userAgent := fs.String("user-agent", "", "User-Agent sent to Leonardo.ai")
+	skipNSFW := fs.Bool("skip-nsfw", false, "Don't download images flagged as NSFW")
+	cancelOnExit := fs.Bool("cancel-on-exit", false, "Cancel the running generation on Leonardo.ai when interrupted")
+	noDownload := fs.Bool("no-download", false, "Only print the image URLs without downloading the images")
+	embedMetadata := fs.Bool("embed-metadata", false, "Write the prompt, model, seed and generation ID into the downloaded PNG images")
+	contactSheet := fs.Bool("contact-sheet", false, "Write a contact_sheet.png grid of the downloaded images")
+	manifest := fs.Bool("manifest", false, "Write a manifest.json listing the downloaded images with their URL, path, seed, size, prompt and model")
+	appendManifest := fs.Bool("append-manifest", false, "Add the images to the existing manifest.json instead of replacing it")
+	deleteAfterDownload := fs.Bool("delete", false, "Delete the generation from Leonardo after downloading")
+	webhookURL := fs.String("webhook-url", "", "URL notified when the generation finishes (signed with LEOVERSE_WEBHOOK_SECRET)")
+	jsonOutput := fs.Bool("json", false, "Print the result as JSON, sending progress messages to stderr")
+	noProgress := fs.Bool("no-progress", false, "Log each generation of a batch instead of showing a progress bar on terminals")
+	filenameTemplate := fs.String("filename-template", leoverse.DefaultFilenameTemplate, "Filename template ({index}, {prompt_slug}, {generation_id}, {timestamp})")
+
+	return &ffcli.Command{
+		Name:       "generate",
+		ShortUsage: "leoverse generate [flags] [<prompt>]",
+		ShortHelp:  "Generate image using Leonardo.ai",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			p := *prompt
+			if p == "" {
+				p = strings.Join(args, " ")
+			}
+			if p == "" && *promptFile == "" {
+				return errors.New("please provide a prompt")
+			}
+			preset, err := leoverse.FindPreset(*presetName, presetsPath(*presetsFile))
+			if err != nil {
+				return err
+			}
+			if *aspect != "" {
+				// Keep the longer side of the requested size
+				target := max(*width, *height)
+				if target == 0 {
+					target = max(preset.Width, preset.Height)
+				}
+				w, h, err := leonardo.DimensionsForAspect(*aspect, target)
+				if err != nil {
+					return err
+				}
+				*width, *height = w, h
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+			if err := accounts.apply(cfg); err != nil {
+				return err
+			}
+			cfg.Preset = preset
+			cfg.NumImages = *numImages
+			cfg.Steps = *steps
+			cfg.Width = *width
+			cfg.Height = *height
+			cfg.NegativePrompt = *negativePrompt
+			cfg.Seed = *seed
+			cfg.Tiling = *tiling
+			if cfg.Elements, err = parseElements(*elements); err != nil {
+				return err
+			}
+			cfg.PhotoReal = *photoReal
+			cfg.FilenameTemplate = *filenameTemplate
+			cfg.MaxGenerationRetries = *retries
+			cfg.DownloadRetries = *downloadRetries
+			cfg.PollInterval = *pollInterval
+			cfg.MaxPollInterval = *maxPollInterval
+			cfg.GenerationTimeout = *timeout
+			cfg.StartDelay = *startDelay
+			cfg.Stagger = *stagger
+			cfg.RequestTimeout = *requestTimeout
+			cfg.DownloadTimeout = *downloadTimeout
+			cfg.UserAgent = *userAgent
+			cfg.SkipNSFW = *skipNSFW
+			cfg.CancelOnExit = *cancelOnExit
+			cfg.SkipDownload = *noDownload
+			cfg.EmbedMetadata = *embedMetadata
+			cfg.ContactSheet = *contactSheet
+			cfg.WriteManifest = *manifest || *appendManifest
+			cfg.AppendManifest = *appendManifest
+			cfg.DeleteAfterDownload = *deleteAfterDownload
+			cfg.WebhookURL = *webhookURL
+			cfg.WebhookSecret = os.Getenv("LEOVERSE_WEBHOOK_SECRET")
+
+			if *jsonOutput {
+				cfg.Output = os.Stderr
+			}
+
+			if *count > 1 {
+				if *promptFile != "" || *varsFile != "" {
+					return errors.New("--count can't be combined with --prompt-file or --vars")
+				}
+				defer printResults(cfg, *count, *jsonOutput, !*noProgress)()
+				_, err := leoverse.GenerateCount(ctx, cfg, p, *count, *concurrency)
+				return err
+			}
+
+			if *promptFile != "" || *varsFile != "" {
+				prompts := []string{p}
+				if *promptFile != "" {
+					if prompts, err = readPromptFile(*promptFile); err != nil {
+						return err
+					}
+					if len(prompts) == 0 {
+						return fmt.Errorf("no prompts found in %s", *promptFile)
+					}
+				}
+				if *varsFile != "" {
+					if prompts, err = expandPrompts(prompts, *varsFile, *maxPrompts); err != nil {
+						return err
+					}
+				}
+				return generateBatch(ctx, cfg, prompts, *concurrency, *jsonOutput, !*noProgress)
+			}
+
+			result, err := leoverse.GenerateImage(ctx, cfg, p)
+			if err != nil {
+				return err
+			}
+			if *jsonOutput {
+				return json.NewEncoder(os.Stdout).Encode(result)
+			}
+			return nil
+		},
+	}
+}
+
+// generateBatch generates the prompts with a single client, saving the images
+// of each prompt in its own subdirectory.
+func generateBatch(ctx context.Context, cfg *leoverse.Config, prompts []string, concurrency int, jsonOutput, progress bool) error {
+	defer printResults(cfg, len(prompts), jsonOutput, progress)()
+	_, err := leoverse.GenerateBatch(ctx, cfg, prompts, concurrency)
+	return err
+}
+
+// printResults reports each generation of a batch as soon as it completes:
+// its outcome on stderr and, if requested, its result as a JSON line on
+// stdout, so the results of an interrupted batch aren't lost. If progress is
+// set and stderr is a terminal, a progress bar of the finished generations is
+// shown below the messages, except with --json. The returned function ends
+// the bar.
+func printResults(cfg *leoverse.Config, total int, jsonOutput, progress bool) func() {
+	// The progress bar is redrawn in place, which only works on terminals
+	return reportResults(cfg, total, jsonOutput, progress && isTerminal(os.Stderr), os.Stdout, os.Stderr)
+}
+
+// reportResults is printResults writing to the given outputs.
+func reportResults(cfg *leoverse.Config, total int, jsonOutput, progress bool, stdout, stderr io.Writer) func() {
+	enc := json.NewEncoder(stdout)
+	out := stderr
+	var bar *progressBar
+	// The JSON output falls back to plain logging, for the tools reading it
+	if progress && !jsonOutput {
+		bar = newProgressBar(stderr, "generated")
+		out = bar
+		cfg.Output = bar
+	}
+	done := 0
+	cfg.OnResult = func(index int, result *leoverse.Result, err error) {
+		done++
+		if bar != nil {
+			bar.Update(done, total)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "[%d/%d] Generation %d failed: %v\n", done, total, index+1, err)
+			return
+		}
+		fmt.Fprintf(out, "[%d/%d] Generation %d completed: %s\n", done, total, index+1, result.GenerationID)
+		if jsonOutput {
+			if err := enc.Encode(result); err != nil {
+				fmt.Fprintf(out, "Couldn't print result: %v\n", err)
+			}
+		}
+	}
+	return func() {
+		if bar != nil {
+			bar.Finish()
+		}
+	}
+}
+
+// expandPrompts expands the template variables of the prompts with the values
+// of the JSON vars file. It fails if the templates expand to more than
+// maxPrompts prompts in total.
+func expandPrompts(templates []string, varsFile string, maxPrompts int) ([]string, error) {
+	if maxPrompts <= 0 {
+		maxPrompts = leoverse.DefaultMaxPrompts
+	}
+	data, err := os.ReadFile(varsFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read vars file: %w", err)
+	}
+	var vars map[string][]string
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return nil, fmt.Errorf("couldn't parse vars file %s: %w", varsFile, err)
+	}
+	var prompts []string
+	for _, tmpl := range templates {
+		expanded, err := leoverse.ExpandPrompts(tmpl, vars, maxPrompts)
+		if err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, expanded...)
+		if len(prompts) > maxPrompts {
+			return nil, fmt.Errorf("the prompt templates expand to more than %d prompts", maxPrompts)
+		}
+	}
+	return prompts, nil
+}
+
+// parseElements parses the comma-separated akUUID:weight elements of the
+// --elements flag.
+func parseElements(s string) ([]leonardo.Element, error) {
+	var elements []leonardo.Element
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, weight, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid element %q, expected akUUID:weight", field)
+		}
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid element weight %q: %w", weight, err)
+		}
+		elements = append(elements, leonardo.Element{AkUUID: id, Weight: w})
+	}
+	return elements, nil
+}
+
+// presetsPath returns the presets file to load: the given path, or the
+// presets.json file of the leoverse config directory if it exists.
+func presetsPath(path string) string {
+	if path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	path = filepath.Join(dir, "leoverse", "presets.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// readPromptFile returns the non-empty lines of the file that aren't comments.
+func readPromptFile(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open prompt file: %w", err)
+	}
+	defer f.Close()
+
+	var prompts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prompts = append(prompts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read prompt file: %w", err)
+	}
+	return prompts, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"automation/leoverse"
+)
+
+func TestReportResults(t *testing.T) {
+	for _, jsonOutput := range []bool{false, true} {
+		var stdout, stderr bytes.Buffer
+		cfg := &leoverse.Config{}
+		finish := reportResults(cfg, 2, jsonOutput, true, &stdout, &stderr)
+		cfg.OnResult(0, &leoverse.Result{Prompt: "a cat", GenerationID: "generation"}, nil)
+		finish()
+
+		bar := strings.Contains(stderr.String(), "1/2 generated")
+		if bar == jsonOutput {
+			t.Errorf("json %v: progress bar shown = %v, output %q", jsonOutput, bar, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), "[1/2] Generation 1 completed: generation") {
+			t.Errorf("json %v: result not logged: %q", jsonOutput, stderr.String())
+		}
+		if !jsonOutput {
+			continue
+		}
+		var result leoverse.Result
+		if err := json.Unmarshal(stdout.Bytes(), &result); err != nil || result.GenerationID != "generation" {
+			t.Errorf("got result %q, %v", stdout.String(), err)
+		}
+	}
+}
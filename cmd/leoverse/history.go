@@ -0,0 +1,71 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newHistoryCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	limit := fs.Int("limit", 10, "Number of generations to list, 0 lists every matching generation")
+	offset := fs.Int("offset", 0, "Number of generations to skip")
+	since := fs.String("since", "", "Only list the generations created on or after the date (YYYY-MM-DD or RFC 3339)")
+	until := fs.String("until", "", "Only list the generations created before the date (YYYY-MM-DD or RFC 3339)")
+	status := fs.String("status", "", "Only list the generations with the status, such as COMPLETE or FAILED")
+
+	return &ffcli.Command{
+		Name:       "history",
+		ShortUsage: "leoverse history [flags]",
+		ShortHelp:  "List past generations",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			filter := leonardo.GenerationFilter{Status: *status}
+			var err error
+			if filter.Since, err = parseDate(*since); err != nil {
+				return fmt.Errorf("invalid --since: %w", err)
+			}
+			if filter.Until, err = parseDate(*until); err != nil {
+				return fmt.Errorf("invalid --until: %w", err)
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			gens, err := leoverse.ListGenerationsFiltered(ctx, cfg, filter, *limit, *offset)
+			if err != nil {
+				return err
+			}
+			for _, gen := range gens {
+				fmt.Printf("%s %s %s %q\n", gen.ID, gen.CreatedAt, gen.Status, leoverse.SanitizePrompt(gen.Prompt))
+				for i, img := range gen.Images {
+					fmt.Printf("  %d. %s\n", i+1, img.URL)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// parseDate parses a date in the local time zone, or an RFC 3339 time. An
+// empty string is the zero time.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
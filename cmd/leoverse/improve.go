@@ -0,0 +1,44 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newImprovePromptCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("improve-prompt", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+
+	return &ffcli.Command{
+		Name:       "improve-prompt",
+		ShortUsage: "leoverse improve-prompt [flags] <prompt>",
+		ShortHelp:  "Print the prompt enhanced by Leonardo.ai",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			prompt := strings.Join(args, " ")
+			if prompt == "" {
+				return errors.New("please provide a prompt")
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			improved, err := leoverse.ImprovePrompt(ctx, cfg, prompt)
+			if err != nil {
+				return err
+			}
+			fmt.Println(improved)
+			return nil
+		},
+	}
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"automation/leoverse"
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"strings"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"automation/leoverse/pkg/airtable"
+	"automation/leoverse/pkg/leonardo"
 
 	"github.com/joho/godotenv"
 
@@ -26,87 +31,164 @@ var version = ""
 var commit = ""
 var date = ""
 
-func mainCmd() {
-	// Create signal based context
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
-
-	// Launch command
-	cmd := newCommand()
-	if err := cmd.ParseAndRun(ctx, os.Args[1:]); err != nil {
-		log.Fatal(err)
-	}
-}
-
 func newCommand() *ffcli.Command {
 	fs := flag.NewFlagSet("leoverse", flag.ExitOnError)
 
-	var (
-		cookie string
-		debug  bool
-		proxy  string
-	)
-
-	fs.StringVar(&cookie, "cookie", "", "Leonardo.ai cookie")
-	fs.BoolVar(&debug, "debug", false, "Enable debug mode")
-	fs.StringVar(&proxy, "proxy", "", "Proxy URL")
-
 	return &ffcli.Command{
-		ShortUsage: "leoverse [flags] <subcommand>",
+		ShortUsage: "leoverse <subcommand> [flags]",
 		FlagSet:    fs,
 		Subcommands: []*ffcli.Command{
 			newVersionCommand(),
-			newGenerateCommand(cookie, debug, proxy),
+			newGenerateCommand(),
+			newAirtableCommand(),
+			newHistoryCommand(),
+			newFetchCommand(),
+			newVariationCommand(),
+			newMotionCommand(),
+			newReplCommand(),
+			newCSVCommand(),
+			newImprovePromptCommand(),
+			newWhoAmICommand(),
+			newTokenCommand(),
+			newCheckCookieCommand(),
+			newDownloadCommand(),
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
 		},
 	}
 }
 
-func newGenerateCommand(cookie string, debug bool, proxy string) *ffcli.Command {
-	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+// commonFlags are the flags shared by the subcommands that talk to
+// Leonardo.ai.
+type commonFlags struct {
+	debug       bool
+	verbose     bool
+	proxy       string
+	proxyList   string
+	proxyPerGen bool
+	dumpDir     string
+	blocklist   string
+}
 
-	var (
-		genCookie string
-		genDebug  bool
-		genProxy  string
-	)
+func (f *commonFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.debug, "debug", false, "Enable debug mode, logging the requests and responses")
+	fs.BoolVar(&f.verbose, "verbose", false, "Log the progress (authentication, jobs, polling and retries) to stderr")
+	fs.StringVar(&f.proxy, "proxy", "", "Proxy URL (http, https or socks5)")
+	fs.StringVar(&f.proxyList, "proxy-list", "", "File with one proxy URL per line, used in turn instead of --proxy")
+	fs.BoolVar(&f.proxyPerGen, "proxy-per-generation", false, "Send all the requests of a generation through the same proxy of --proxy-list, instead of rotating on each request")
+	fs.StringVar(&f.dumpDir, "dump-responses", "", "Directory to save each GraphQL request and response to, with the credentials redacted")
+	fs.StringVar(&f.blocklist, "blocklist", os.Getenv("LEOVERSE_BLOCKLIST"), "File with one blocked term per line, rejecting the prompts containing them before they're sent")
+}
 
-	fs.StringVar(&genCookie, "cookie", cookie, "Leonardo.ai cookie")
-	fs.BoolVar(&genDebug, "debug", debug, "Enable debug mode")
-	fs.StringVar(&genProxy, "proxy", proxy, "Proxy URL")
+// accountFlags are the flags of the batch commands that can rotate between
+// several accounts.
+type accountFlags struct {
+	cookieFiles string
+	cooldown    time.Duration
+}
 
-	return &ffcli.Command{
-		Name:       "generate",
-		ShortUsage: "leoverse generate [flags] <prompt>",
-		ShortHelp:  "Generate image using Leonardo.ai",
-		FlagSet:    fs,
-		Exec: func(ctx context.Context, args []string) error {
-			if len(args) < 1 {
-				return fmt.Errorf("prompt is required")
-			}
+func (f *accountFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.cookieFiles, "cookie-files", "", "Comma-separated cookie files of additional accounts, used in turn when an account is rate limited or out of credits")
+	fs.DurationVar(&f.cooldown, "account-cooldown", leonardo.DefaultCooldown, "How long an account is skipped after it's rate limited or out of credits")
+}
 
-			// If no cookie provided, try to read from cookie.txt
-			if genCookie == "" {
-				data, err := os.ReadFile("cookie.txt")
-				if err == nil {
-					var session struct {
-						AccessToken string `json:"accessToken"`
-					}
-					if err := json.Unmarshal(data, &session); err == nil && session.AccessToken != "" {
-						genCookie = fmt.Sprintf("__Secure-next-auth.session-token=%s", session.AccessToken)
-					} else {
-						genCookie = strings.TrimSpace(string(data))
-					}
-				}
-			}
+// apply reads the cookie files of the additional accounts into the config.
+func (f *accountFlags) apply(cfg *leoverse.Config) error {
+	for _, path := range strings.Split(f.cookieFiles, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		cookie, err := readCookieFile(path)
+		if err != nil {
+			return err
+		}
+		cfg.Cookies = append(cfg.Cookies, cookie)
+	}
+	cfg.AccountCooldown = f.cooldown
+	return nil
+}
 
-			cfg := &leoverse.Config{
-				Cookie: genCookie,
-				Debug:  genDebug,
-				Proxy:  genProxy,
-			}
+// config loads the cookie and returns the base configuration.
+func (f *commonFlags) config() (*leoverse.Config, error) {
+	cookie, err := loadCookie()
+	if err != nil {
+		return nil, err
+	}
+	cfg := f.configWithCookie(cookie)
+	if f.proxyList != "" {
+		if f.proxy != "" {
+			return nil, errors.New("--proxy and --proxy-list are mutually exclusive")
+		}
+		if cfg.ProxyList, err = readListFile(f.proxyList); err != nil {
+			return nil, fmt.Errorf("couldn't read proxy list: %w", err)
+		}
+		if len(cfg.ProxyList) == 0 {
+			return nil, fmt.Errorf("proxy list %s is empty", f.proxyList)
+		}
+	}
+	if f.blocklist != "" {
+		if cfg.BlockedTerms, err = readListFile(f.blocklist); err != nil {
+			return nil, fmt.Errorf("couldn't read blocklist: %w", err)
+		}
+	}
+	return cfg, nil
+}
 
-			return leoverse.GenerateImage(ctx, cfg, args[0])
-		},
+// readListFile returns the entries of a list file, such as the blocklist or the
+// proxy list, one per line, skipping blank lines and comments.
+func readListFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// configWithCookie returns the base configuration using the given cookie.
+func (f *commonFlags) configWithCookie(cookie string) *leoverse.Config {
+	if f.debug || f.verbose {
+		// Logging is disabled by default in main
+		log.SetOutput(os.Stderr)
+	}
+	return &leoverse.Config{
+		Cookie:             cookie,
+		Debug:              f.debug,
+		Verbose:            f.verbose,
+		Proxy:              f.proxy,
+		ProxyPerGeneration: f.proxyPerGen,
+		ResponseDumpDir:    f.dumpDir,
+		ProxyUsername:      os.Getenv("LEOVERSE_PROXY_USERNAME"),
+		ProxyPassword:      os.Getenv("LEOVERSE_PROXY_PASSWORD"),
+		BaseURL:            os.Getenv("LEOVERSE_BASE_URL"),
+		S3:                 s3Config(),
+	}
+}
+
+// s3Config returns the S3 configuration from the environment, or nil if
+// S3_BUCKET is not set.
+func s3Config() *leoverse.S3Config {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	return &leoverse.S3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    bucket,
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		Prefix:    os.Getenv("S3_PREFIX"),
+		Insecure:  os.Getenv("S3_INSECURE") == "true",
 	}
 }
 
@@ -138,137 +220,116 @@ func newVersionCommand() *ffcli.Command {
 	}
 }
 
-func main() {
-	// Disable non-essential logging
-	log.SetOutput(io.Discard)
-
-	// Load environment variables from .env file
-	if err := godotenv.Load(); err != nil {
-		fmt.Printf("Warning: Error loading .env file: %v\n", err)
+// findCookieFile returns the path of the cookie file. It uses the
+// LEOVERSE_COOKIE_FILE environment variable if set, otherwise it looks in the
+// user config directory and then in the current directory.
+func findCookieFile() (string, error) {
+	if p := os.Getenv("LEOVERSE_COOKIE_FILE"); p != "" {
+		if _, err := os.Stat(p); err != nil {
+			return "", fmt.Errorf("cookie file from LEOVERSE_COOKIE_FILE not found: %w", err)
+		}
+		return p, nil
 	}
 
-	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
-	prompt := generateCmd.String("prompt", "", "Prompt for image generation")
-	debug := generateCmd.Bool("debug", false, "Enable debug mode")
-	proxy := generateCmd.String("proxy", "", "Proxy URL")
-
-	airtableCmd := flag.NewFlagSet("airtable", flag.ExitOnError)
-	debugAirtable := airtableCmd.Bool("debug", false, "Enable debug mode")
-	proxyAirtable := airtableCmd.String("proxy", "", "Proxy URL")
-
-	if len(os.Args) < 2 {
-		fmt.Println("expected 'generate' or 'airtable' subcommands")
-		os.Exit(1)
+	var candidates []string
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "leoverse", "cookie.txt"))
 	}
+	candidates = append(candidates, "cookie.txt", filepath.Join("cmd", "leoverse", "cookie.txt"))
+	for _, p := range candidates {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("cookie file not found, looked in: %s (set LEOVERSE_COOKIE_FILE to use another path)", strings.Join(candidates, ", "))
+}
 
-	// Read cookie from file
-	cookie, err := os.ReadFile("cmd/leoverse/cookie.txt")
+// loadCookie finds, reads and validates the cookie file.
+func loadCookie() (string, error) {
+	cookiePath, err := findCookieFile()
 	if err != nil {
-		fmt.Printf("Error reading cookie file: %v\n", err)
-		os.Exit(1)
+		return "", err
 	}
+	return readCookieFile(cookiePath)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Handle interrupt signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-sigCh
-		cancel()
-	}()
-
-	switch os.Args[1] {
-	case "generate":
-		generateCmd.Parse(os.Args[2:])
-		if *prompt == "" {
-			fmt.Println("please provide a prompt")
-			os.Exit(1)
-		}
-
-		cfg := &leoverse.Config{
-			Cookie: string(cookie),
-			Debug:  *debug,
-			Proxy:  *proxy,
-		}
-
-		if err := leoverse.GenerateImage(ctx, cfg, *prompt); err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
-		}
+// maxCookieSize is the size above which the cookie file is rejected. Session
+// cookies are a few KB, so larger files aren't cookie files.
+const maxCookieSize = 64 << 10
 
-	case "airtable":
-		airtableCmd.Parse(os.Args[2:])
-		// Get Airtable configuration from environment variables
-		apiKey := os.Getenv("AIRTABLE_API_KEY")
-		baseID := os.Getenv("AIRTABLE_BASE_ID")
-		tableName := os.Getenv("AIRTABLE_TABLE_NAME")
+// readCookieFile reads and validates the cookie file at the given path.
+func readCookieFile(cookiePath string) (string, error) {
+	f, err := os.Open(cookiePath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read cookie file: %w", err)
+	}
+	defer f.Close()
+	// Reading a FIFO or a device could block forever or never end
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("couldn't read cookie file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("invalid cookie file %s: not a regular file", cookiePath)
+	}
+	if info.Size() > maxCookieSize {
+		return "", fmt.Errorf("invalid cookie file %s: %d bytes, maximum is %d", cookiePath, info.Size(), maxCookieSize)
+	}
+	// The file may grow after the stat
+	data, err := io.ReadAll(io.LimitReader(f, maxCookieSize+1))
+	if err != nil {
+		return "", fmt.Errorf("couldn't read cookie file: %w", err)
+	}
+	if len(data) > maxCookieSize {
+		return "", fmt.Errorf("invalid cookie file %s: larger than %d bytes", cookiePath, maxCookieSize)
+	}
+	// Editors on Windows may save the file with a byte order mark
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if err := checkPrintable(data); err != nil {
+		return "", fmt.Errorf("invalid cookie file %s: %w", cookiePath, err)
+	}
 
-		if apiKey == "" || baseID == "" || tableName == "" {
-			fmt.Println("please set AIRTABLE_API_KEY, AIRTABLE_BASE_ID, and AIRTABLE_TABLE_NAME environment variables")
-			os.Exit(1)
-		}
+	cookie := string(data)
+	if _, err := leonardo.NewMemCookieStoreChecked(cookie); err != nil {
+		return "", fmt.Errorf("invalid cookie file %s: %w", cookiePath, err)
+	}
+	return cookie, nil
+}
 
-		cfg := &leoverse.Config{
-			Cookie: string(cookie),
-			Debug:  *debugAirtable,
-			Proxy:  *proxyAirtable,
+// checkPrintable returns an error if the data isn't printable UTF-8 text,
+// which means a binary file was given as the cookie file.
+func checkPrintable(data []byte) error {
+	if !utf8.Valid(data) {
+		return errors.New("not UTF-8 text")
+	}
+	for i, r := range string(data) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return fmt.Errorf("non-printable character %U at byte %d", r, i)
 		}
+	}
+	return nil
+}
 
-		// Initialize Airtable client
-		airtableClient := airtable.NewClient(apiKey, baseID, tableName)
-		log.Printf("Initialized Airtable client for base %s, table %s", baseID, tableName)
-
-		// Process prompts from Airtable
-		processFunc := func(prompt string) (string, error) {
-			// Create temporary directory for each prompt
-			tempDir, err := os.MkdirTemp("", "leoverse-*")
-			if err != nil {
-				log.Printf("Error creating temp directory: %v", err)
-				return "", fmt.Errorf("couldn't create temp directory: %w", err)
-			}
-			log.Printf("Created temporary directory: %s", tempDir)
-
-			// Set output directory to temp directory
-			os.Setenv("OUTPUT_DIR", tempDir)
-			log.Printf("Processing prompt: %q", prompt)
-
-			// Generate image
-			if err := leoverse.GenerateImage(ctx, cfg, prompt); err != nil {
-				log.Printf("Error generating image: %v", err)
-				os.RemoveAll(tempDir)
-				return "", fmt.Errorf("generation failed: %w", err)
-			}
-			log.Printf("Successfully generated image for prompt: %q", prompt)
-
-			// Process all generated images
-			for i := 1; i <= 4; i++ {
-				imagePath := fmt.Sprintf("%s/image_%d.png", tempDir, i)
-				log.Printf("Processing image: %s", imagePath)
+func main() {
+	// Disable non-essential logging
+	log.SetOutput(io.Discard)
 
-				// Upload each image to Airtable
-				if err := airtableClient.UploadImage(prompt, imagePath); err != nil {
-					log.Printf("Error uploading image %d: %v", i, err)
-					continue
-				}
-				log.Printf("Successfully uploaded image %d to Airtable", i)
-			}
+	// Load environment variables from .env file
+	if err := godotenv.Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Error loading .env file: %v\n", err)
+	}
 
-			// Return success even if some uploads failed
-			return tempDir, nil
-		}
+	// Create signal based context
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-		log.Println("Starting to process prompts from Airtable...")
-		if err := airtableClient.ProcessPrompts(processFunc); err != nil {
-			log.Printf("Error processing prompts: %v", err)
-			fmt.Printf("Error processing prompts: %v\n", err)
+	// Launch command
+	cmd := newCommand()
+	if err := cmd.ParseAndRun(ctx, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
 			os.Exit(1)
 		}
-		log.Println("Successfully completed processing all prompts")
-
-	default:
-		fmt.Println("expected 'generate' or 'airtable' subcommands")
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
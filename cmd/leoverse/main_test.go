@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCookieFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Editors on Windows save the file with a byte order mark
+	cookie, err := readCookieFile(write("bom.txt", []byte("\xef\xbb\xbfsession=token; other=value\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cookie, "session=token") {
+		t.Errorf("got cookie %q, want the byte order mark removed", cookie)
+	}
+
+	tests := map[string]struct {
+		path string
+		want string
+	}{
+		"oversize":    {write("large.txt", []byte("session="+strings.Repeat("a", maxCookieSize))), "maximum is"},
+		"binary":      {write("image.png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")), "not UTF-8 text"},
+		"control":     {write("control.txt", []byte("session=token\x00")), "non-printable character U+0000"},
+		"non-regular": {dir, "not a regular file"},
+		"missing":     {filepath.Join(dir, "missing.txt"), "couldn't read cookie file"},
+	}
+	for name, tt := range tests {
+		_, err := readCookieFile(tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckPrintable(t *testing.T) {
+	for _, data := range []string{"session=token", "session=token;\r\n\tother=välue\n"} {
+		if err := checkPrintable([]byte(data)); err != nil {
+			t.Errorf("checkPrintable(%q) = %v, want nil", data, err)
+		}
+	}
+	for _, data := range []string{"\xff\xfe", "session=\x1b[0m", "session=\u200e"} {
+		if err := checkPrintable([]byte(data)); err == nil {
+			t.Errorf("checkPrintable(%q) = nil, want an error", data)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newMotionCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("motion", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	strength := fs.Int("strength", 5, "Motion strength, from 1 to 10")
+
+	return &ffcli.Command{
+		Name:       "motion",
+		ShortUsage: "leoverse motion [flags] <image-id>",
+		ShortHelp:  "Animate a generated image and download the MP4 video",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) < 1 {
+				return errors.New("please provide an image id")
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			_, err = leoverse.GenerateMotion(ctx, cfg, args[0], *strength)
+			return err
+		},
+	}
+}
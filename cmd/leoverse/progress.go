@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// progressBarWidth is the number of cells of the progress bar.
+const progressBarWidth = 30
+
+// progressBar renders the number of finished downloads or generations on the
+// last line of a terminal. The messages written to it are printed above the
+// bar, so it can be used as the output of the config.
+type progressBar struct {
+	mu    sync.Mutex
+	out   io.Writer
+	label string
+	done  int
+	total int
+}
+
+// newProgressBar returns a bar whose count is followed by the label, e.g.
+// "downloaded".
+func newProgressBar(out io.Writer, label string) *progressBar {
+	return &progressBar{out: out, label: label}
+}
+
+// Update sets the progress and redraws the bar. It matches
+// leoverse.Config.OnDownload.
+func (p *progressBar) Update(done, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done, p.total = done, total
+	p.render()
+}
+
+// Write prints the message above the bar.
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Clear the bar, print the message and draw the bar again below it
+	fmt.Fprint(p.out, "\r\033[K")
+	n, err := p.out.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		fmt.Fprintln(p.out)
+	}
+	p.render()
+	return n, nil
+}
+
+// Finish ends the line of the bar.
+func (p *progressBar) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.total > 0 {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// render draws the bar. The caller must hold the lock.
+func (p *progressBar) render() {
+	if p.total <= 0 {
+		return
+	}
+	filled := p.done * progressBarWidth / p.total
+	fmt.Fprintf(p.out, "\r\033[K[%s%s] %d/%d %s", strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), p.done, p.total, p.label)
+}
+
+// isTerminal reports whether the file is a terminal, where the progress bar
+// can be redrawn in place.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	bar := newProgressBar(&out, "downloaded")
+
+	// Nothing is drawn until the total is known
+	fmt.Fprint(bar, "Starting")
+	if got, want := out.String(), "\r\033[KStarting\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	out.Reset()
+	bar.Update(1, 3)
+	want := "\r\033[K[" + strings.Repeat("#", 10) + strings.Repeat(".", 20) + "] 1/3 downloaded"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The messages are printed above the bar
+	out.Reset()
+	fmt.Fprintln(bar, "Saved image_1.png")
+	if got := out.String(); got != "\r\033[KSaved image_1.png\n"+want {
+		t.Errorf("got %q after a message", got)
+	}
+
+	out.Reset()
+	bar.Update(3, 3)
+	bar.Finish()
+	if got := out.String(); got != "\r\033[K["+strings.Repeat("#", 30)+"] 3/3 downloaded\n" {
+		t.Errorf("got %q when finished", got)
+	}
+}
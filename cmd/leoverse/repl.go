@@ -0,0 +1,107 @@
+package main
+
+import (
+	"automation/leoverse"
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newReplCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	steps := fs.Int("steps", leoverse.DefaultSteps, "Number of inference steps")
+	width := fs.Int("width", leoverse.DefaultWidth, "Image width")
+	height := fs.Int("height", leoverse.DefaultHeight, "Image height")
+	negativePrompt := fs.String("negative-prompt", "", "Negative prompt for image generation")
+	skipNSFW := fs.Bool("skip-nsfw", false, "Don't download images flagged as NSFW")
+
+	return &ffcli.Command{
+		Name:       "repl",
+		ShortUsage: "leoverse repl [flags]",
+		ShortHelp:  "Generate images for the prompts read from stdin, one per line",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+			cfg.Steps = *steps
+			cfg.Width = *width
+			cfg.Height = *height
+			cfg.NegativePrompt = *negativePrompt
+			cfg.SkipNSFW = *skipNSFW
+			// Keep stdout for the image URLs
+			cfg.Output = os.Stderr
+
+			// Log in once for the whole session
+			client, err := leoverse.StartClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer client.Stop(context.Background())
+
+			lines := readLines(ctx)
+			for {
+				fmt.Fprint(os.Stderr, "> ")
+				var line string
+				var ok bool
+				select {
+				case <-ctx.Done():
+					fmt.Fprintln(os.Stderr)
+					return nil
+				case line, ok = <-lines:
+				}
+				if !ok {
+					return nil
+				}
+
+				prompt := strings.TrimSpace(line)
+				switch prompt {
+				case "":
+					continue
+				case "exit", "quit":
+					return nil
+				}
+
+				result, err := leoverse.GenerateImageWithClient(ctx, cfg, client, prompt)
+				if err != nil {
+					if ctx.Err() != nil {
+						fmt.Fprintln(os.Stderr)
+						return nil
+					}
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					continue
+				}
+				for _, u := range result.URLs {
+					fmt.Println(u)
+				}
+			}
+		},
+	}
+}
+
+// readLines sends the lines read from stdin to the returned channel, which is
+// closed at EOF.
+func readLines(ctx context.Context) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return lines
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newTokenCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	asJSON := fs.Bool("json", false, "Print the whole session as JSON: user ID, access token, expiry and refreshed cookie")
+	cookie := fs.Bool("cookie", false, "Print the refreshed session cookie instead of the access token")
+
+	return &ffcli.Command{
+		Name:       "token",
+		ShortUsage: "leoverse token [flags]",
+		ShortHelp:  "Authenticate and print the access token (a secret)",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			client, err := leoverse.StartClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer client.Stop(context.Background())
+
+			session, err := client.Session(ctx)
+			if err != nil {
+				return err
+			}
+			// Only the secret goes to stdout, so it can be captured
+			fmt.Fprintln(os.Stderr, "Warning: the output grants access to the account, keep it secret and don't log it")
+			switch {
+			case *asJSON:
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(session)
+			case *cookie:
+				fmt.Println(session.Cookie)
+			default:
+				fmt.Println(session.AccessToken)
+			}
+			return nil
+		},
+	}
+}
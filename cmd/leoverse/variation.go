@@ -0,0 +1,40 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"errors"
+	"flag"
+	"strings"
+
+	"automation/leoverse/pkg/leonardo"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newVariationCommand() *ffcli.Command {
+	fs := flag.NewFlagSet("variation", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+	variationType := fs.String("type", leonardo.VariationUnzoom, "Variation type (UNZOOM, UPSCALE or NOBG)")
+
+	return &ffcli.Command{
+		Name:       "variation",
+		ShortUsage: "leoverse variation [flags] <image-id>",
+		ShortHelp:  "Create a variation of a generated image",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) < 1 {
+				return errors.New("please provide an image id")
+			}
+
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			return leoverse.CreateVariation(ctx, cfg, args[0], strings.ToUpper(*variationType))
+		},
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"automation/leoverse"
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+)
+
+func newWhoAmICommand() *ffcli.Command {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+
+	var common commonFlags
+	common.register(fs)
+
+	return &ffcli.Command{
+		Name:       "whoami",
+		ShortUsage: "leoverse whoami [flags]",
+		ShortHelp:  "Check the cookie and print the email of the logged-in account",
+		FlagSet:    fs,
+		Exec: func(ctx context.Context, args []string) error {
+			cfg, err := common.config()
+			if err != nil {
+				return err
+			}
+
+			client, err := leoverse.StartClient(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			defer client.Stop(context.Background())
+
+			user, err := client.WhoAmI(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Println(user.Email)
+			return nil
+		},
+	}
+}
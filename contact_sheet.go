@@ -0,0 +1,114 @@
+package leoverse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"math"
+	"os"
+)
+
+// ContactSheetName is the name of the contact sheet written next to the
+// downloaded images.
+const ContactSheetName = "contact_sheet.png"
+
+// contactSheetCell is the size of the square cell each image is scaled into.
+const contactSheetCell = 512
+
+// writeContactSheet stores the contact sheet of the downloaded files and
+// returns its location. Failures are reported without failing the generation,
+// as the images are already stored.
+func (cfg *Config) writeContactSheet(ctx context.Context, files []string) string {
+	sink, err := cfg.sink()
+	if err != nil {
+		cfg.printf("Couldn't create contact sheet: %v\n", err)
+		return ""
+	}
+	if _, ok := sink.(*LocalSink); !ok {
+		cfg.printf("Skipping contact sheet, the images aren't stored locally\n")
+		return ""
+	}
+	location, err := writeContactSheet(ctx, sink, files)
+	if err != nil {
+		cfg.printf("Couldn't create contact sheet: %v\n", err)
+		return ""
+	}
+	cfg.printf("Contact sheet: %s\n", location)
+	return location
+}
+
+// writeContactSheet composites the downloaded image files into a grid and
+// stores it in the sink.
+func writeContactSheet(ctx context.Context, sink ImageSink, files []string) (string, error) {
+	var images []image.Image
+	for _, name := range files {
+		img, err := decodeImage(name)
+		if err != nil {
+			return "", err
+		}
+		images = append(images, img)
+	}
+	if len(images) == 0 {
+		return "", fmt.Errorf("no images for the contact sheet")
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, contactSheet(images, contactSheetCell)); err != nil {
+		return "", fmt.Errorf("couldn't encode contact sheet: %w", err)
+	}
+	return sink.Put(ctx, ContactSheetName, &buf)
+}
+
+func decodeImage(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode %s: %w", name, err)
+	}
+	return img, nil
+}
+
+// contactSheet returns a grid with the images scaled to fit square cells of
+// the given size, as close to a square as possible.
+func contactSheet(images []image.Image, cell int) *image.RGBA {
+	cols := int(math.Ceil(math.Sqrt(float64(len(images)))))
+	rows := (len(images) + cols - 1) / cols
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cell, rows*cell))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i, img := range images {
+		x, y := (i%cols)*cell, (i/cols)*cell
+		scaleInto(sheet, image.Rect(x, y, x+cell, y+cell), img)
+	}
+	return sheet
+}
+
+// scaleInto draws src centered in r, scaled with nearest neighbour sampling
+// to fit while keeping its aspect ratio.
+func scaleInto(dst *image.RGBA, r image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() {
+		return
+	}
+	scale := min(float64(r.Dx())/float64(sb.Dx()), float64(r.Dy())/float64(sb.Dy()))
+	w := max(1, int(float64(sb.Dx())*scale))
+	h := max(1, int(float64(sb.Dy())*scale))
+	x0 := r.Min.X + (r.Dx()-w)/2
+	y0 := r.Min.Y + (r.Dy()-h)/2
+	for y := range h {
+		sy := sb.Min.Y + y*sb.Dy()/h
+		for x := range w {
+			sx := sb.Min.X + x*sb.Dx()/w
+			dst.Set(x0+x, y0+y, src.At(sx, sy))
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package leoverse
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteContactSheet(t *testing.T) {
+	dir := t.TempDir()
+	sizes := []image.Point{{100, 50}, {50, 100}, {64, 64}}
+	var files []string
+	for i, size := range sizes {
+		img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+		for y := range size.Y {
+			for x := range size.X {
+				img.Set(x, y, color.Black)
+			}
+		}
+		name := filepath.Join(dir, fmt.Sprintf("image_%d.png", i+1))
+		f, err := os.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		files = append(files, name)
+	}
+
+	location, err := writeContactSheet(context.Background(), &LocalSink{Dir: dir}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(location) != ContactSheetName {
+		t.Errorf("unexpected location %s", location)
+	}
+	sheet, err := decodeImage(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three images fit in a 2x2 grid
+	if got, want := sheet.Bounds().Size(), image.Pt(2*contactSheetCell, 2*contactSheetCell); got != want {
+		t.Errorf("size = %v, want %v", got, want)
+	}
+	// The wide image is centered vertically in its cell
+	if r, _, _, _ := sheet.At(contactSheetCell/2, contactSheetCell/2).RGBA(); r != 0 {
+		t.Error("expected the first image in the center of its cell")
+	}
+	if r, _, _, _ := sheet.At(contactSheetCell/2, 10).RGBA(); r == 0 {
+		t.Error("expected padding above the wide image")
+	}
+	// The last cell is empty
+	if r, _, _, _ := sheet.At(2*contactSheetCell-1, 2*contactSheetCell-1).RGBA(); r == 0 {
+		t.Error("expected an empty last cell")
+	}
+}
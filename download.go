@@ -0,0 +1,141 @@
+package leoverse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+// downloadAttempts is the number of times DownloadURLs tries each image.
+const downloadAttempts = 3
+
+// downloadBackoff is the delay before retrying a failed download, multiplied
+// by the attempt number.
+var downloadBackoff = 2 * time.Second
+
+// DownloadURLs downloads the images at the URLs to the configured sink with a
+// bounded pool of workers, retrying failed downloads. The locations are in the
+// same order as the URLs; the error joins the errors of the failed downloads.
+func DownloadURLs(ctx context.Context, cfg *Config, urls []string, concurrency int) ([]string, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	concurrency = min(concurrency, len(urls))
+
+	sink, err := cfg.sink()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := cfg.downloadClient()
+	if err != nil {
+		return nil, err
+	}
+	names, err := downloadNames(urls)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := make([]string, len(urls))
+	errs := make([]error, len(urls))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	finished := func() {
+		if cfg.OnDownload == nil {
+			return
+		}
+		// Serialized so the callback sees increasing counts
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		cfg.OnDownload(done, len(urls))
+	}
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				location, err := downloadWithRetry(ctx, cfg, httpClient, sink, urls[i], names[i])
+				if err != nil {
+					errs[i] = err
+					finished()
+					continue
+				}
+				cfg.printf("Downloaded to: %s\n", location)
+				locations[i] = location
+				finished()
+			}
+		}()
+	}
+	for i := range urls {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", urls[i], err))
+		}
+	}
+	return locations, errors.Join(failed...)
+}
+
+// downloadNames returns the file names of the URLs, prefixing the names that
+// appear several times with their position.
+func downloadNames(urls []string) ([]string, error) {
+	names := make([]string, len(urls))
+	seen := make(map[string]bool)
+	for i, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid image url %q", rawURL)
+		}
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = fmt.Sprintf("image_%d", i+1)
+		}
+		if seen[name] {
+			name = fmt.Sprintf("%d_%s", i+1, name)
+		}
+		seen[name] = true
+		names[i] = name
+	}
+	return names, nil
+}
+
+// downloadWithRetry downloads the image, retrying errors other than client
+// errors, which would fail again.
+func downloadWithRetry(ctx context.Context, cfg *Config, client *http.Client, sink ImageSink, url, name string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		location, _, err := downloadImage(ctx, client, sink, url, name, nil)
+		if err == nil {
+			return location, nil
+		}
+		var status statusError
+		if errors.As(err, &status) && status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			return "", err
+		}
+		if ctx.Err() != nil || attempt >= downloadAttempts {
+			return "", err
+		}
+		cfg.printf("Download of %s failed, retrying: %v\n", url, err)
+		t := time.NewTimer(time.Duration(attempt) * downloadBackoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return "", ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package leoverse
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+	"automation/leoverse/pkg/metrics"
+	"automation/leoverse/pkg/metrics/metricstest"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n")
+
+func TestDownloadImageTruncated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Announce more bytes than sent and close the connection
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: image/png\r\nContent-Length: 1000\r\n\r\n")
+		rw.Write(pngHeader)
+		rw.Flush()
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if _, _, err := downloadImage(context.Background(), http.DefaultClient, &LocalSink{Dir: dir}, srv.URL, "image_1.png", nil); err == nil {
+		t.Fatal("expected error for truncated download")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no files, got %d", len(entries))
+	}
+}
+
+func TestDownloadImageNotImage(t *testing.T) {
+	// An error page served with a 200 status and an image content type
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "<!DOCTYPE html><html><body>Access denied</body></html>")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	_, _, err := downloadImage(context.Background(), http.DefaultClient, &LocalSink{Dir: dir}, srv.URL, "image_1.png", nil)
+	if err == nil || !strings.Contains(err.Error(), "not image: text/html") {
+		t.Fatalf("expected the html page to be rejected, got %v", err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected no files, got %v, %v", entries, err)
+	}
+}
+
+func TestDownloadImageHash(t *testing.T) {
+	data := append(pngHeader, "image data"...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	location, hash, err := downloadImage(context.Background(), http.DefaultClient, &LocalSink{Dir: dir}, srv.URL, "image_1.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if want := hex.EncodeToString(sum[:]); hash != want {
+		t.Errorf("hash = %s, want %s", hash, want)
+	}
+	stored, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Error("stored image doesn't match the download")
+	}
+}
+
+// getterFunc gets a generation from a function.
+type getterFunc func(ctx context.Context, generationID string) (*leonardo.Generation, error)
+
+func (f getterFunc) GetGeneration(ctx context.Context, generationID string) (*leonardo.Generation, error) {
+	return f(ctx, generationID)
+}
+
+func TestDownloadImagesExpiredURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "fresh" {
+			http.Error(w, "Request has expired", http.StatusForbidden)
+			return
+		}
+		w.Write(pngHeader)
+	}))
+	defer srv.Close()
+
+	fetches := 0
+	getter := getterFunc(func(ctx context.Context, generationID string) (*leonardo.Generation, error) {
+		fetches++
+		if generationID != "generation" {
+			t.Errorf("unexpected generation id %s", generationID)
+		}
+		return &leonardo.Generation{ID: generationID, Images: []leonardo.GeneratedImage{
+			{ID: "other", URL: srv.URL + "/other.png?sig=fresh"},
+			{ID: "image", URL: srv.URL + "/image.png?sig=fresh"},
+		}}, nil
+	})
+	images := []leonardo.GeneratedImage{{ID: "image", URL: srv.URL + "/image.png?sig=stale"}}
+	cfg := &Config{OutputDir: t.TempDir(), Output: io.Discard}
+	files, sources, _, err := downloadImages(context.Background(), cfg, getter, "a cat", "model", "generation", images, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || fetches != 1 {
+		t.Fatalf("got %d files after %d fetches, want 1 file after 1 fetch", len(files), fetches)
+	}
+	if want := srv.URL + "/image.png?sig=fresh"; sources[0] != want || images[0].URL != want {
+		t.Errorf("got source %s and image URL %s, want %s", sources[0], images[0].URL, want)
+	}
+
+	// Without a getter the expired URL fails
+	images[0].URL = srv.URL + "/image.png?sig=stale"
+	if _, _, _, err := downloadImages(context.Background(), cfg, nil, "a cat", "model", "generation", images, time.Now()); !isExpired(err) {
+		t.Errorf("expected expired URL error, got %v", err)
+	}
+}
+
+func TestDownloadMetrics(t *testing.T) {
+	data := append(pngHeader, "image data"...)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer srv.Close()
+
+	m := metricstest.NewRecorder()
+	client, err := (&Config{Metrics: m}).downloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := downloadImage(context.Background(), client, &LocalSink{Dir: t.TempDir()}, srv.URL, "image_1.png", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Counter(metrics.DownloadBytes); got != float64(len(data)) {
+		t.Errorf("got %v downloaded bytes, want %d", got, len(data))
+	}
+}
+
+func TestDownloadURLs(t *testing.T) {
+	downloadBackoff = time.Millisecond
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		n := attempts[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/missing.png":
+			http.NotFound(w, r)
+		case r.URL.Path == "/flaky.png" && n == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write(pngHeader)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	var progress []int
+	cfg := &Config{Sink: &LocalSink{Dir: dir}, Output: io.Discard, OnDownload: func(done, total int) {
+		if total != 4 {
+			t.Errorf("progress total = %d, want 4", total)
+		}
+		progress = append(progress, done)
+	}}
+	urls := []string{srv.URL + "/a/image.png", srv.URL + "/flaky.png", srv.URL + "/missing.png", srv.URL + "/b/image.png"}
+	locations, err := DownloadURLs(context.Background(), cfg, urls, 2)
+	if err == nil {
+		t.Fatal("expected error for the missing image")
+	}
+	want := []string{
+		filepath.Join(dir, "image.png"),
+		filepath.Join(dir, "flaky.png"),
+		"",
+		filepath.Join(dir, "4_image.png"),
+	}
+	if strings.Join(locations, ",") != strings.Join(want, ",") {
+		t.Errorf("locations = %v, want %v", locations, want)
+	}
+	if attempts["/flaky.png"] != 2 {
+		t.Errorf("expected 2 attempts for the flaky image, got %d", attempts["/flaky.png"])
+	}
+	if attempts["/missing.png"] != 1 {
+		t.Errorf("expected 1 attempt for the missing image, got %d", attempts["/missing.png"])
+	}
+	// Failed downloads are counted as finished
+	if fmt.Sprint(progress) != "[1 2 3 4]" {
+		t.Errorf("progress = %v, want [1 2 3 4]", progress)
+	}
+}
+
+func TestLengthReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int64
+		wantErr bool
+	}{
+		{"complete", pngHeader, int64(len(pngHeader)), false},
+		{"unknown length", pngHeader, -1, false},
+		{"truncated", pngHeader, 1000, true},
+		{"empty", nil, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &lengthReader{r: bytes.NewReader(tt.data), want: tt.want}
+			_, err := io.Copy(io.Discard, r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVariationName(t *testing.T) {
+	tests := map[string]string{
+		"https://cdn.leonardo.ai/users/1/variations/2/image.jpg":                "variation_v1.jpg",
+		"https://cdn.leonardo.ai/users/1/variations/2/image.jpg?X-Amz-Date=1.5": "variation_v1.jpg",
+		"https://cdn.leonardo.ai/users/1/variations/2/image?format=webp.gif":    "variation_v1.png",
+		"https://cdn.leonardo.ai/v1.0/image":                                    "variation_v1.png",
+	}
+	for rawURL, want := range tests {
+		if got := variationName("v1", rawURL); got != want {
+			t.Errorf("variationName(%q) = %q, want %q", rawURL, got, want)
+		}
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	// The server sends the headers, then stalls the body
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(pngHeader)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client, err := (&Config{DownloadTimeout: 50 * time.Millisecond}).downloadClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, _, err = downloadImage(context.Background(), client, &LocalSink{Dir: t.TempDir()}, srv.URL, "image_1.png", nil)
+	if err == nil {
+		t.Fatal("expected the stalled download to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("download gave up after %s", elapsed)
+	}
+
+	if client, _ := (&Config{DownloadTimeout: -1}).downloadClient(); client.Timeout != 0 {
+		t.Errorf("got timeout %s, want none", client.Timeout)
+	}
+	if client, _ := (&Config{}).downloadClient(); client.Timeout != DefaultDownloadTimeout {
+		t.Errorf("got timeout %s, want %s", client.Timeout, DefaultDownloadTimeout)
+	}
+}
@@ -0,0 +1,32 @@
+package leoverse
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// FetchGeneration downloads the images of a previously started generation.
+func FetchGeneration(ctx context.Context, cfg *Config, generationID string) error {
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Stop(ctx)
+
+	gen, err := client.GetGeneration(ctx, generationID)
+	if err != nil {
+		return err
+	}
+	cfg.printf("Generation %s status: %s\n", gen.ID, gen.Status)
+	if gen.Status != "COMPLETE" {
+		return fmt.Errorf("generation %s is not complete", gen.ID)
+	}
+
+	createdAt, err := time.Parse("2006-01-02T15:04:05.000", gen.CreatedAt)
+	if err != nil {
+		createdAt = time.Now()
+	}
+	_, _, _, err = downloadImages(ctx, cfg, client, gen.Prompt, gen.ModelID, gen.ID, gen.Images, createdAt)
+	return err
+}
@@ -0,0 +1,83 @@
+package leoverse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"automation/leoverse/internal/textutil"
+)
+
+// DefaultFilenameTemplate is the filename template used when
+// Config.FilenameTemplate is not set.
+const DefaultFilenameTemplate = "image_{index}.png"
+
+// maxSlugLength is the maximum length of the prompt slug used in filenames.
+const maxSlugLength = 50
+
+func (cfg *Config) filenameTemplate() string {
+	if cfg.FilenameTemplate == "" {
+		return DefaultFilenameTemplate
+	}
+	return cfg.FilenameTemplate
+}
+
+type filenameData struct {
+	index        int
+	prompt       string
+	generationID string
+	timestamp    time.Time
+}
+
+// expandFilename replaces the placeholders in the template. Supported
+// placeholders are {index}, {prompt_slug}, {generation_id} and {timestamp}.
+func expandFilename(tmpl string, data filenameData) (string, error) {
+	if !strings.Contains(tmpl, "{index}") {
+		return "", fmt.Errorf("filename template %q must contain {index}", tmpl)
+	}
+	r := strings.NewReplacer(
+		"{index}", strconv.Itoa(data.index),
+		"{prompt_slug}", slugify(data.prompt),
+		"{generation_id}", data.generationID,
+		"{timestamp}", data.timestamp.Format("20060102_150405"),
+	)
+	name := r.Replace(tmpl)
+	if strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("filename %q must not contain path separators", name)
+	}
+	return name, nil
+}
+
+// slugify converts the prompt to a lowercase string containing only letters,
+// digits and dashes, so it's safe to use in filenames.
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= maxSlugLength {
+			break
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if slug == "" {
+		slug = "image"
+	}
+	return slug
+}
+
+// SanitizePrompt returns the prompt to show in the logs. Control and
+// invisible formatting characters are removed, whitespace such as newlines is
+// collapsed into single spaces and the prompt is truncated to 100 characters.
+// The full prompt is kept in the results, image metadata and manifest.
+func SanitizePrompt(prompt string) string {
+	return textutil.SanitizePrompt(prompt)
+}
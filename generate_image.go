@@ -1,117 +1,778 @@
 package leoverse
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"automation/leoverse/pkg/leonardo"
+	"automation/leoverse/pkg/metrics"
 )
 
+// Settings of the default preset, used when the corresponding Config fields
+// are not set.
+const (
+	DefaultSteps  = 10
+	DefaultWidth  = 1472
+	DefaultHeight = 832
+)
+
+// DefaultDownloadRetries is the number of times an expired image URL is
+// re-fetched when Config.DownloadRetries is not set.
+const DefaultDownloadRetries = 2
+
+// DefaultDownloadTimeout limits each download, reading the body included,
+// when Config.DownloadTimeout is not set.
+const DefaultDownloadTimeout = 5 * time.Minute
+
+// DefaultNumImages is the number of images generated per prompt when
+// Config.NumImages is not set.
+const DefaultNumImages = 4
+
 type Config struct {
-	Cookie string
-	Wait   bool
-	Debug  bool
-	Proxy  string
+	Cookie         string
+	Wait           bool
+	Debug          bool
+	Proxy          string
+	Steps          int
+	Width          int
+	Height         int
+	NegativePrompt string
+
+	// Cookies are the session cookies of additional accounts. If set, the
+	// batches rotate between the accounts, skipping an account for
+	// AccountCooldown when it's rate limited or runs out of credits. Zero
+	// uses leonardo.DefaultCooldown.
+	Cookies         []string
+	AccountCooldown time.Duration
+
+	// NumImages is the number of images generated per prompt. Defaults to
+	// DefaultNumImages.
+	NumImages int
+
+	// Verbose logs the progress of the client without the request payloads
+	// logged by Debug.
+	Verbose bool
+
+	// ProxyList are the proxies the requests are spread over, in turn, as an
+	// alternative to Proxy: setting both is an error. A proxy failing several
+	// requests in a row is skipped for a while. If ProxyPerGeneration is set,
+	// all the requests of a generation go through the same proxy instead of
+	// rotating on each request.
+	ProxyList          []string
+	ProxyPerGeneration bool
+
+	// ProxyUsername and ProxyPassword authenticate with the proxy, overriding
+	// the credentials embedded in the Proxy URL.
+	ProxyUsername string
+	ProxyPassword string
+
+	// FilenameTemplate is the name of the downloaded files, supporting the
+	// {index}, {prompt_slug}, {generation_id} and {timestamp} placeholders.
+	// Defaults to DefaultFilenameTemplate.
+	FilenameTemplate string
+
+	// PollInterval is the initial delay between generation status checks,
+	// which backs off up to MaxPollInterval while the status doesn't change.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// GenerationTimeout aborts a generation that hasn't completed after the
+	// given duration.
+	GenerationTimeout time.Duration
+	// StartDelay postpones the start of GenerateImage or of a batch, to
+	// spread the load of several runs. Stagger spaces the generations of a
+	// batch: the nth one doesn't start before n times Stagger after the
+	// first, even if a worker is free.
+	StartDelay time.Duration
+	Stagger    time.Duration
+	// CancelOnExit cancels the remote generation when the context is
+	// cancelled, e.g. on Ctrl-C, so aborted runs don't consume credits.
+	CancelOnExit bool
+	// RequestTimeout limits each request to Leonardo, so a stuck request
+	// fails fast instead of consuming the generation deadline.
+	RequestTimeout time.Duration
+	// OnProgress is called with the generation status after each poll, so
+	// front-ends can render the progress.
+	OnProgress func(generationID, status string, elapsed time.Duration)
+	// OnDownload is called by DownloadURLs each time a download completes or
+	// fails, with the number of finished downloads and the total, so
+	// front-ends can render a progress bar.
+	OnDownload func(done, total int)
+	// OnResult is called by GenerateBatch and GenerateCount each time a
+	// generation completes or fails, with its index in the batch. The calls
+	// are serialized.
+	OnResult func(index int, result *Result, err error)
+
+	// MaxIdleConns, MaxIdleConnsPerHost and IdleConnTimeout tune the
+	// connection pool of the requests to Leonardo and the downloads. Zero
+	// uses DefaultMaxIdleConns, DefaultMaxIdleConnsPerHost and
+	// DefaultIdleConnTimeout.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// Metrics receives the generation, rate limit and download metrics of
+	// the client. Nil disables them.
+	Metrics metrics.Metrics
+
+	// BlockedTerms are rejected before the generation is sent, when the
+	// prompt contains one of them as a whole word, ignoring the case. The
+	// error is a *leonardo.ContentBlockedError.
+	BlockedTerms []string
+
+	// ResponseDumpDir, if set, is the directory each GraphQL request and its
+	// response are written to, with the credentials redacted.
+	ResponseDumpDir string
+
+	// BaseURL replaces the Leonardo API host, e.g. to go through a gateway.
+	BaseURL string
+
+	// UserAgent and ExtraHeaders customize the headers sent to Leonardo.
+	UserAgent    string
+	ExtraHeaders map[string]string
+
+	// Preset provides the model, style and size of the generation. Defaults
+	// to the DefaultPreset built-in preset.
+	Preset *Preset
+
+	// Seed makes the generation reproducible, zero picks a random seed.
+	Seed int64
+
+	// Tiling generates seamless textures.
+	Tiling bool
+
+	// Elements apply trained styles or concepts (LoRAs) with a weight,
+	// replacing the elements of the preset.
+	Elements []leonardo.Element
+
+	// MaxGenerationRetries re-submits a generation that finishes with a failed
+	// status up to the given number of times. Other errors, such as auth or
+	// credit errors, aren't retried.
+	MaxGenerationRetries int
+
+	// DownloadRetries is the number of times the image URLs are re-fetched
+	// from the generation when the CDN rejects them as expired. Zero uses
+	// DefaultDownloadRetries, a negative value disables it.
+	DownloadRetries int
+	// DownloadTimeout limits each download, reading the body included, so a
+	// stalled transfer doesn't hang the run. Zero uses
+	// DefaultDownloadTimeout, a negative value disables it.
+	DownloadTimeout time.Duration
+
+	// PhotoReal generates with Leonardo PhotoReal instead of the default
+	// model.
+	PhotoReal bool
+
+	// SkipNSFW skips downloading images flagged as NSFW by Leonardo.
+	SkipNSFW bool
+
+	// DeleteAfterDownload deletes the generation from Leonardo once all its
+	// images have been downloaded. It's ignored if SkipDownload is set.
+	DeleteAfterDownload bool
+
+	// SkipDownload only returns the image URLs, without storing the images.
+	// Like SkipNSFW, it's a skip flag so the zero Config downloads the images.
+	SkipDownload bool
+
+	// EmbedMetadata writes the prompt, model ID, seed and generation ID into
+	// the downloaded PNG images. Other formats are stored unchanged.
+	EmbedMetadata bool
+
+	// ContactSheet composites the downloaded images into a grid stored as
+	// ContactSheetName next to them. Only local images are supported.
+	ContactSheet bool
+
+	// WebhookURL receives a POST with the outcome of each generation. If
+	// WebhookSecret is set, the body is signed with HMAC-SHA256 in the
+	// WebhookSignatureHeader header.
+	WebhookURL    string
+	WebhookSecret string
+
+	// Sink stores the downloaded images. If nil and S3 is set, images are
+	// uploaded to the S3 bucket, otherwise they are written to OutputDir.
+	Sink ImageSink
+	S3   *S3Config
+
+	// WriteManifest writes the ManifestName file next to the downloaded
+	// images, listing their URL, path, seed and dimensions with the prompt
+	// and model. A batch writes a single manifest of all its images in the
+	// output directory. AppendManifest adds them to the existing manifest
+	// instead of replacing it.
+	WriteManifest  bool
+	AppendManifest bool
+
+	// OutputDir is the directory the images are written to. Defaults to the
+	// OUTPUT_DIR environment variable, or "output".
+	OutputDir string
+
+	// Output receives the progress messages. Defaults to os.Stdout.
+	Output io.Writer
+
+	// transports is the transport built from the config, shared with its
+	// copies
+	transports *sharedTransport
 }
 
-func GenerateImage(ctx context.Context, cfg *Config, prompt string) error {
-	httpClient := &http.Client{
-		Timeout: 5 * time.Minute, // Increased timeout
-	}
-	if cfg.Proxy != "" {
-		u, err := url.Parse(cfg.Proxy)
-		if err != nil {
-			return fmt.Errorf("invalid proxy URL: %w", err)
-		}
-		httpClient.Transport = &http.Transport{
-			Proxy: http.ProxyURL(u),
-		}
+func (cfg *Config) printf(format string, args ...any) {
+	out := cfg.Output
+	if out == nil {
+		out = os.Stdout
 	}
+	fmt.Fprintf(out, format, args...)
+}
 
-	client := leonardo.New(&leonardo.Config{
-		Wait:        10 * time.Second, // Reduced wait time
-		Debug:       cfg.Debug,
-		Client:      httpClient,
-		CookieStore: leonardo.NewMemCookieStore(cfg.Cookie),
-	})
+// Result describes a completed generation. Files contains the locations
+// returned by the image sink: local paths or object URLs. Hashes contains the
+// hex encoded SHA-256 of each file and Sources the URL it was downloaded from.
+type Result struct {
+	Prompt       string   `json:"prompt"`
+	GenerationID string   `json:"generation_id"`
+	Seed         int64    `json:"seed"`
+	URLs         []string `json:"urls"`
+	Files        []string `json:"files"`
+	Hashes       []string `json:"hashes"`
+	Sources      []string `json:"sources"`
+	ContactSheet string   `json:"contact_sheet,omitempty"`
 
-	if err := client.Start(ctx); err != nil {
-		return fmt.Errorf("couldn't start leonardo client: %w", err)
+	// Images contains the metadata of the generated images.
+	Images []leonardo.GeneratedImage `json:"images"`
+
+	// manifest describes the downloaded files, for the manifest of a batch.
+	manifest []ManifestEntry
+}
+
+// GenerateImage generates images for the prompt and downloads them to the
+// output directory.
+func GenerateImage(ctx context.Context, cfg *Config, prompt string) (*Result, error) {
+	if err := cfg.delayStart(ctx); err != nil {
+		return nil, err
+	}
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		notifyWebhook(ctx, cfg, prompt, nil, err)
+		return nil, err
 	}
 	defer client.Stop(ctx)
 
-	fmt.Printf("Generating image for prompt: %q\n", prompt)
+	return GenerateImageWithClient(ctx, cfg, client, prompt)
+}
+
+// delayStart waits for cfg.StartDelay, or until the context is cancelled.
+func (cfg *Config) delayStart(ctx context.Context) error {
+	if cfg.StartDelay <= 0 {
+		return nil
+	}
+	cfg.printf("Starting in %s\n", cfg.StartDelay)
+	return sleep(ctx, cfg.StartDelay)
+}
+
+// sleep waits for the duration, or until the context is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// GenerateImageWithClient is like GenerateImage but uses a client started with
+// StartClient or StartGenerationClient, avoiding a new login for each prompt.
+func GenerateImageWithClient(ctx context.Context, cfg *Config, client GenerationClient, prompt string) (*Result, error) {
+	result, err := generateImage(ctx, cfg, client, prompt)
+	notifyWebhook(ctx, cfg, prompt, result, err)
+	return result, err
+}
+
+func generateImage(ctx context.Context, cfg *Config, client GenerationClient, prompt string) (*Result, error) {
+	cfg.printf("Generating image for prompt: %q\n", SanitizePrompt(prompt))
 	startTime := time.Now()
+	if cfg.ProxyPerGeneration {
+		// The requests of the generation and its downloads share a proxy
+		ctx = withProxyPin(ctx)
+	}
+
+	preset := cfg.Preset
+	if preset == nil {
+		p := builtinPresets[DefaultPreset]
+		preset = &p
+	}
+	input := preset.input(prompt)
+	input.NumImages = DefaultNumImages
+	if cfg.NumImages != 0 {
+		input.NumImages = cfg.NumImages
+	}
+	input.Public = true
+	input.EnhancePrompt = true
+	input.Weighting = 0.75
+	input.NSFW = true // Allow NSFW content
+	input.Seed = cfg.Seed
+	input.Tiling = cfg.Tiling
+
+	// The config overrides the preset
+	if cfg.Steps != 0 {
+		input.Steps = cfg.Steps
+	}
+	if cfg.Width != 0 && cfg.Height != 0 {
+		input.Width, input.Height = cfg.Width, cfg.Height
+	}
+	if cfg.NegativePrompt != "" {
+		input.NegativePrompt = cfg.NegativePrompt
+	}
+	if cfg.PhotoReal {
+		input.PhotoReal = true
+	}
+	if len(cfg.Elements) > 0 {
+		input.Elements = cfg.Elements
+	}
+	if input.PhotoReal {
+		// PhotoReal selects its own model and style
+		input.ModelID = ""
+		input.SDVersion = ""
+		input.PresetStyle = ""
+	}
 
-	input := &leonardo.GenerateImageInput{
-		Prompt:        prompt,
-		Width:         1472,
-		Height:        832,
-		NumImages:     4,
-		Steps:         10,   // Reduced steps
-		Public:        true, // Changed to true
-		EnhancePrompt: true,
-		ModelID:       "6b645e3a-d64f-4341-a6d8-7a3690fbf042", // Updated model ID
-		GuidanceScale: 7.0,
-		Scheduler:     "LEONARDO",
-		SDVersion:     "PHOENIX",  // Added SD version
-		PresetStyle:   "LEONARDO", // Added preset style
-		Contrast:      3.5,        // Added contrast
-		Weighting:     0.75,       // Added weighting
-		NSFW:          true,       // Allow NSFW content
-	}
-
-	urls, err := client.GenerateImage(ctx, input)
+	// Validate the template before spending credits on the generation
+	if _, err := expandFilename(cfg.filenameTemplate(), filenameData{}); err != nil {
+		return nil, err
+	}
+
+	generationID, images, err := runGeneration(ctx, cfg, client, input)
 	if err != nil {
-		return fmt.Errorf("generation failed: %w", err)
+		return nil, fmt.Errorf("generation failed: %w", err)
 	}
 
 	elapsed := time.Since(startTime).Round(time.Second)
-	fmt.Printf("\nGeneration completed in %s\n", elapsed)
-	fmt.Printf("Generated %d images:\n", len(urls))
+	cfg.printf("\nGeneration completed in %s\n", elapsed)
+	var seed int64
+	if len(images) > 0 {
+		seed = images[0].Seed
+		cfg.printf("Seed: %d\n", seed)
+	}
 
-	for i, url := range urls {
-		fmt.Printf("%d. %s\n", i+1, url)
+	modelID := input.ModelID
+	if input.PhotoReal {
+		modelID = "PhotoReal"
+	}
+	var files, sources, hashes []string
+	if cfg.SkipDownload {
+		cfg.printf("Generated %d images:\n", len(images))
+		for i, img := range images {
+			cfg.printf("%d. %s\n", i+1, img.URL)
+		}
+	} else {
+		files, sources, hashes, err = downloadImages(ctx, cfg, client, prompt, modelID, generationID, images, startTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	manifest := manifestEntries(prompt, modelID, generationID, images, files, sources, startTime)
+	if cfg.WriteManifest && len(manifest) > 0 {
+		cfg.writeManifest(ctx, manifest)
+	}
+	var contactSheet string
+	if cfg.ContactSheet && len(files) > 0 {
+		contactSheet = cfg.writeContactSheet(ctx, files)
+	}
 
-		// Get output directory from environment variable, default to "output"
-		outputDir := os.Getenv("OUTPUT_DIR")
-		if outputDir == "" {
-			outputDir = "output"
+	// All images were downloaded, so it's safe to delete the generation
+	if cfg.DeleteAfterDownload && !cfg.SkipDownload {
+		if err := client.DeleteGeneration(ctx, generationID); err != nil {
+			return nil, fmt.Errorf("couldn't delete generation: %w", err)
 		}
+		cfg.printf("Deleted generation %s\n", generationID)
+	}
 
-		// Create output directory if it doesn't exist
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("couldn't create output directory: %w", err)
+	result := &Result{
+		Prompt:       prompt,
+		GenerationID: generationID,
+		Seed:         seed,
+		Files:        files,
+		Hashes:       hashes,
+		Sources:      sources,
+		ContactSheet: contactSheet,
+		Images:       images,
+		manifest:     manifest,
+	}
+	for _, img := range images {
+		result.URLs = append(result.URLs, img.URL)
+	}
+	return result, nil
+}
+
+// runGeneration creates the generation and waits for its images, re-submitting
+// it if it fails, up to cfg.MaxGenerationRetries times.
+func runGeneration(ctx context.Context, cfg *Config, client GenerationClient, input *leonardo.GenerateImageInput) (string, []leonardo.GeneratedImage, error) {
+	for attempt := 1; ; attempt++ {
+		generationID, err := client.CreateGeneration(ctx, input)
+		if err != nil {
+			return "", nil, err
+		}
+		images, err := client.WaitForGeneration(ctx, generationID)
+		if err == nil {
+			return generationID, images, nil
+		}
+		// Only failed generations are retried, other errors would fail again
+		if !errors.Is(err, leonardo.ErrGenerationFailed) || attempt > cfg.MaxGenerationRetries {
+			return "", nil, err
 		}
+		cfg.printf("Generation %s failed, retrying (attempt %d of %d)\n", generationID, attempt+1, cfg.MaxGenerationRetries+1)
+	}
+}
 
-		filename := fmt.Sprintf("%s/image_%d.png", outputDir, i+1)
-		if err := downloadImage(url, filename); err != nil {
-			return fmt.Errorf("couldn't download image %d: %w", i+1, err)
+// downloadImages downloads the generated images to the configured sink and
+// returns the locations, source URLs and hashes of the stored files. If the
+// getter is not nil, the expired image URLs are replaced in images by fresh
+// ones from the generation.
+func downloadImages(ctx context.Context, cfg *Config, getter generationGetter, prompt, modelID, generationID string, images []leonardo.GeneratedImage, timestamp time.Time) ([]string, []string, []string, error) {
+	sink, err := cfg.sink()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	httpClient, err := cfg.downloadClient()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var files, sources, hashes []string
+	cfg.printf("Generated %d images:\n", len(images))
+
+	for i, img := range images {
+		cfg.printf("%d. %s\n", i+1, img.URL)
+		if img.NSFW && cfg.SkipNSFW {
+			cfg.printf("Skipping image %d flagged as NSFW\n", i+1)
+			continue
+		}
+
+		name, err := expandFilename(cfg.filenameTemplate(), filenameData{
+			index:        i + 1,
+			prompt:       prompt,
+			generationID: generationID,
+			timestamp:    timestamp,
+		})
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		fmt.Printf("Downloaded to: %s\n", filename)
+		var meta []pngText
+		if cfg.EmbedMetadata {
+			meta = []pngText{
+				{"Prompt", prompt},
+				{"Model ID", modelID},
+				{"Seed", strconv.FormatInt(img.Seed, 10)},
+				{"Generation ID", generationID},
+			}
+		}
+		location, hash, err := downloadImage(ctx, httpClient, sink, img.URL, name, meta)
+		for attempt := 1; isExpired(err) && getter != nil && attempt <= cfg.downloadRetries(); attempt++ {
+			cfg.printf("Image %d URL expired, fetching a fresh one\n", i+1)
+			url, ferr := freshURL(ctx, getter, generationID, img.ID, i)
+			if ferr != nil {
+				err = fmt.Errorf("%w (couldn't refresh the URL: %w)", err, ferr)
+				break
+			}
+			images[i].URL = url
+			location, hash, err = downloadImage(ctx, httpClient, sink, url, name, meta)
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("couldn't download image %d: %w", i+1, err)
+		}
+		cfg.printf("Downloaded to: %s\n", location)
+		files = append(files, location)
+		sources = append(sources, images[i].URL)
+		hashes = append(hashes, hash)
+	}
+
+	return files, sources, hashes, nil
+}
+
+// generationGetter gets a generation with fresh image URLs.
+type generationGetter interface {
+	GetGeneration(ctx context.Context, generationID string) (*leonardo.Generation, error)
+}
+
+// freshURL fetches the generation again and returns the current URL of the
+// image, matched by ID or, if it has none, by index.
+func freshURL(ctx context.Context, getter generationGetter, generationID, imageID string, index int) (string, error) {
+	gen, err := getter.GetGeneration(ctx, generationID)
+	if err != nil {
+		return "", err
+	}
+	for i, img := range gen.Images {
+		if (imageID != "" && img.ID == imageID) || (imageID == "" && i == index) {
+			return img.URL, nil
+		}
+	}
+	return "", fmt.Errorf("image %s not found in generation %s", imageID, generationID)
+}
+
+// downloadRetries returns the number of times an expired image URL is
+// re-fetched.
+func (cfg *Config) downloadRetries() int {
+	if cfg.DownloadRetries == 0 {
+		return DefaultDownloadRetries
+	}
+	return max(cfg.DownloadRetries, 0)
+}
+
+// downloadTimeout returns the time limit of each download, zero if there's
+// none.
+func (cfg *Config) downloadTimeout() time.Duration {
+	if cfg.DownloadTimeout == 0 {
+		return DefaultDownloadTimeout
 	}
+	return max(cfg.DownloadTimeout, 0)
+}
 
-	return nil
+// outputDir returns the directory the images are saved to by default.
+func (cfg *Config) outputDir() string {
+	if cfg.OutputDir != "" {
+		return cfg.OutputDir
+	}
+	// Get output directory from environment variable, default to "output"
+	dir := os.Getenv("OUTPUT_DIR")
+	if dir == "" {
+		dir = "output"
+	}
+	return dir
 }
 
-func downloadImage(url, filename string) error {
-	resp, err := http.Get(url)
+// StartClient creates a leonardo client from the config and authenticates it.
+// The client can be reused for several generations and must be stopped by the
+// caller.
+func StartClient(ctx context.Context, cfg *Config) (*leonardo.Client, error) {
+	client, err := newClient(cfg, cfg.Cookie)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := client.Start(ctx); err != nil {
+		return nil, fmt.Errorf("couldn't start leonardo client: %w", err)
+	}
+	return client, nil
+}
+
+// GenerationClient creates, polls and deletes generations. It's implemented by
+// *leonardo.Client and by *leonardo.RotatingClient, which spreads the
+// generations among several accounts.
+type GenerationClient interface {
+	CreateGeneration(ctx context.Context, input *leonardo.GenerateImageInput) (string, error)
+	WaitForGeneration(ctx context.Context, generationID string) ([]leonardo.GeneratedImage, error)
+	GetGeneration(ctx context.Context, generationID string) (*leonardo.Generation, error)
+	DeleteGeneration(ctx context.Context, generationID string) error
+	Stop(ctx context.Context) error
+}
+
+// StartGenerationClient is like StartClient, but if cfg.Cookies is set it
+// returns a client rotating between the account of cfg.Cookie and those
+// accounts, so the generations continue when an account is rate limited or
+// runs out of credits.
+func StartGenerationClient(ctx context.Context, cfg *Config) (GenerationClient, error) {
+	if len(cfg.Cookies) == 0 {
+		return StartClient(ctx, cfg)
+	}
+	var clients []*leonardo.Client
+	for _, cookie := range append([]string{cfg.Cookie}, cfg.Cookies...) {
+		if cookie == "" {
+			continue
+		}
+		client, err := newClient(cfg, cookie)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	client := leonardo.NewRotatingClient(cfg.AccountCooldown, clients...)
+	if err := client.Start(ctx); err != nil {
+		return nil, fmt.Errorf("couldn't start leonardo client: %w", err)
+	}
+	return client, nil
+}
+
+// newClient creates a leonardo client from the config, authenticating with
+// the given cookie.
+func newClient(cfg *Config, cookie string) (*leonardo.Client, error) {
+	transport, err := cfg.transport()
+	if err != nil {
+		return nil, err
+	}
+	// Requests are limited by Config.RequestTimeout, which doesn't apply to
+	// the image downloads
+	httpClient := &http.Client{Transport: transport}
+
+	return leonardo.New(&leonardo.Config{
+		// Minimum delay between requests to Leonardo
+		Wait:              10 * time.Second,
+		PollInterval:      cfg.PollInterval,
+		MaxPollInterval:   cfg.MaxPollInterval,
+		GenerationTimeout: cfg.GenerationTimeout,
+		CancelOnExit:      cfg.CancelOnExit,
+		Metrics:           cfg.Metrics,
+		RequestTimeout:    cfg.RequestTimeout,
+		OnProgress:        cfg.OnProgress,
+		BaseURL:           cfg.BaseURL,
+		UserAgent:         cfg.UserAgent,
+		ExtraHeaders:      cfg.ExtraHeaders,
+		Debug:             cfg.Debug,
+		Verbose:           cfg.Verbose,
+		ResponseDumpDir:   cfg.ResponseDumpDir,
+		BlockedTerms:      cfg.BlockedTerms,
+		Client:            httpClient,
+		CookieStore:       leonardo.NewMemCookieStore(cookie),
+	}), nil
+}
+
+// downloadClient returns the HTTP client used for the image downloads, which
+// goes through the configured proxy and gives up after the download timeout.
+// Its transport is built once per config, so the downloads of the generations
+// reuse its connections.
+func (cfg *Config) downloadClient() (*http.Client, error) {
+	transport, err := cfg.transport()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Metrics != nil {
+		transport = &meteredTransport{base: transport, metrics: cfg.Metrics}
+	}
+	return &http.Client{Transport: transport, Timeout: cfg.downloadTimeout()}, nil
+}
+
+// meteredTransport counts the bytes of the downloaded response bodies.
+type meteredTransport struct {
+	base    http.RoundTripper
+	metrics metrics.Metrics
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &meteredBody{ReadCloser: resp.Body, metrics: t.metrics}
+	return resp, nil
+}
+
+type meteredBody struct {
+	io.ReadCloser
+	metrics metrics.Metrics
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.metrics.IncCounter(metrics.DownloadBytes, float64(n))
+	}
+	return n, err
+}
+
+// downloadImage downloads the image and stores it in the sink, returning its
+// location and the hex encoded SHA-256 of its content. The metadata is
+// embedded into PNG images.
+func downloadImage(ctx context.Context, client *http.Client, sink ImageSink, url, name string, meta []pngText) (string, string, error) {
+	return download(ctx, client, sink, url, name, "image", meta)
+}
+
+// download stores the file at url in the sink, checking its content is of the
+// given media type, such as "image" or "video".
+func download(ctx context.Context, client *http.Client, sink ImageSink, url, name, mediaType string, meta []pngText) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", statusError(resp.StatusCode)
+	}
+
+	// Check the content before storing it, so CDN error pages aren't saved
+	// as images
+	body := bufio.NewReaderSize(&lengthReader{r: resp.Body, want: resp.ContentLength}, sniffLen)
+	head, err := body.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return "", "", err
+	}
+	contentType := http.DetectContentType(head)
+	if !strings.HasPrefix(contentType, mediaType+"/") {
+		return "", "", fmt.Errorf("downloaded content is not %s: %s", mediaType, contentType)
+	}
 
-	out, err := os.Create(filename)
+	var r io.Reader = body
+	if len(meta) > 0 && contentType == "image/png" {
+		// The chunks are inserted at the start of the file, so the image
+		// is buffered
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return "", "", err
+		}
+		data, _ = embedPNGText(data, meta)
+		r = bytes.NewReader(data)
+	}
+
+	// Hash the image while it's stored
+	h := sha256.New()
+	location, err := sink.Put(ctx, name, io.TeeReader(r, h))
 	if err != nil {
-		return err
+		return "", "", err
+	}
+	return location, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// statusError is returned when the image server doesn't respond with 200.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d", int(e))
+}
+
+// isExpired reports whether the download failed because the signed CDN URL
+// expired, which the CDN reports with 403 Forbidden or 410 Gone.
+func isExpired(err error) bool {
+	var status statusError
+	if !errors.As(err, &status) {
+		return false
 	}
-	defer out.Close()
+	return status == http.StatusForbidden || status == http.StatusGone
+}
+
+// sniffLen is the number of bytes used by http.DetectContentType.
+const sniffLen = 512
 
-	_, err = io.Copy(out, resp.Body)
-	return err
+// lengthReader fails at EOF if nothing was read or if the number of bytes read
+// doesn't match the expected length, so truncated downloads aren't stored.
+// A negative length means it's unknown.
+type lengthReader struct {
+	r    io.Reader
+	n    int64
+	want int64
+}
+
+func (l *lengthReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if err == io.EOF {
+		if l.n == 0 {
+			return n, errors.New("downloaded image is empty")
+		}
+		if l.want >= 0 && l.n != l.want {
+			return n, fmt.Errorf("downloaded %d bytes, expected %d", l.n, l.want)
+		}
+	}
+	return n, err
 }
@@ -4,10 +4,26 @@ go 1.23
 
 toolchain go1.23.5
 
-require github.com/peterbourgon/ff/v3 v3.4.0
+require (
+	github.com/joho/godotenv v1.5.1
+	github.com/minio/minio-go/v7 v7.0.82
+	github.com/peterbourgon/ff/v3 v3.4.0
+	golang.org/x/net v0.30.0
+	golang.org/x/term v0.25.0
+	golang.org/x/time v0.8.0
+)
 
 require (
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/mehanizm/airtable v0.3.3 // indirect
-	golang.org/x/time v0.8.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/go-ini/ini v1.67.0 // indirect
+	github.com/goccy/go-json v0.10.3 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.11 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
+	github.com/minio/md5-simd v1.1.2 // indirect
+	github.com/rs/xid v1.6.0 // indirect
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
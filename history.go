@@ -0,0 +1,30 @@
+package leoverse
+
+import (
+	"context"
+
+	"automation/leoverse/pkg/leonardo"
+)
+
+// ListGenerations returns the user's past generations, most recent first.
+func ListGenerations(ctx context.Context, cfg *Config, limit, offset int) ([]leonardo.Generation, error) {
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Stop(ctx)
+
+	return client.ListGenerations(ctx, limit, offset)
+}
+
+// ListGenerationsFiltered returns the user's past generations matching the
+// filter, most recent first. A zero limit returns every matching generation.
+func ListGenerationsFiltered(ctx context.Context, cfg *Config, filter leonardo.GenerationFilter, limit, offset int) ([]leonardo.Generation, error) {
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Stop(ctx)
+
+	return client.ListGenerationsFiltered(ctx, filter, limit, offset)
+}
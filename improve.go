@@ -0,0 +1,15 @@
+package leoverse
+
+import "context"
+
+// ImprovePrompt returns the prompt enhanced by Leonardo, so it can be reviewed
+// and reused before generating.
+func ImprovePrompt(ctx context.Context, cfg *Config, prompt string) (string, error) {
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer client.Stop(context.Background())
+
+	return client.ImprovePrompt(ctx, prompt)
+}
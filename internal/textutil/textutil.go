@@ -0,0 +1,46 @@
+// Package textutil formats the user-provided text shown in the logs.
+package textutil
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MaxDisplayPromptLength is the maximum number of characters of the prompt
+// shown in the logs.
+const MaxDisplayPromptLength = 100
+
+// SanitizePrompt returns the prompt to show in the logs. Control and
+// invisible formatting characters are removed, whitespace such as newlines is
+// collapsed into single spaces and the prompt is truncated to
+// MaxDisplayPromptLength characters.
+func SanitizePrompt(prompt string) string {
+	var b strings.Builder
+	n := 0
+	space := false
+	for _, r := range prompt {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		space = space && n > 0
+		width := 1
+		if space {
+			width++
+		}
+		if n+width > MaxDisplayPromptLength {
+			b.WriteString("...")
+			break
+		}
+		if space {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(r)
+		n += width
+		space = false
+	}
+	return b.String()
+}
@@ -0,0 +1,30 @@
+package textutil
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizePrompt(t *testing.T) {
+	tests := []struct {
+		prompt string
+		want   string
+	}{
+		{"a cat", "a cat"},
+		{"  a cat\non a\r\n\tmat  ", "a cat on a mat"},
+		{"a \x1b[31mred\x1b[0m cat", "a [31mred[0m cat"},
+		{"a cat‮ tac a", "a cat tac a"},
+		{"\n\n", ""},
+	}
+	for _, tt := range tests {
+		if got := SanitizePrompt(tt.prompt); got != tt.want {
+			t.Errorf("SanitizePrompt(%q) = %q, want %q", tt.prompt, got, tt.want)
+		}
+	}
+
+	long := SanitizePrompt(strings.Repeat("chat ", 100))
+	if n := utf8.RuneCountInString(strings.TrimSuffix(long, "...")); n > MaxDisplayPromptLength || !strings.HasSuffix(long, "...") {
+		t.Errorf("long prompt sanitized to %d characters: %q", n, long)
+	}
+}
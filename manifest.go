@@ -0,0 +1,120 @@
+package leoverse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+)
+
+// ManifestName is the name of the manifest written next to the downloaded
+// images.
+const ManifestName = "manifest.json"
+
+// Manifest lists the downloaded images with the settings they were generated
+// with.
+type Manifest struct {
+	Images []ManifestEntry `json:"images"`
+}
+
+// ManifestEntry describes a downloaded image.
+type ManifestEntry struct {
+	Prompt       string    `json:"prompt"`
+	ModelID      string    `json:"model_id"`
+	GenerationID string    `json:"generation_id"`
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Seed         int64     `json:"seed"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// manifestMu serializes the updates of a manifest, as concurrent runs may
+// append to the same one.
+var manifestMu sync.Mutex
+
+// manifestEntries describes the downloaded files, whose images are found by
+// their source URL.
+func manifestEntries(prompt, modelID, generationID string, images []leonardo.GeneratedImage, files, sources []string, createdAt time.Time) []ManifestEntry {
+	byURL := make(map[string]leonardo.GeneratedImage, len(images))
+	for _, img := range images {
+		byURL[img.URL] = img
+	}
+	var entries []ManifestEntry
+	for i, file := range files {
+		img := byURL[sources[i]]
+		entries = append(entries, ManifestEntry{
+			Prompt:       prompt,
+			ModelID:      modelID,
+			GenerationID: generationID,
+			URL:          sources[i],
+			Path:         file,
+			Seed:         img.Seed,
+			Width:        img.Width,
+			Height:       img.Height,
+			CreatedAt:    createdAt.UTC(),
+		})
+	}
+	return entries
+}
+
+// writeManifest writes the manifest of the entries to the output directory.
+// Failures are reported without failing the generation, as the images are
+// already stored.
+func (cfg *Config) writeManifest(ctx context.Context, entries []ManifestEntry) {
+	sink, err := cfg.sink()
+	if err != nil {
+		cfg.printf("Couldn't write manifest: %v\n", err)
+		return
+	}
+	local, ok := sink.(*LocalSink)
+	if !ok {
+		cfg.printf("Skipping manifest, the images aren't stored locally\n")
+		return
+	}
+
+	location, err := updateManifest(ctx, local, entries, cfg.AppendManifest)
+	if err != nil {
+		cfg.printf("Couldn't write manifest: %v\n", err)
+		return
+	}
+	cfg.printf("Manifest: %s\n", location)
+}
+
+// updateManifest stores the entries in the manifest of the directory, after
+// the existing ones if keep is set, and returns its location.
+func updateManifest(ctx context.Context, sink *LocalSink, entries []ManifestEntry, keep bool) (string, error) {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	var manifest Manifest
+	if keep {
+		data, err := os.ReadFile(filepath.Join(sink.Dir, ManifestName))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return "", err
+		default:
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return "", fmt.Errorf("couldn't parse existing manifest: %w", err)
+			}
+		}
+	}
+	manifest.Images = append(manifest.Images, entries...)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// The sink replaces the manifest atomically
+	return sink.Put(ctx, ManifestName, bytes.NewReader(data))
+}
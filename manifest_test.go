@@ -0,0 +1,68 @@
+package leoverse
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"automation/leoverse/pkg/leonardo"
+)
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{OutputDir: dir, Output: io.Discard, WriteManifest: true}
+	images := []leonardo.GeneratedImage{
+		{URL: "https://cdn.leonardo.ai/1.jpg", Seed: 42, Width: 1024, Height: 768},
+		{URL: "https://cdn.leonardo.ai/2.jpg", Seed: 42, Width: 1024, Height: 768},
+	}
+	// The NSFW second image wasn't downloaded
+	files := []string{filepath.Join(dir, "image_1.jpg")}
+	sources := []string{images[0].URL}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	read := func() Manifest {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	cfg.writeManifest(context.Background(), manifestEntries("a cat", "model", "generation", images, files, sources, created))
+	m := read()
+	want := ManifestEntry{
+		Prompt:       "a cat",
+		ModelID:      "model",
+		GenerationID: "generation",
+		URL:          images[0].URL,
+		Path:         files[0],
+		Seed:         42,
+		Width:        1024,
+		Height:       768,
+		CreatedAt:    created,
+	}
+	if len(m.Images) != 1 || m.Images[0] != want {
+		t.Fatalf("got manifest %+v, want %+v", m.Images, want)
+	}
+
+	// The manifest is replaced unless AppendManifest is set
+	cfg.writeManifest(context.Background(), manifestEntries("a cat", "model", "generation", images, files, sources, created))
+	if n := len(read().Images); n != 1 {
+		t.Errorf("got %d entries after overwriting, want 1", n)
+	}
+	cfg.AppendManifest = true
+	cfg.writeManifest(context.Background(), manifestEntries("a dog", "model", "generation2", images, files, sources, created))
+	m = read()
+	if len(m.Images) != 2 || m.Images[1].Prompt != "a dog" {
+		t.Errorf("got manifest %+v after appending, want 2 entries", m.Images)
+	}
+}
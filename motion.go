@@ -0,0 +1,39 @@
+package leoverse
+
+import (
+	"context"
+	"fmt"
+)
+
+// GenerateMotion animates a generated image, waits for the video to complete
+// and downloads it. It returns the location of the video.
+func GenerateMotion(ctx context.Context, cfg *Config, imageID string, motionStrength int) (string, error) {
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer client.Stop(ctx)
+
+	cfg.printf("Creating motion for image %s\n", imageID)
+	url, err := client.GenerateMotion(ctx, imageID, motionStrength)
+	if err != nil {
+		return "", err
+	}
+	cfg.printf("Motion completed: %s\n", url)
+
+	sink, err := cfg.sink()
+	if err != nil {
+		return "", err
+	}
+	httpClient, err := cfg.downloadClient()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("motion_%s.mp4", imageID)
+	location, _, err := download(ctx, httpClient, sink, url, name, "video", nil)
+	if err != nil {
+		return "", fmt.Errorf("couldn't download motion: %w", err)
+	}
+	cfg.printf("Downloaded to: %s\n", location)
+	return location, nil
+}
@@ -2,22 +2,184 @@ package airtable
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+
+	"automation/leoverse/internal/textutil"
+	"automation/leoverse/pkg/metrics"
+
+	"golang.org/x/time/rate"
 )
 
+// DefaultRateLimit is the maximum number of requests per second allowed by
+// Airtable for a single base.
+const DefaultRateLimit rate.Limit = 5
+
+// DefaultAttachmentField is the attachment field the images are added to.
+const DefaultAttachmentField = "Image"
+
+// DefaultTimeout is the timeout of each request to Airtable.
+const DefaultTimeout = 30 * time.Second
+
 type Client struct {
 	APIKey     string
 	BaseID     string
 	TableName  string
 	httpClient *http.Client
+	timeout    time.Duration
+	limiter    *rate.Limiter
+	metrics    metrics.Metrics
+
+	replaceAttachments bool
+	createMissing      bool
+	hashField          string
+	blockedField       string
+	attachmentField    string
+	checkpointPath     string
+
+	// Shrinking of the images larger than MaxAttachmentSize
+	shrinkImages bool
+	jpegQuality  int
+	maxDimension int
+
+	// List parameters sent by GetPrompts
+	filterByFormula string
+	pageSize        int
+	view            string
+}
+
+// Option configures optional client settings.
+type Option func(*Client)
+
+// WithReplaceAttachments sets whether ProcessPrompts overwrites the existing
+// attachments of a record instead of appending the generated images.
+func WithReplaceAttachments(replace bool) Option {
+	return func(c *Client) {
+		c.replaceAttachments = replace
+	}
+}
+
+// WithCreateMissing sets whether UploadImage creates a new record when no
+// record matches the prompt.
+func WithCreateMissing(create bool) Option {
+	return func(c *Client) {
+		c.createMissing = create
+	}
+}
+
+// WithHashField sets the text field storing the SHA-256 of the images uploaded
+// to each record. ProcessPrompts skips the images whose hash is already stored,
+// so re-running a prompt doesn't add duplicate attachments.
+func WithHashField(field string) Option {
+	return func(c *Client) {
+		c.hashField = field
+	}
+}
+
+// WithAttachmentField sets the attachment field the images are added to,
+// DefaultAttachmentField by default.
+func WithAttachmentField(field string) Option {
+	return func(c *Client) {
+		if field != "" {
+			c.attachmentField = field
+		}
+	}
+}
+
+// WithCheckpoint sets the file recording the records processed by
+// ProcessPrompts. If the batch is interrupted, the records of the checkpoint
+// are only marked as generated by the next run instead of being processed
+// again. The records are dropped from the file once they're marked as
+// generated, and the file is removed when none are left.
+func WithCheckpoint(path string) Option {
+	return func(c *Client) {
+		c.checkpointPath = path
+	}
+}
+
+// WithBlockedField sets the checkbox field checked on the records whose prompt
+// was blocked by the content moderation, so they can be excluded from the next
+// runs by the filter formula instead of being retried.
+func WithBlockedField(field string) Option {
+	return func(c *Client) {
+		c.blockedField = field
+	}
+}
+
+// WithFilterByFormula sets the formula used by GetPrompts to select the
+// records server-side, e.g. "NOT({Generated})".
+func WithFilterByFormula(formula string) Option {
+	return func(c *Client) {
+		c.filterByFormula = formula
+	}
+}
+
+// maxPageSize is the maximum number of records Airtable returns per request.
+const maxPageSize = 100
+
+// WithPageSize sets the number of records fetched per request, up to 100.
+// Larger sizes are clamped to 100, and sizes that aren't positive leave the
+// default of Airtable.
+func WithPageSize(n int) Option {
+	return func(c *Client) {
+		c.pageSize = min(max(n, 0), maxPageSize)
+	}
+}
+
+// WithView sets the table view the records are fetched from, which also
+// determines their order.
+func WithView(view string) Option {
+	return func(c *Client) {
+		c.view = view
+	}
+}
+
+// WithMetrics sets the hooks receiving the request and rate limit metrics.
+func WithMetrics(m metrics.Metrics) Option {
+	return func(c *Client) {
+		c.metrics = metrics.OrNop(m)
+	}
+}
+
+// WithHTTPClient sets the client sending the requests, e.g. to route them
+// through a proxy. Its Timeout limits each request, including the attachment
+// uploads, unless WithTimeout is set. A nil client uses the default one.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithTimeout sets the timeout of each request, DefaultTimeout by default.
+// Uploads of large attachments may need a longer timeout. It applies to a
+// copy of the client set by WithHTTPClient, whatever the order of the options.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithRateLimit sets the maximum number of requests per second sent to
+// Airtable.
+func WithRateLimit(r rate.Limit) Option {
+	return func(c *Client) {
+		c.limiter = rate.NewLimiter(r, 1)
+	}
 }
 
 type Record struct {
@@ -34,54 +196,397 @@ type UpdateResponse struct {
 	Records []Record `json:"records"`
 }
 
-func NewClient(apiKey, baseID, tableName string) *Client {
-	return &Client{
-		APIKey:    apiKey,
-		BaseID:    baseID,
-		TableName: tableName,
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+func NewClient(apiKey, baseID, tableName string, opts ...Option) *Client {
+	c := &Client{
+		APIKey:          apiKey,
+		BaseID:          baseID,
+		TableName:       tableName,
+		limiter:         rate.NewLimiter(DefaultRateLimit, 1),
+		metrics:         metrics.Nop{},
+		attachmentField: DefaultAttachmentField,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if c.timeout > 0 {
+		// The given client may be shared with other users
+		client := *c.httpClient
+		client.Timeout = c.timeout
+		c.httpClient = &client
 	}
+	return c
 }
 
-func (c *Client) GetPrompts() ([]Record, error) {
-	url := fmt.Sprintf("https://api.airtable.com/v0/%s/%s", c.BaseID, c.TableName)
-	req, err := http.NewRequest("GET", url, nil)
+// maxRetries is the number of times a request is retried after a 429 or 5xx
+// response.
+const maxRetries = 3
+
+// backoff is used between retries when the response has no Retry-After header.
+var backoff = []time.Duration{
+	5 * time.Second,
+	15 * time.Second,
+	30 * time.Second,
+}
+
+// do waits for the rate limiter and sends the request, retrying on 429 and
+// 5xx responses. The request body is closed on every path, as for
+// http.Client.Do, which stops the goroutines encoding the upload bodies.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	closeBody := func() {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			closeBody()
+			return nil, err
+		}
+		c.metrics.IncCounter(metrics.AirtableRequests, 1)
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			c.metrics.IncCounter(metrics.AirtableRateLimited, 1)
+		}
+		if !shouldRetry(resp.StatusCode) || attempt >= maxRetries {
+			return resp, nil
+		}
+
+		// Discard the response and rewind the request body
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %w", err)
+			}
+			req.Body = body
+		}
+
+		idx := attempt
+		if idx >= len(backoff) {
+			idx = len(backoff) - 1
+		}
+		wait := retryAfter(resp.Header.Get("Retry-After"), backoff[idx])
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			closeBody()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func shouldRetry(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// retryAfter parses a Retry-After header value, which may be either a number
+// of seconds or an HTTP date, returning def if it can't be parsed.
+func retryAfter(v string, def time.Duration) time.Duration {
+	if v == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return def
+}
+
+// GetPrompts returns the records of the table, filtered by the formula set
+// with WithFilterByFormula.
+func (c *Client) GetPrompts(ctx context.Context) ([]Record, error) {
+	return c.listRecords(ctx, c.filterByFormula)
+}
+
+// listRecords fetches all the pages of records matching the formula.
+func (c *Client) listRecords(ctx context.Context, formula string) ([]Record, error) {
+	params := url.Values{}
+	if formula != "" {
+		params.Set("filterByFormula", formula)
+	}
+	if c.pageSize > 0 {
+		params.Set("pageSize", strconv.Itoa(c.pageSize))
+	}
+	if c.view != "" {
+		params.Set("view", c.view)
+	}
+
+	var records []Record
+	for {
+		u := fmt.Sprintf("https://api.airtable.com/v0/%s/%s?%s", c.BaseID, c.TableName, params.Encode())
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+
+		var listResp ListResponse
+		err = json.NewDecoder(resp.Body).Decode(&listResp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, listResp.Records...)
+		if listResp.Offset == "" {
+			return records, nil
+		}
+		params.Set("offset", listResp.Offset)
+	}
+}
+
+// UpdateRecord appends the image to the record's attachments and marks the
+// record as generated.
+func (c *Client) UpdateRecord(ctx context.Context, recordID string, imageData []byte) error {
+	return c.UpdateRecordImages(ctx, recordID, [][]byte{imageData}, false)
+}
+
+// UpdateRecordImages uploads all the images to the record and marks it as
+// generated. Airtable appends uploaded attachments to the existing ones, so if
+// replace is true the attachment field is cleared before uploading.
+func (c *Client) UpdateRecordImages(ctx context.Context, recordID string, images [][]byte, replace bool) error {
+	if len(images) == 0 {
+		return fmt.Errorf("no images provided")
+	}
+
+	if replace {
+		if err := c.clearAttachments(ctx, recordID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.uploadAttachments(ctx, recordID, images); err != nil {
+		return err
+	}
+
+	// Update the record to mark it as generated
+	return c.patchRecords(ctx, []Record{generatedRecord(recordID)})
+}
+
+func (c *Client) clearAttachments(ctx context.Context, recordID string) error {
+	update := []Record{{ID: recordID, Fields: map[string]interface{}{c.attachmentField: []interface{}{}}}}
+	if err := c.patchRecords(ctx, update); err != nil {
+		return fmt.Errorf("failed to clear attachments: %w", err)
+	}
+	return nil
+}
+
+// uploadAttachments uploads the images in order and returns the number of
+// images uploaded, which are attached even if a later one fails.
+func (c *Client) uploadAttachments(ctx context.Context, recordID string, images [][]byte) (int, error) {
+	for i, imageData := range images {
+		if err := c.uploadAttachment(ctx, recordID, imageData); err != nil {
+			return i, fmt.Errorf("image %d: %w", i+1, err)
+		}
+	}
+	return len(images), nil
+}
+
+// UpdateRecordWithURL appends the image at the public URL to the record's
+// attachments and marks the record as generated. Airtable downloads the image
+// itself, so it isn't limited to MaxAttachmentSize.
+func (c *Client) UpdateRecordWithURL(ctx context.Context, recordID, imageURL string) error {
+	if imageURL == "" {
+		return fmt.Errorf("no image URL provided")
+	}
+	record, err := c.getRecord(ctx, recordID)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	update := urlAttachments(record, c.attachmentField, []string{imageURL}, false)
+	update.Fields["Generated"] = true
+	return c.patchRecords(ctx, []Record{update})
+}
 
+// urlAttachments returns the update attaching the images at the URLs to the
+// field of the record. Updating an attachment field replaces its value, so the
+// existing attachments are kept by referencing their IDs unless replace is
+// true.
+func urlAttachments(record Record, field string, urls []string, replace bool) Record {
+	var attachments []interface{}
+	if !replace {
+		existing, _ := record.Fields[field].([]interface{})
+		for _, a := range existing {
+			if m, ok := a.(map[string]interface{}); ok && m["id"] != nil {
+				attachments = append(attachments, map[string]interface{}{"id": m["id"]})
+			}
+		}
+	}
+	for _, u := range urls {
+		attachments = append(attachments, map[string]interface{}{"url": u})
+	}
+	return Record{ID: record.ID, Fields: map[string]interface{}{field: attachments}}
+}
+
+// getRecord fetches the record with the given ID.
+func (c *Client) getRecord(ctx context.Context, recordID string) (Record, error) {
+	u := fmt.Sprintf("https://api.airtable.com/v0/%s/%s/%s", c.BaseID, c.TableName, recordID)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to create request: %w", err)
+	}
 	req.Header.Set("Authorization", "Bearer "+c.APIKey)
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return Record{}, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
-
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return Record{}, fmt.Errorf("failed to get record %s: status=%d", recordID, resp.StatusCode)
+	}
+	var record Record
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		return Record{}, fmt.Errorf("failed to decode record: %w", err)
 	}
+	return record, nil
+}
 
-	var listResp ListResponse
-	if err := json.NewDecoder(resp.Body).Decode(&listResp); err != nil {
-		return nil, err
+// generatedUpdate returns the update marking the record as generated and
+// storing the hashes of its images, if a hash field is set.
+func (c *Client) generatedUpdate(recordID string, hashes []string) Record {
+	update := generatedRecord(recordID)
+	if c.hashField != "" {
+		update.Fields[c.hashField] = strings.Join(hashes, "\n")
 	}
+	return update
+}
+
+// generatedRecord returns the update marking the record as generated.
+func generatedRecord(recordID string) Record {
+	return Record{ID: recordID, Fields: map[string]interface{}{"Generated": true}}
+}
+
+// maxBatchSize is the maximum number of records per Airtable request.
+const maxBatchSize = 10
+
+// UpdateError reports the records that couldn't be updated.
+type UpdateError struct {
+	RecordIDs []string
+	Err       error
+}
+
+func (e *UpdateError) Error() string {
+	return fmt.Sprintf("failed to update records %s: %v", strings.Join(e.RecordIDs, ", "), e.Err)
+}
+
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
+
+// UpdateRecords updates the records in batches of 10. A failed batch doesn't
+// stop the remaining ones; the IDs of the records that couldn't be updated are
+// reported in an *UpdateError.
+func (c *Client) UpdateRecords(ctx context.Context, records []Record) error {
+	var failed []string
+	var errs []error
+	for start := 0; start < len(records); start += maxBatchSize {
+		batch := records[start:min(start+maxBatchSize, len(records))]
+		if err := c.patchRecords(ctx, batch); err != nil {
+			for _, r := range batch {
+				failed = append(failed, r.ID)
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				// Report the remaining records as failed too
+				for _, r := range records[start+len(batch):] {
+					failed = append(failed, r.ID)
+				}
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &UpdateError{RecordIDs: failed, Err: errors.Join(errs...)}
+	}
+	return nil
+}
+
+// MaxAttachmentSize is the maximum size of an image uploaded to a record.
+// Airtable's uploadAttachment endpoint rejects files larger than 5MB, larger
+// images must be attached from a public URL instead.
+const MaxAttachmentSize = 5 * 1024 * 1024
+
+// uploadBody returns a function creating readers of the JSON payload of the
+// uploadAttachment endpoint, and the payload length. The image is base64
+// encoded while the payload is read, so the encoded copy is never held in
+// memory.
+func uploadBody(contentType, filename string, data []byte) (func() io.ReadCloser, int64, error) {
+	// The fields are written before the file so it can be streamed last
+	head, err := json.Marshal(struct {
+		ContentType string `json:"contentType"`
+		Filename    string `json:"filename"`
+	}{contentType, filename})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to marshal upload payload: %w", err)
+	}
+	prefix := append(head[:len(head)-1], `,"file":"`...)
+	suffix := []byte(`"}`)
+	length := int64(len(prefix) + base64.StdEncoding.EncodedLen(len(data)) + len(suffix))
+
+	body := func() io.ReadCloser {
+		pr, pw := io.Pipe()
+		go func() {
+			enc := base64.NewEncoder(base64.StdEncoding, pw)
+			_, err := enc.Write(data)
+			if err == nil {
+				err = enc.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		// Closing the body stops the encoding goroutine
+		return readCloser{io.MultiReader(bytes.NewReader(prefix), pr, bytes.NewReader(suffix)), pr}
+	}
+	return body, length, nil
+}
 
-	return listResp.Records, nil
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
 
-func (c *Client) UpdateRecord(recordID string, imageData []byte) error {
+func (c *Client) uploadAttachment(ctx context.Context, recordID string, imageData []byte) error {
 	// Validate input data
 	if len(imageData) == 0 {
 		return fmt.Errorf("empty image data provided")
 	}
 
-	// Check file size (max 5MB as per Airtable's limit)
-	const maxSize = 5 * 1024 * 1024 // 5MB
-	if len(imageData) > maxSize {
-		return fmt.Errorf("image size exceeds maximum allowed size of 5MB (current size: %.2fMB)", float64(len(imageData))/1024/1024)
+	if len(imageData) > MaxAttachmentSize && c.shrinkImages {
+		shrunk, desc, err := shrinkImage(imageData, MaxAttachmentSize, c.jpegQuality, c.maxDimension)
+		if err != nil {
+			return fmt.Errorf("image size exceeds maximum allowed size of 5MB (current size: %.2fMB): %w", megabytes(len(imageData)), err)
+		}
+		fmt.Printf("Shrunk image for record %s from %s\n", recordID, desc)
+		imageData = shrunk
+	}
+	if len(imageData) > MaxAttachmentSize {
+		return fmt.Errorf("image size exceeds maximum allowed size of 5MB (current size: %.2fMB)", megabytes(len(imageData)))
 	}
 
 	// Detect MIME type
@@ -90,69 +595,121 @@ func (c *Client) UpdateRecord(recordID string, imageData []byte) error {
 		return fmt.Errorf("invalid image format: %s", mimeType)
 	}
 
-	// Convert image data to base64
-	imageBase64 := base64.StdEncoding.EncodeToString(imageData)
-
-	// Prepare the upload payload
-	uploadPayload := struct {
-		ContentType string `json:"contentType"`
-		File        string `json:"file"`
-		Filename    string `json:"filename"`
-	}{
-		ContentType: mimeType,
-		File:        imageBase64,
-		Filename:    fmt.Sprintf("generated_image.%s", getExtensionFromMIME(mimeType)),
-	}
-
-	payload, err := json.Marshal(uploadPayload)
+	ext, err := getExtensionFromMIME(mimeType)
 	if err != nil {
-		return fmt.Errorf("failed to marshal upload payload: %w", err)
+		return err
 	}
 
 	// Use the dedicated attachment upload endpoint
-	url := fmt.Sprintf("https://content.airtable.com/v0/%s/%s/Image/uploadAttachment", c.BaseID, recordID)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	u := fmt.Sprintf("https://content.airtable.com/v0/%s/%s/%s/uploadAttachment", c.BaseID, recordID, url.PathEscape(c.attachmentField))
+	body, length, err := uploadBody(mimeType, fmt.Sprintf("generated_image.%s", ext), imageData)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
+	// The body is rewound by do when the request is retried
+	req.Body = body()
+	req.ContentLength = length
+	req.GetBody = func() (io.ReadCloser, error) {
+		return body(), nil
+	}
 
 	req.Header.Set("Authorization", "Bearer "+c.APIKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to upload attachment: status=%d, response=%s", resp.StatusCode, string(body))
+		return fmt.Errorf("failed to upload attachment to field %q: status=%d, response=%s", c.attachmentField, resp.StatusCode, string(respBody))
 	}
+	return nil
+}
 
-	// Update the record to mark it as generated
-	update := UpdateResponse{
-		Records: []Record{
-			{
-				ID: recordID,
-				Fields: map[string]interface{}{
-					"Generated": true,
-				},
-			},
-		},
-	}
-
-	payload, err = json.Marshal(update)
+type schemaResponse struct {
+	Tables []struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Fields []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"fields"`
+	} `json:"tables"`
+}
+
+// CheckAttachmentField checks that the attachment field exists in the table
+// schema and is an attachment field. Reading the schema requires the
+// schema.bases:read scope; without it, or if the schema can't be read for
+// another reason, the field isn't checked and a missing field is reported by
+// the upload errors instead.
+func (c *Client) CheckAttachmentField(ctx context.Context) error {
+	u := fmt.Sprintf("https://api.airtable.com/v0/meta/bases/%s/tables", c.BaseID)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+
+	resp, err := c.do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Printf("Warning: couldn't read the table schema to check the %q field: %v\n", c.attachmentField, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Warning: couldn't read the table schema to check the %q field (status=%d)\n", c.attachmentField, resp.StatusCode)
+		return nil
+	}
+
+	var schema schemaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		fmt.Printf("Warning: couldn't decode the table schema to check the %q field: %v\n", c.attachmentField, err)
+		return nil
+	}
+	for _, table := range schema.Tables {
+		if table.ID != c.TableName && table.Name != c.TableName {
+			continue
+		}
+		var attachmentFields []string
+		for _, f := range table.Fields {
+			if f.Type == "multipleAttachments" {
+				attachmentFields = append(attachmentFields, f.Name)
+			}
+			if f.Name != c.attachmentField {
+				continue
+			}
+			if f.Type != "multipleAttachments" {
+				return fmt.Errorf("field %q of table %s is a %s field, not an attachment field", f.Name, c.TableName, f.Type)
+			}
+			return nil
+		}
+		return fmt.Errorf("table %s has no field %q, attachment fields: %s", c.TableName, c.attachmentField, strings.Join(attachmentFields, ", "))
+	}
+	return fmt.Errorf("table %s not found in base %s", c.TableName, c.BaseID)
+}
+
+func (c *Client) patchRecords(ctx context.Context, records []Record) error {
+	payload, err := json.Marshal(UpdateResponse{Records: records})
 	if err != nil {
 		return fmt.Errorf("failed to marshal update payload: %w", err)
 	}
 
-	url = fmt.Sprintf("https://api.airtable.com/v0/%s/%s", c.BaseID, c.TableName)
-	req, err = http.NewRequest("PATCH", url, bytes.NewBuffer(payload))
+	url := fmt.Sprintf("https://api.airtable.com/v0/%s/%s", c.BaseID, c.TableName)
+	req, err := http.NewRequestWithContext(ctx, "PATCH", url, bytes.NewBuffer(payload))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -160,13 +717,13 @@ func (c *Client) UpdateRecord(recordID string, imageData []byte) error {
 	req.Header.Set("Authorization", "Bearer "+c.APIKey)
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err = c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	body, err = io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
@@ -178,115 +735,432 @@ func (c *Client) UpdateRecord(recordID string, imageData []byte) error {
 	return nil
 }
 
-func (c *Client) ProcessPrompts(processFunc func(prompt string) (string, error)) error {
-	records, err := c.GetPrompts()
+// Record statuses reported in a BatchResult.
+const (
+	StatusProcessed = "processed"
+	StatusSkipped   = "skipped"
+	StatusFailed    = "failed"
+	StatusBlocked   = "blocked"
+)
+
+// ErrBlocked is wrapped by the errors of the process functions when the prompt
+// was rejected by the content moderation. The record is reported with
+// StatusBlocked rather than StatusFailed.
+var ErrBlocked = errors.New("prompt blocked by moderation")
+
+// RecordResult is the outcome of processing a single record.
+type RecordResult struct {
+	RecordID string
+	Prompt   string
+	Status   string
+	Err      error
+}
+
+// BatchResult is the outcome of ProcessPrompts.
+type BatchResult struct {
+	Records   []RecordResult
+	Processed int
+	Skipped   int
+	Failed    int
+	Blocked   int
+}
+
+func (r *BatchResult) add(rec RecordResult) {
+	r.Records = append(r.Records, rec)
+	switch rec.Status {
+	case StatusProcessed:
+		r.Processed++
+	case StatusSkipped:
+		r.Skipped++
+	case StatusFailed:
+		r.Failed++
+	case StatusBlocked:
+		r.Blocked++
+	}
+}
+
+// fail marks the processed records with the given IDs as failed.
+func (r *BatchResult) fail(recordIDs []string, err error) {
+	ids := make(map[string]bool, len(recordIDs))
+	for _, id := range recordIDs {
+		ids[id] = true
+	}
+	for i := range r.Records {
+		rec := &r.Records[i]
+		if rec.Status == StatusProcessed && ids[rec.RecordID] {
+			rec.Status = StatusFailed
+			rec.Err = err
+			r.Processed--
+			r.Failed++
+		}
+	}
+}
+
+// ProcessPrompts calls processFunc for each record that hasn't been generated
+// yet and uploads the images it returns, either a file or a directory
+// containing image_* files. The returned BatchResult reports the outcome of
+// each record, even if the context is cancelled.
+func (c *Client) ProcessPrompts(ctx context.Context, processFunc func(recordID, prompt string) (string, error)) (*BatchResult, error) {
+	return c.ProcessPromptFiles(ctx, func(recordID, prompt string) ([]string, error) {
+		path, err := processFunc(recordID, prompt)
+		if err != nil {
+			return nil, err
+		}
+		return imageFiles(path)
+	})
+}
+
+// ProcessPromptFiles is like ProcessPrompts but processFunc returns the paths
+// of the generated images, so every image is uploaded whatever its name.
+func (c *Client) ProcessPromptFiles(ctx context.Context, processFunc func(recordID, prompt string) ([]string, error)) (*BatchResult, error) {
+	return c.ProcessPromptAttachments(ctx, func(recordID, prompt string) ([]Attachment, error) {
+		files, err := processFunc(recordID, prompt)
+		if err != nil {
+			return nil, err
+		}
+		attachments := make([]Attachment, len(files))
+		for i, f := range files {
+			attachments[i] = Attachment{Path: f}
+		}
+		return attachments, nil
+	})
+}
+
+// Attachment is an image generated for a record. It's attached from its URL
+// if set, which Airtable downloads itself, otherwise the file at Path is
+// uploaded. The file is also used to hash the image when a hash field is set.
+type Attachment struct {
+	Path string
+	URL  string
+}
+
+// ProcessPromptAttachments is like ProcessPromptFiles but processFunc returns
+// the URLs of the generated images, which are attached without uploading
+// them. Images without a URL fall back to uploading the file.
+func (c *Client) ProcessPromptAttachments(ctx context.Context, processFunc func(recordID, prompt string) ([]Attachment, error)) (*BatchResult, error) {
+	// Fail before generating anything if the images can't be attached
+	if err := c.CheckAttachmentField(ctx); err != nil {
+		return nil, err
+	}
+
+	records, err := c.GetPrompts(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get prompts: %w", err)
+		return nil, fmt.Errorf("failed to get prompts: %w", err)
 	}
 
+	result := &BatchResult{}
 	if len(records) == 0 {
 		fmt.Println("No prompts found in Airtable")
-		return nil
+		return result, nil
 	}
 
-	processedCount := 0
-	skippedCount := 0
+	var cp *checkpoint
+	if c.checkpointPath != "" {
+		if cp, err = openCheckpoint(c.checkpointPath); err != nil {
+			return nil, err
+		}
+		defer cp.close()
+	}
+
+	// The records are marked as generated in batches
+	var pending []Record
+	flush := func(ctx context.Context) {
+		err := c.UpdateRecords(ctx, pending)
+		updated := make(map[string]bool, len(pending))
+		for _, r := range pending {
+			updated[r.ID] = true
+		}
+		pending = nil
+		if err != nil {
+			fmt.Printf("Error marking records as generated: %v\n", err)
+			var updateErr *UpdateError
+			if errors.As(err, &updateErr) {
+				result.fail(updateErr.RecordIDs, err)
+				for _, id := range updateErr.RecordIDs {
+					delete(updated, id)
+				}
+			} else {
+				clear(updated)
+			}
+		}
+		// The records marked as generated don't need their entry anymore
+		if cp != nil {
+			if err := cp.drop(slices.Collect(maps.Keys(updated))); err != nil {
+				fmt.Printf("Warning: couldn't update checkpoint: %v\n", err)
+			}
+		}
+	}
 
 	for _, record := range records {
+		// Stop processing if the context was cancelled, keeping track of the
+		// records that were already uploaded
+		if err := ctx.Err(); err != nil {
+			flush(context.WithoutCancel(ctx))
+			return result, err
+		}
+
 		// Skip if already generated
 		if generated, ok := record.Fields["Generated"].(bool); ok && generated {
-			skippedCount++
+			result.add(RecordResult{RecordID: record.ID, Status: StatusSkipped})
 			fmt.Printf("Skipping already processed prompt ID: %s\n", record.ID)
+			// Its entry isn't needed anymore, and would mark the record as
+			// generated again if it's later unmarked to regenerate it
+			if _, done := cp.lookup(record.ID); done {
+				if err := cp.drop([]string{record.ID}); err != nil {
+					fmt.Printf("Warning: couldn't update checkpoint: %v\n", err)
+				}
+			}
 			continue
 		}
 
 		prompt, ok := record.Fields["Prompt"].(string)
+
+		// A previous run processed the record but didn't mark it as
+		// generated
+		if hashes, done := cp.lookup(record.ID); done {
+			result.add(RecordResult{RecordID: record.ID, Prompt: prompt, Status: StatusProcessed})
+			fmt.Printf("Prompt ID %s was processed by a previous run, marking it as generated\n", record.ID)
+			pending = append(pending, c.generatedUpdate(record.ID, hashes))
+			if len(pending) >= maxBatchSize {
+				flush(ctx)
+			}
+			continue
+		}
+
 		if !ok || prompt == "" {
+			result.add(RecordResult{RecordID: record.ID, Status: StatusSkipped})
 			fmt.Printf("Warning: Record %s has no valid prompt field\n", record.ID)
 			continue
 		}
 
-		fmt.Printf("Processing prompt ID %s: %q\n", record.ID, prompt)
-
-		// Process the prompt
-		imageFile, err := processFunc(prompt)
-		if err != nil {
-			fmt.Printf("Error processing prompt '%s': %v\n", prompt, err)
+		fmt.Printf("Processing prompt ID %s: %q\n", record.ID, textutil.SanitizePrompt(prompt))
+		hashes, err := c.processRecord(ctx, record, prompt, processFunc)
+		if errors.Is(err, ErrBlocked) {
+			result.add(RecordResult{RecordID: record.ID, Prompt: prompt, Status: StatusBlocked, Err: err})
+			fmt.Printf("Prompt ID %s blocked by moderation: %v\n", record.ID, err)
+			if c.blockedField != "" {
+				pending = append(pending, Record{ID: record.ID, Fields: map[string]interface{}{c.blockedField: true}})
+				if len(pending) >= maxBatchSize {
+					flush(ctx)
+				}
+			}
 			continue
 		}
-
-		// Verify the image file exists
-		fileInfo, err := os.Stat(imageFile)
 		if err != nil {
-			fmt.Printf("Error: Image file '%s' does not exist: %v\n", imageFile, err)
+			result.add(RecordResult{RecordID: record.ID, Prompt: prompt, Status: StatusFailed, Err: err})
+			fmt.Printf("Error processing prompt %q: %v\n", textutil.SanitizePrompt(prompt), err)
 			continue
 		}
-
-		// Check if the path is a directory and handle accordingly
-		if fileInfo.IsDir() {
-			// Try to find the image file in the directory
-			files, err := os.ReadDir(imageFile)
-			if err != nil {
-				fmt.Printf("Error reading directory '%s': %v\n", imageFile, err)
-				continue
+		result.add(RecordResult{RecordID: record.ID, Prompt: prompt, Status: StatusProcessed})
+		fmt.Printf("Successfully processed prompt ID %s: %q\n", record.ID, textutil.SanitizePrompt(prompt))
+		if cp != nil {
+			if err := cp.add(record.ID, hashes); err != nil {
+				fmt.Printf("Warning: couldn't checkpoint record %s: %v\n", record.ID, err)
 			}
+		}
 
-			// Look for image files in the directory
-			var found bool
-			for _, file := range files {
-				if !file.IsDir() && strings.HasPrefix(file.Name(), "image_") {
-					imageFile = filepath.Join(imageFile, file.Name())
-					found = true
-					break
-				}
-			}
+		pending = append(pending, c.generatedUpdate(record.ID, hashes))
+		if len(pending) >= maxBatchSize {
+			flush(ctx)
+		}
+	}
+	flush(ctx)
 
-			if !found {
-				fmt.Printf("Error: No valid image file found in directory '%s'\n", imageFile)
-				continue
-			}
+	// Every processed record is marked as generated, so the checkpoint isn't
+	// needed anymore
+	if cp != nil && cp.empty() {
+		if err := cp.remove(); err != nil {
+			fmt.Printf("Warning: couldn't remove checkpoint: %v\n", err)
 		}
+	}
+
+	fmt.Printf("Processing completed. Total records: %d, Processed: %d, Skipped: %d, Failed: %d, Blocked: %d\n",
+		len(records), result.Processed, result.Skipped, result.Failed, result.Blocked)
+
+	return result, nil
+}
+
+// processRecord generates the images for the prompt and uploads them to the
+// record, without marking it as generated. It returns the hashes of the images
+// attached to the record.
+func (c *Client) processRecord(ctx context.Context, record Record, prompt string, processFunc func(recordID, prompt string) ([]Attachment, error)) ([]string, error) {
+	recordID := record.ID
+
+	// Process the prompt
+	attachments, err := processFunc(recordID, prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, errors.New("no images generated")
+	}
+
+	// The existing attachments are kept unless they are replaced
+	var hashes []string
+	known := make(map[string]bool)
+	if c.hashField != "" && !c.replaceAttachments {
+		hashes = recordHashes(record, c.hashField)
+		for _, h := range hashes {
+			known[h] = true
+		}
+	}
 
-		// Read the generated image
-		imageData, err := os.ReadFile(imageFile)
+	// Read the generated images, the ones with a URL are only read to be
+	// hashed
+	var urls []string
+	var images [][]byte
+	// uploads are the hashes of the images, if a hash field is set
+	var uploads []string
+	var size int
+	skipped := 0
+	for _, a := range attachments {
+		if a.URL != "" && (c.hashField == "" || a.Path == "") {
+			urls = append(urls, a.URL)
+			continue
+		}
+		imageData, err := os.ReadFile(a.Path)
 		if err != nil {
-			fmt.Printf("Error reading image file '%s': %v\n", imageFile, err)
+			fmt.Printf("Error reading image file '%s': %v\n", a.Path, err)
 			continue
 		}
 
 		// Verify we have valid image data
 		if len(imageData) == 0 {
-			fmt.Printf("Error: Image file '%s' is empty\n", imageFile)
+			fmt.Printf("Error: Image file '%s' is empty\n", a.Path)
 			continue
 		}
-
-		fmt.Printf("Attempting to update record %s with image (size: %d bytes)\n", record.ID, len(imageData))
-
-		// Update the record with the generated image
-		if err := c.UpdateRecord(record.ID, imageData); err != nil {
-			fmt.Printf("Error updating record for prompt '%s': %v\n", prompt, err)
+		if c.hashField != "" {
+			hash := imageHash(imageData)
+			if known[hash] {
+				skipped++
+				continue
+			}
+			known[hash] = true
+			hashes = append(hashes, hash)
+		}
+		if a.URL != "" {
+			urls = append(urls, a.URL)
 			continue
 		}
+		images = append(images, imageData)
+		if c.hashField != "" {
+			uploads = append(uploads, hashes[len(hashes)-1])
+		}
+		size += len(imageData)
+	}
+	if len(images) == 0 && len(urls) == 0 && skipped > 0 {
+		fmt.Printf("All %d images are already attached to record %s\n", skipped, recordID)
+		return hashes, nil
+	}
+	if len(images) == 0 && len(urls) == 0 {
+		return nil, fmt.Errorf("no readable images in %s", attachmentPaths(attachments))
+	}
+	if skipped > 0 {
+		fmt.Printf("Skipping %d images already attached to record %s\n", skipped, recordID)
+	}
 
-		processedCount++
-		fmt.Printf("Successfully processed prompt ID %s: %q\n", record.ID, prompt)
+	// Attach the images with a URL, which replaces the existing attachments
+	// if requested
+	if len(urls) > 0 {
+		fmt.Printf("Attaching %d image URLs to record %s\n", len(urls), recordID)
+		if err := c.patchRecords(ctx, []Record{urlAttachments(record, c.attachmentField, urls, c.replaceAttachments)}); err != nil {
+			return nil, fmt.Errorf("failed to attach image URLs: %w", err)
+		}
+	} else if c.replaceAttachments {
+		if err := c.clearAttachments(ctx, recordID); err != nil {
+			return nil, err
+		}
+	}
+	if len(images) == 0 {
+		return hashes, nil
 	}
 
-	fmt.Printf("Processing completed. Total records: %d, Processed: %d, Skipped: %d\n",
-		len(records), processedCount, skippedCount)
+	// Upload the other images to the record
+	fmt.Printf("Attempting to update record %s with %d images (size: %d bytes)\n", recordID, len(images), size)
+	if n, err := c.uploadAttachments(ctx, recordID, images); err != nil {
+		if n > 0 || len(urls) > 0 {
+			c.recordPartialUpload(ctx, recordID, hashes, uploads, n)
+		}
+		return nil, err
+	}
+	return hashes, nil
+}
 
-	return nil
+// recordPartialUpload stores the hashes of the images attached to the record
+// before the upload of uploads[n] failed, so retrying the record doesn't
+// attach them twice. Without a hash field, the record is only reported.
+func (c *Client) recordPartialUpload(ctx context.Context, recordID string, hashes, uploads []string, n int) {
+	if c.hashField == "" {
+		fmt.Printf("Warning: record %s keeps the images attached before the upload failed, retrying it attaches them again\n", recordID)
+		return
+	}
+	failed := uploads[n:]
+	attached := slices.DeleteFunc(slices.Clone(hashes), func(h string) bool {
+		return slices.Contains(failed, h)
+	})
+	update := Record{ID: recordID, Fields: map[string]interface{}{c.hashField: strings.Join(attached, "\n")}}
+	// The hashes are stored even if the batch is being cancelled
+	if err := c.patchRecords(context.WithoutCancel(ctx), []Record{update}); err != nil {
+		fmt.Printf("Warning: couldn't record the images attached to record %s: %v\n", recordID, err)
+	}
 }
 
-func (c *Client) UploadImage(prompt string, imagePath string) error {
-	// Read the image file
-	imageData, err := os.ReadFile(imagePath)
+// attachmentPaths lists the files of the attachments for error messages.
+func attachmentPaths(attachments []Attachment) string {
+	paths := make([]string, len(attachments))
+	for i, a := range attachments {
+		paths[i] = a.Path
+	}
+	return strings.Join(paths, ", ")
+}
+
+// imageFiles returns the image file, or the image_* files of the directory.
+func imageFiles(imageFile string) ([]string, error) {
+	// Verify the image file exists
+	fileInfo, err := os.Stat(imageFile)
 	if err != nil {
-		return fmt.Errorf("failed to read image file: %w", err)
+		return nil, fmt.Errorf("image file '%s' does not exist: %w", imageFile, err)
+	}
+	if !fileInfo.IsDir() {
+		return []string{imageFile}, nil
 	}
 
+	// Look for image files in the directory
+	files, err := os.ReadDir(imageFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory '%s': %w", imageFile, err)
+	}
+	var imageFiles []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), "image_") {
+			imageFiles = append(imageFiles, filepath.Join(imageFile, file.Name()))
+		}
+	}
+	if len(imageFiles) == 0 {
+		return nil, fmt.Errorf("no valid image file found in directory '%s'", imageFile)
+	}
+	return imageFiles, nil
+}
+
+// imageHash returns the hex encoded SHA-256 of the image.
+func imageHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordHashes returns the image hashes stored in the field of the record, one
+// per line.
+func recordHashes(record Record, field string) []string {
+	v, _ := record.Fields[field].(string)
+	return strings.Fields(v)
+}
+
+// UploadImage uploads the image to the record matching the prompt. It fetches
+// all records to find the match, so prefer UploadImageToRecord when the record
+// ID is already known.
+func (c *Client) UploadImage(ctx context.Context, prompt string, imagePath string) error {
 	// Get records to find the matching prompt
-	records, err := c.GetPrompts()
+	records, err := c.listRecords(ctx, fmt.Sprintf("{Prompt} = %s", formulaString(prompt)))
 	if err != nil {
 		return fmt.Errorf("failed to get records: %w", err)
 	}
@@ -301,24 +1175,105 @@ func (c *Client) UploadImage(prompt string, imagePath string) error {
 	}
 
 	if recordID == "" {
-		return fmt.Errorf("no record found for prompt: %s", prompt)
+		if !c.createMissing {
+			return fmt.Errorf("no record found for prompt: %s", prompt)
+		}
+		imageData, err := os.ReadFile(imagePath)
+		if err != nil {
+			return fmt.Errorf("failed to read image file: %w", err)
+		}
+		_, err = c.CreateRecord(ctx, prompt, imageData)
+		return err
+	}
+
+	return c.UploadImageToRecord(ctx, recordID, imagePath)
+}
+
+// formulaString quotes s as a string literal of an Airtable formula.
+func formulaString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// CreateRecord creates a record with the prompt, attaches the image and marks
+// it as generated. It returns the ID of the new record.
+func (c *Client) CreateRecord(ctx context.Context, prompt string, imageData []byte) (string, error) {
+	payload, err := json.Marshal(UpdateResponse{Records: []Record{{Fields: map[string]interface{}{"Prompt": prompt}}}})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal create payload: %w", err)
+	}
+
+	url := fmt.Sprintf("https://api.airtable.com/v0/%s/%s", c.BaseID, c.TableName)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to create record: status=%d, response=%s", resp.StatusCode, string(body))
+	}
+
+	var created UpdateResponse
+	if err := json.Unmarshal(body, &created); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if len(created.Records) == 0 || created.Records[0].ID == "" {
+		return "", fmt.Errorf("no record returned: %s", string(body))
+	}
+
+	recordID := created.Records[0].ID
+	if err := c.UpdateRecord(ctx, recordID, imageData); err != nil {
+		return recordID, err
+	}
+	return recordID, nil
+}
+
+// UploadImageToRecord uploads the image to the record with the given ID.
+func (c *Client) UploadImageToRecord(ctx context.Context, recordID string, imagePath string) error {
+	// Read the image file
+	imageData, err := os.ReadFile(imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to read image file: %w", err)
 	}
 
 	// Update the record with the image
-	return c.UpdateRecord(recordID, imageData)
+	return c.UpdateRecord(ctx, recordID, imageData)
 }
 
-func getExtensionFromMIME(mimeType string) string {
+// getExtensionFromMIME returns the file extension of the image MIME type. It
+// fails for unknown types, since a wrong extension corrupts the attachment.
+func getExtensionFromMIME(mimeType string) (string, error) {
 	switch mimeType {
 	case "image/jpeg", "image/jpg":
-		return "jpg"
+		return "jpg", nil
 	case "image/png":
-		return "png"
+		return "png", nil
 	case "image/gif":
-		return "gif"
+		return "gif", nil
 	case "image/webp":
-		return "webp"
+		return "webp", nil
+	case "image/bmp":
+		return "bmp", nil
+	case "image/tiff":
+		return "tiff", nil
+	case "image/avif":
+		return "avif", nil
 	default:
-		return "png" // Default to png if unknown
+		return "", fmt.Errorf("unsupported image type: %s", mimeType)
 	}
 }
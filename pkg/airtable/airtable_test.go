@@ -0,0 +1,757 @@
+package airtable
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"automation/leoverse/pkg/metrics"
+	"automation/leoverse/pkg/metrics/metricstest"
+)
+
+func TestGetExtensionFromMIME(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		ext      string
+		wantErr  bool
+	}{
+		{"image/jpeg", "jpg", false},
+		{"image/jpg", "jpg", false},
+		{"image/png", "png", false},
+		{"image/gif", "gif", false},
+		{"image/webp", "webp", false},
+		{"image/bmp", "bmp", false},
+		{"image/tiff", "tiff", false},
+		{"image/avif", "avif", false},
+		{"image/x-icon", "", true},
+		{"application/octet-stream", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		ext, err := getExtensionFromMIME(tt.mimeType)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.mimeType, err, tt.wantErr)
+			continue
+		}
+		if ext != tt.ext {
+			t.Errorf("%q: got %q, want %q", tt.mimeType, ext, tt.ext)
+		}
+	}
+}
+
+func TestProcessRecordSkipsKnownImages(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("image data")
+	if err := os.WriteFile(filepath.Join(dir, "image_1.png"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// No request is sent, as the image is already attached
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		return nil, errors.New("unexpected request")
+	})
+	c := NewClient("key", "base", "table", WithHashField("Hashes"), WithHTTPClient(&http.Client{Transport: transport}))
+	record := Record{ID: "rec1", Fields: map[string]interface{}{"Hashes": "other\n" + imageHash(data)}}
+	hashes, err := c.processRecord(context.Background(), record, "a cat", func(recordID, prompt string) ([]Attachment, error) {
+		return []Attachment{{Path: filepath.Join(dir, "image_1.png")}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(hashes, ","); got != "other,"+imageHash(data) {
+		t.Errorf("unexpected hashes %s", got)
+	}
+}
+
+func TestProcessRecordPartialUpload(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	var images [][]byte
+	for i := range 3 {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, i+1, i+1))); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("image_%d.png", i+1))
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		images = append(images, buf.Bytes())
+	}
+
+	// The second upload fails, after the first image was attached
+	uploads := 0
+	var patched UpdateResponse
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		switch r.Method {
+		case "POST":
+			if uploads++; uploads == 2 {
+				status = http.StatusUnprocessableEntity
+			}
+		case "PATCH":
+			if err := json.NewDecoder(r.Body).Decode(&patched); err != nil {
+				t.Error(err)
+			}
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader("{}")), Request: r}, nil
+	})
+	c := NewClient("key", "base", "table", WithHashField("Hashes"), WithHTTPClient(&http.Client{Transport: transport}))
+	record := Record{ID: "rec1", Fields: map[string]interface{}{"Hashes": "other"}}
+	_, err := c.processRecord(context.Background(), record, "a cat", func(recordID, prompt string) ([]Attachment, error) {
+		return []Attachment{{Path: paths[0]}, {Path: paths[1]}, {Path: paths[2]}}, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "image 2") {
+		t.Fatalf("got error %v, want the second upload to fail", err)
+	}
+	if uploads != 2 {
+		t.Errorf("got %d uploads, want none after the failure", uploads)
+	}
+	// The attached image is recorded so it isn't uploaded again, but the
+	// record isn't marked as generated
+	want := "other\n" + imageHash(images[0])
+	if len(patched.Records) != 1 || patched.Records[0].ID != "rec1" || patched.Records[0].Fields["Hashes"] != want {
+		t.Errorf("got update %+v, want the hashes %q", patched, want)
+	}
+	if _, ok := patched.Records[0].Fields["Generated"]; ok {
+		t.Error("record marked as generated")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestProcessRecordAttachesURLs(t *testing.T) {
+	var patched UpdateResponse
+	c := NewClient("key", "base", "table")
+	c.httpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Method != "PATCH" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patched); err != nil {
+			t.Error(err)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Request: r}, nil
+	})}
+
+	existing := []interface{}{map[string]interface{}{"id": "att1", "url": "https://dl.airtable.com/old.png"}}
+	record := Record{ID: "rec1", Fields: map[string]interface{}{"Image": existing}}
+	_, err := c.processRecord(context.Background(), record, "a cat", func(recordID, prompt string) ([]Attachment, error) {
+		return []Attachment{{URL: "https://cdn.leonardo.ai/1.jpg"}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patched.Records) != 1 || patched.Records[0].ID != "rec1" {
+		t.Fatalf("unexpected update %+v", patched)
+	}
+	got, _ := json.Marshal(patched.Records[0].Fields["Image"])
+	if want := `[{"id":"att1"},{"url":"https://cdn.leonardo.ai/1.jpg"}]`; string(got) != want {
+		t.Errorf("got attachments %s, want %s", got, want)
+	}
+}
+
+func TestUploadImageCreateMissing(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	imagePath := filepath.Join(t.TempDir(), "image_1.png")
+	if err := os.WriteFile(imagePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests []string
+	var created, patched UpdateResponse
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requests = append(requests, r.Method+" "+r.URL.Host+r.URL.Path)
+		body := "{}"
+		switch r.Method {
+		case "GET":
+			// The only record has another prompt
+			body = `{"records":[{"id":"rec1","fields":{"Prompt":"a dog"}}]}`
+		case "POST":
+			if r.URL.Host == "api.airtable.com" {
+				if err := json.NewDecoder(r.Body).Decode(&created); err != nil {
+					t.Error(err)
+				}
+				body = `{"records":[{"id":"rec2","fields":{"Prompt":"a cat"}}]}`
+			}
+		case "PATCH":
+			if err := json.NewDecoder(r.Body).Decode(&patched); err != nil {
+				t.Error(err)
+			}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Request: r}, nil
+	})
+
+	c := NewClient("key", "base", "Prompts", WithHTTPClient(&http.Client{Transport: transport}))
+	if err := c.UploadImage(context.Background(), "a cat", imagePath); err == nil || !strings.Contains(err.Error(), "no record found") {
+		t.Errorf("got error %v, want no record found without WithCreateMissing", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("got requests %v, want only the lookup", requests)
+	}
+
+	requests = nil
+	c = NewClient("key", "base", "Prompts", WithHTTPClient(&http.Client{Transport: transport}), WithCreateMissing(true))
+	if err := c.UploadImage(context.Background(), "a cat", imagePath); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET api.airtable.com/v0/base/Prompts",
+		"POST api.airtable.com/v0/base/Prompts",
+		"POST content.airtable.com/v0/base/rec2/Image/uploadAttachment",
+		"PATCH api.airtable.com/v0/base/Prompts",
+	}
+	if !slices.Equal(requests, want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+	if len(created.Records) != 1 || created.Records[0].ID != "" || created.Records[0].Fields["Prompt"] != "a cat" || len(created.Records[0].Fields) != 1 {
+		t.Errorf("unexpected create payload %+v", created)
+	}
+	if len(patched.Records) != 1 || patched.Records[0].ID != "rec2" || patched.Records[0].Fields["Generated"] != true {
+		t.Errorf("unexpected update %+v, want rec2 marked as generated", patched)
+	}
+}
+
+func TestUpdateRecordWithURL(t *testing.T) {
+	var patched []byte
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := "{}"
+		switch r.Method {
+		case "GET":
+			if r.URL.Path != "/v0/base/Prompts/rec1" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			}
+			body = `{"id":"rec1","fields":{"Prompt":"a cat","Image":[{"id":"att1","url":"https://dl.airtable.com/old.png"}]}}`
+		case "PATCH":
+			patched, _ = io.ReadAll(r.Body)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body)), Request: r}, nil
+	})
+	c := NewClient("key", "base", "Prompts", WithHTTPClient(&http.Client{Transport: transport}))
+	if err := c.UpdateRecordWithURL(context.Background(), "rec1", "https://cdn.leonardo.ai/1.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	// The existing attachment is kept by its ID
+	want := `{"records":[{"id":"rec1","fields":{"Generated":true,"Image":[{"id":"att1"},{"url":"https://cdn.leonardo.ai/1.jpg"}]}}]}`
+	if string(patched) != want {
+		t.Errorf("got payload %s, want %s", patched, want)
+	}
+
+	if err := c.UpdateRecordWithURL(context.Background(), "rec1", ""); err == nil {
+		t.Error("expected error without image URL")
+	}
+}
+
+func TestCheckAttachmentField(t *testing.T) {
+	schema := `{"tables":[{"id":"tbl1","name":"Prompts","fields":[{"name":"Prompt","type":"multilineText"},{"name":"Image","type":"multipleAttachments"},{"name":"Renders","type":"multipleAttachments"}]}]}`
+	status := http.StatusOK
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path != "/v0/meta/bases/base/tables" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(schema)), Request: r}, nil
+	})
+	client := func(table, field string) *Client {
+		return NewClient("key", "base", table, WithHTTPClient(&http.Client{Transport: transport}), WithAttachmentField(field))
+	}
+
+	tests := []struct {
+		table, field string
+		wantErr      bool
+	}{
+		{"Prompts", "", false},
+		{"tbl1", "Renders", false},
+		{"Prompts", "Prompt", true},
+		{"Prompts", "Missing", true},
+		{"Other", "Image", true},
+	}
+	for _, tt := range tests {
+		err := client(tt.table, tt.field).CheckAttachmentField(context.Background())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s/%s: error = %v, wantErr %v", tt.table, tt.field, err, tt.wantErr)
+		}
+	}
+
+	// Without the schema scope, or if the schema can't be read, the field
+	// can't be checked
+	defer func(b []time.Duration) { backoff = b }(backoff)
+	backoff = []time.Duration{time.Millisecond}
+	for _, status = range []int{http.StatusForbidden, http.StatusNotFound, http.StatusBadGateway} {
+		if err := client("Prompts", "Missing").CheckAttachmentField(context.Background()); err != nil {
+			t.Errorf("unexpected error without schema (status=%d): %v", status, err)
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	defer func(b []time.Duration) { backoff = b }(backoff)
+	backoff = []time.Duration{time.Millisecond}
+	schema := `{"tables":[{"id":"tbl1","name":"Prompts","fields":[{"name":"Image","type":"multipleAttachments"}]}]}`
+	// The first request is rate limited and retried
+	statuses := []int{http.StatusTooManyRequests, http.StatusOK}
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(schema)), Request: r}, nil
+	})
+	m := metricstest.NewRecorder()
+	c := NewClient("key", "base", "Prompts", WithHTTPClient(&http.Client{Transport: transport}), WithMetrics(m))
+	if err := c.CheckAttachmentField(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Counter(metrics.AirtableRequests); got != 2 {
+		t.Errorf("got %v requests, want 2", got)
+	}
+	if got := m.Counter(metrics.AirtableRateLimited); got != 1 {
+		t.Errorf("got %v rate limited requests, want 1", got)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	tests := []struct {
+		size int
+		want string
+	}{
+		{0, ""},
+		{-1, ""},
+		{50, "50"},
+		{100, "100"},
+		{500, "100"},
+	}
+	for _, tt := range tests {
+		var got string
+		transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			got = r.URL.Query().Get("pageSize")
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"records":[]}`)), Request: r}, nil
+		})
+		c := NewClient("key", "base", "table", WithHTTPClient(&http.Client{Transport: transport}), WithPageSize(tt.size))
+		if _, err := c.GetPrompts(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("page size %d: got pageSize=%q, want %q", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	if c := NewClient("key", "base", "table"); c.httpClient.Timeout != DefaultTimeout {
+		t.Errorf("unexpected default timeout %s", c.httpClient.Timeout)
+	}
+
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) { return nil, nil })
+	hc := &http.Client{Transport: transport}
+	c := NewClient("key", "base", "table", WithHTTPClient(hc), WithTimeout(2*time.Minute))
+	if c.httpClient.Timeout != 2*time.Minute || c.httpClient.Transport == nil {
+		t.Errorf("unexpected client %+v", c.httpClient)
+	}
+	if hc.Timeout != 0 {
+		t.Error("the given client was modified")
+	}
+
+	// The timeout applies whatever the order of the options
+	c = NewClient("key", "base", "table", WithTimeout(2*time.Minute), WithHTTPClient(hc))
+	if c.httpClient.Timeout != 2*time.Minute || c.httpClient.Transport == nil {
+		t.Errorf("timeout not applied to the client set after it: %+v", c.httpClient)
+	}
+	c = NewClient("key", "base", "table", WithHTTPClient(nil))
+	if c.httpClient == nil || c.httpClient.Timeout != DefaultTimeout {
+		t.Errorf("unexpected client %+v for a nil client", c.httpClient)
+	}
+	c = NewClient("key", "base", "table", WithHTTPClient(nil), WithTimeout(time.Minute))
+	if c.httpClient.Timeout != time.Minute {
+		t.Errorf("unexpected timeout %s for a nil client", c.httpClient.Timeout)
+	}
+}
+
+func TestUploadCancelledDuringBackoff(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+
+	// The upload is cancelled while waiting to retry, after the body was
+	// rewound
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		r.Body.Close()
+		cancel()
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	})
+	c := NewClient("key", "base", "table", WithHTTPClient(&http.Client{Transport: transport}))
+	if err := c.uploadAttachment(ctx, "rec1", buf.Bytes()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled upload, got %v", err)
+	}
+
+	// The encoding goroutines of the bodies exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("got %d goroutines after the upload, want %d", n, before)
+	}
+}
+
+func TestUploadBody(t *testing.T) {
+	data := bytes.Repeat([]byte("image data"), 1000)
+	body, length, err := uploadBody("image/png", "generated_image.png", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The body can be read several times for retries
+	for range 2 {
+		r := body()
+		payload, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(payload)) != length {
+			t.Errorf("length = %d, want %d", len(payload), length)
+		}
+		var got struct {
+			ContentType string `json:"contentType"`
+			File        string `json:"file"`
+			Filename    string `json:"filename"`
+		}
+		if err := json.Unmarshal(payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ContentType != "image/png" || got.Filename != "generated_image.png" {
+			t.Errorf("unexpected fields %+v", got)
+		}
+		if got.File != base64.StdEncoding.EncodeToString(data) {
+			t.Error("file doesn't match the encoded image")
+		}
+	}
+}
+
+func TestShrinkImage(t *testing.T) {
+	// Noise doesn't compress, so lowering the quality isn't enough and the
+	// image has to be downscaled below the maximum dimension too
+	img := image.NewNRGBA(image.Rect(0, 0, 900, 600))
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.IntN(256))
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	const limit = 100 << 10
+	data, desc, err := shrinkImage(buf.Bytes(), limit, 0, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > limit {
+		t.Errorf("shrunk to %d bytes, want at most %d", len(data), limit)
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sides are rounded down at each step
+	if format != "jpeg" || cfg.Width >= 800 || abs(cfg.Height-cfg.Width*2/3) > 1 {
+		t.Errorf("got %s %dx%d, want a JPEG downscaled below 800 wide keeping the aspect ratio", format, cfg.Width, cfg.Height)
+	}
+	if !strings.HasPrefix(desc, "png 900x600") {
+		t.Errorf("unexpected description %q", desc)
+	}
+
+	if _, _, err := shrinkImage(buf.Bytes(), 1<<10, 0, 0); err == nil {
+		t.Error("expected error when the image can't fit")
+	}
+
+	// A thin image keeps at least a pixel on its short side
+	buf.Reset()
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 2000, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err = shrinkImage(buf.Bytes(), limit, 0, 100); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, _, err = image.DecodeConfig(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 100 || cfg.Height != 1 {
+		t.Errorf("got %dx%d, want 100x1", cfg.Width, cfg.Height)
+	}
+}
+
+func abs(n int) int {
+	return max(n, -n)
+}
+
+func TestProcessPromptAttachmentsResume(t *testing.T) {
+	generated := map[string]bool{}
+	failUpdates := true
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		respond := func(status int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Request: r}, nil
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v0/meta/"):
+			return respond(http.StatusForbidden, "{}")
+		case r.Method == "GET":
+			var records []Record
+			for _, id := range []string{"rec1", "rec2"} {
+				records = append(records, Record{ID: id, Fields: map[string]interface{}{"Prompt": "a cat", "Generated": generated[id]}})
+			}
+			data, _ := json.Marshal(ListResponse{Records: records})
+			return respond(http.StatusOK, string(data))
+		}
+		var update UpdateResponse
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			t.Error(err)
+		}
+		if _, ok := update.Records[0].Fields["Generated"]; !ok {
+			// Attachment update
+			return respond(http.StatusOK, "{}")
+		}
+		if failUpdates {
+			return respond(http.StatusUnprocessableEntity, "{}")
+		}
+		for _, r := range update.Records {
+			generated[r.ID] = true
+		}
+		return respond(http.StatusOK, "{}")
+	})
+	path := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+	c := NewClient("key", "base", "table", WithHTTPClient(&http.Client{Transport: transport}), WithCheckpoint(path))
+	generations := 0
+	process := func(recordID, prompt string) ([]Attachment, error) {
+		generations++
+		return []Attachment{{URL: "https://cdn.leonardo.ai/" + recordID + ".jpg"}}, nil
+	}
+
+	// The records are processed but can't be marked as generated
+	if _, err := c.ProcessPromptAttachments(context.Background(), process); err != nil {
+		t.Fatal(err)
+	}
+	if generations != 2 || len(generated) != 0 {
+		t.Fatalf("got %d generations and %v, want 2 unmarked generations", generations, generated)
+	}
+
+	// The next run marks them from the checkpoint without generating them
+	failUpdates = false
+	result, err := c.ProcessPromptAttachments(context.Background(), process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generations != 2 || !generated["rec1"] || !generated["rec2"] || result.Processed != 2 {
+		t.Fatalf("got %d generations and %v, want the records marked from the checkpoint", generations, generated)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("checkpoint wasn't removed")
+	}
+
+	// A record unmarked to regenerate it is generated again
+	generated["rec1"] = false
+	if _, err := c.ProcessPromptAttachments(context.Background(), process); err != nil {
+		t.Fatal(err)
+	}
+	if generations != 3 {
+		t.Errorf("got %d generations, want the unmarked record generated again", generations)
+	}
+}
+
+func TestProcessPromptAttachmentsDropsGenerated(t *testing.T) {
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		respond := func(status int, body string) (*http.Response, error) {
+			return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Request: r}, nil
+		}
+		if strings.HasPrefix(r.URL.Path, "/v0/meta/") {
+			return respond(http.StatusForbidden, "{}")
+		}
+		if r.Method != "GET" {
+			t.Errorf("unexpected %s request", r.Method)
+		}
+		data, _ := json.Marshal(ListResponse{Records: []Record{{ID: "rec1", Fields: map[string]interface{}{"Prompt": "a cat", "Generated": true}}}})
+		return respond(http.StatusOK, string(data))
+	})
+	// The record was marked as generated after it was checkpointed, by a run
+	// interrupted before dropping it
+	path := filepath.Join(t.TempDir(), "checkpoint.jsonl")
+	cp, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.add("rec1", nil); err != nil {
+		t.Fatal(err)
+	}
+	cp.close()
+
+	c := NewClient("key", "base", "table", WithHTTPClient(&http.Client{Transport: transport}), WithCheckpoint(path))
+	result, err := c.ProcessPromptAttachments(context.Background(), func(recordID, prompt string) ([]Attachment, error) {
+		t.Errorf("record %s was generated again", recordID)
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("got %d skipped records, want 1", result.Skipped)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("checkpoint wasn't removed")
+	}
+}
+
+func TestProcessPromptAttachmentsBlocked(t *testing.T) {
+	for _, field := range []string{"", "Blocked"} {
+		fields := map[string]map[string]interface{}{}
+		transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			respond := func(status int, body string) (*http.Response, error) {
+				return &http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Request: r}, nil
+			}
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/v0/meta/"):
+				return respond(http.StatusForbidden, "{}")
+			case r.Method == "GET":
+				return respond(http.StatusOK, `{"records":[{"id":"rec1","fields":{"Prompt":"a blocked cat"}},{"id":"rec2","fields":{"Prompt":"a cat"}}]}`)
+			}
+			var update UpdateResponse
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				t.Error(err)
+			}
+			for _, record := range update.Records {
+				if fields[record.ID] == nil {
+					fields[record.ID] = map[string]interface{}{}
+				}
+				maps.Copy(fields[record.ID], record.Fields)
+			}
+			return respond(http.StatusOK, "{}")
+		})
+		c := NewClient("key", "base", "table", WithHTTPClient(&http.Client{Transport: transport}), WithBlockedField(field))
+		result, err := c.ProcessPromptAttachments(context.Background(), func(recordID, prompt string) ([]Attachment, error) {
+			if strings.Contains(prompt, "blocked") {
+				return nil, fmt.Errorf("%w: contains a blocked term", ErrBlocked)
+			}
+			return []Attachment{{URL: "https://cdn.leonardo.ai/" + recordID + ".jpg"}}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Blocked != 1 || result.Processed != 1 || result.Failed != 0 {
+			t.Errorf("field %q: got %+v, want a blocked and a processed record", field, result)
+		}
+		if r := result.Records[0]; r.RecordID != "rec1" || r.Status != StatusBlocked || !errors.Is(r.Err, ErrBlocked) {
+			t.Errorf("field %q: unexpected result %+v", field, r)
+		}
+		// The blocked record is never marked as generated, so it's checked
+		// in the blocked field to be excluded by the filter
+		if _, ok := fields["rec1"]["Generated"]; ok {
+			t.Errorf("field %q: blocked record marked as generated", field)
+		}
+		if blocked := fields["rec1"]["Blocked"] == true; blocked != (field != "") {
+			t.Errorf("field %q: got rec1 fields %v", field, fields["rec1"])
+		}
+		if fields["rec2"]["Generated"] != true || fields["rec2"]["Blocked"] != nil {
+			t.Errorf("field %q: got rec2 fields %v, want it marked as generated only", field, fields["rec2"])
+		}
+	}
+}
+
+func TestCheckpointDrop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batch.jsonl")
+	cp, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"rec1", "rec2"} {
+		if err := cp.add(id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cp.drop([]string{"rec1", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.add("rec3", nil); err != nil {
+		t.Fatal(err)
+	}
+	cp.close()
+
+	cp, err = openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.close()
+	if _, ok := cp.lookup("rec1"); ok {
+		t.Error("dropped record is still checkpointed")
+	}
+	for _, id := range []string{"rec2", "rec3"} {
+		if _, ok := cp.lookup(id); !ok {
+			t.Errorf("record %s is missing", id)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints", "batch.jsonl")
+	cp, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cp.lookup("rec1"); ok {
+		t.Error("unexpected record in a new checkpoint")
+	}
+	if err := cp.add("rec1", []string{"hash"}); err != nil {
+		t.Fatal(err)
+	}
+	cp.close()
+
+	// Simulate a line truncated by a crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"rec2","has`)
+	f.Close()
+
+	cp, err = openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes, ok := cp.lookup("rec1"); !ok || len(hashes) != 1 || hashes[0] != "hash" {
+		t.Errorf("unexpected checkpoint of rec1: %v, %v", hashes, ok)
+	}
+	if _, ok := cp.lookup("rec2"); ok {
+		t.Error("truncated record shouldn't be checkpointed")
+	}
+	if err := cp.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("checkpoint wasn't removed")
+	}
+}
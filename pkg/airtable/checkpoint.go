@@ -0,0 +1,141 @@
+package airtable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint records the records processed by a batch, so a batch interrupted
+// before they are marked as generated doesn't process them again. The file
+// contains a JSON object per line with the record ID and image hashes. The
+// records are dropped once they're marked as generated, so a record unmarked
+// later to regenerate it isn't marked again from a stale entry.
+type checkpoint struct {
+	path string
+	done map[string][]string
+	file *os.File
+}
+
+type checkpointEntry struct {
+	ID     string   `json:"id"`
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+// openCheckpoint loads the records of the checkpoint file, if it exists, and
+// opens it to record the next ones.
+func openCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path, done: make(map[string][]string)}
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	default:
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry checkpointEntry
+			// A line truncated by a crash is ignored, its record is
+			// processed again
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.ID == "" {
+				continue
+			}
+			cp.done[entry.ID] = entry.Hashes
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	if cp.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+// lookup returns the hashes of the record if it was processed. A nil
+// checkpoint has no records.
+func (cp *checkpoint) lookup(recordID string) ([]string, bool) {
+	if cp == nil {
+		return nil, false
+	}
+	hashes, ok := cp.done[recordID]
+	return hashes, ok
+}
+
+// add records the processed record, syncing the file so it survives a crash.
+func (cp *checkpoint) add(recordID string, hashes []string) error {
+	line, err := json.Marshal(checkpointEntry{ID: recordID, Hashes: hashes})
+	if err != nil {
+		return err
+	}
+	if _, err := cp.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	cp.done[recordID] = hashes
+	return cp.file.Sync()
+}
+
+// drop removes the records from the checkpoint once they're marked as
+// generated, replacing the file with the remaining records.
+func (cp *checkpoint) drop(recordIDs []string) error {
+	n := len(cp.done)
+	for _, id := range recordIDs {
+		delete(cp.done, id)
+	}
+	if len(cp.done) == n {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for id, hashes := range cp.done {
+		line, err := json.Marshal(checkpointEntry{ID: id, Hashes: hashes})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := cp.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, cp.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace checkpoint: %w", err)
+	}
+	// The old file is kept open until the new one is, so the next records
+	// are always written somewhere
+	f, err := os.OpenFile(cp.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	old := cp.file
+	cp.file = f
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+	return nil
+}
+
+// empty reports whether every processed record was marked as generated.
+func (cp *checkpoint) empty() bool {
+	return len(cp.done) == 0
+}
+
+func (cp *checkpoint) close() error {
+	return cp.file.Close()
+}
+
+// remove deletes the checkpoint file.
+func (cp *checkpoint) remove() error {
+	cp.close()
+	return os.Remove(cp.path)
+}
@@ -0,0 +1,119 @@
+package airtable
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	// Decoders of the images that can be shrunk
+	_ "image/gif"
+	_ "image/png"
+)
+
+// DefaultJPEGQuality is the quality the oversized images are first
+// recompressed with.
+const DefaultJPEGQuality = 90
+
+// minJPEGQuality is the quality below which the images are downscaled rather
+// than compressed further.
+const minJPEGQuality = 60
+
+// minShrinkDimension is the size below which the images aren't downscaled
+// further, since they wouldn't be usable.
+const minShrinkDimension = 256
+
+// WithShrinkImages sets whether the images larger than MaxAttachmentSize are
+// recompressed as JPEG and downscaled until they fit, instead of failing the
+// upload. The quality is lowered from quality, DefaultJPEGQuality if 0, and
+// the images are first scaled down to maxDimension pixels on their longest
+// side, if set.
+func WithShrinkImages(shrink bool, quality, maxDimension int) Option {
+	return func(c *Client) {
+		c.shrinkImages = shrink
+		c.jpegQuality = quality
+		c.maxDimension = maxDimension
+	}
+}
+
+// shrinkImage recompresses the image as JPEG, lowering the quality and then
+// the size until it's at most limit bytes. It returns the new image and a
+// description of the transformation.
+func shrinkImage(data []byte, limit, quality, maxDimension int) ([]byte, string, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image to shrink it: %w", err)
+	}
+	if quality <= 0 || quality > 100 {
+		quality = DefaultJPEGQuality
+	}
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if longest := max(width, height); maxDimension > 0 && longest > maxDimension {
+		width, height = scale(width, maxDimension, longest), scale(height, maxDimension, longest)
+	}
+
+	for {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, downscale(src, width, height), &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", fmt.Errorf("failed to encode shrunk image: %w", err)
+		}
+		if buf.Len() <= limit {
+			desc := fmt.Sprintf("%s %dx%d (%.2fMB) to JPEG %dx%d quality %d (%.2fMB)",
+				format, b.Dx(), b.Dy(), megabytes(len(data)), width, height, quality, megabytes(buf.Len()))
+			return buf.Bytes(), desc, nil
+		}
+		switch {
+		case quality > minJPEGQuality:
+			quality = max(quality-10, minJPEGQuality)
+		case min(width, height)*3/4 >= minShrinkDimension:
+			width, height = scale(width, 3, 4), scale(height, 3, 4)
+		default:
+			return nil, "", fmt.Errorf("image still exceeds %.2fMB at %dx%d quality %d", megabytes(limit), width, height, quality)
+		}
+	}
+}
+
+// scale returns the side scaled by num/den, keeping at least a pixel so a thin
+// image can still be encoded.
+func scale(side, num, den int) int {
+	return max(side*num/den, 1)
+}
+
+// downscale returns the image scaled to width x height by averaging the
+// source pixels, composited on a white background since JPEG has no alpha.
+func downscale(src image.Image, width, height int) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/height, y0+1)
+		for x := range width {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(b.Min.X+(x+1)*b.Dx()/width, x0+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// The colors are premultiplied, so the background shows through
+			// the transparent part
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + white) >> 8),
+				G: uint8((g/n + white) >> 8),
+				B: uint8((bl/n + white) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+func megabytes(n int) float64 {
+	return float64(n) / 1024 / 1024
+}
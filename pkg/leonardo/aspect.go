@@ -0,0 +1,51 @@
+package leonardo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits for the image dimensions accepted by Leonardo.
+const (
+	minDimension = 32
+	maxDimension = 1536
+)
+
+// DimensionsForAspect returns the width and height for an aspect ratio such
+// as "16:9", where target is the length of the longer side. Both dimensions
+// are rounded to the nearest multiple of 8.
+func DimensionsForAspect(ratio string, target int) (int, int, error) {
+	parts := strings.Split(ratio, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("leonardo: invalid aspect ratio %q, expected W:H", ratio)
+	}
+	rw, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || rw <= 0 {
+		return 0, 0, fmt.Errorf("leonardo: invalid aspect ratio %q", ratio)
+	}
+	rh, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || rh <= 0 {
+		return 0, 0, fmt.Errorf("leonardo: invalid aspect ratio %q", ratio)
+	}
+	if target < minDimension || target > maxDimension {
+		return 0, 0, fmt.Errorf("leonardo: invalid target size %d, must be between %d and %d", target, minDimension, maxDimension)
+	}
+
+	w, h := target, target
+	if rw > rh {
+		h = target * rh / rw
+	} else {
+		w = target * rw / rh
+	}
+	w, h = snap(w), snap(h)
+	if w < minDimension || h < minDimension {
+		return 0, 0, fmt.Errorf("leonardo: aspect ratio %q is too extreme for size %d", ratio, target)
+	}
+	return w, h, nil
+}
+
+// snap rounds the dimension to the nearest multiple of 8 within the limits.
+func snap(v int) int {
+	return min((v+4)/8*8, maxDimension)
+}
@@ -0,0 +1,63 @@
+package leonardo
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// blockedTermStatus is the status of the ContentBlockedError returned for the
+// prompts containing a blocked term.
+const blockedTermStatus = "blocked-term"
+
+// blocklist matches the prompts containing one of the blocked terms, ignoring
+// the case. A term only matches whole words, so "cat" doesn't match "catalog".
+type blocklist struct {
+	terms    []string
+	patterns []*regexp.Regexp
+}
+
+func newBlocklist(terms []string) *blocklist {
+	b := &blocklist{}
+	for _, term := range terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		// Word boundaries only apply next to word characters, so terms
+		// such as "#tag" still match. \b is ASCII only, so the boundaries
+		// are spelled out to support accented terms.
+		expr := regexp.QuoteMeta(term)
+		if first, _ := utf8.DecodeRuneInString(term); isWordRune(first) {
+			expr = `(?:^|[^\p{L}\p{N}_])` + expr
+		}
+		if last, _ := utf8.DecodeLastRuneInString(term); isWordRune(last) {
+			expr += `(?:$|[^\p{L}\p{N}_])`
+		}
+		b.terms = append(b.terms, term)
+		b.patterns = append(b.patterns, regexp.MustCompile("(?i)"+expr))
+	}
+	return b
+}
+
+// check returns a *ContentBlockedError if the prompt contains a blocked term.
+func (b *blocklist) check(prompt string) error {
+	if b == nil {
+		return nil
+	}
+	for i, re := range b.patterns {
+		if re.MatchString(prompt) {
+			return &ContentBlockedError{
+				Status: blockedTermStatus,
+				Reason: fmt.Sprintf("prompt contains the blocked term %q", b.terms[i]),
+			}
+		}
+	}
+	return nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,63 @@
+package leonardo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Init image types accepted by ControlNet.
+const (
+	InitImageUploaded  = "UPLOADED"
+	InitImageGenerated = "GENERATED"
+)
+
+// Range of the ControlNet strength.
+const (
+	minControlNetStrength = 0.0
+	maxControlNetStrength = 2.0
+)
+
+// ControlNet guides the generation with an image, e.g. to copy its pose,
+// depth or edges.
+type ControlNet struct {
+	// InitImageID is the ID of the guiding image.
+	InitImageID string
+	// InitImageType is InitImageUploaded or InitImageGenerated, defaults to
+	// InitImageUploaded.
+	InitImageType string
+	// PreprocessorID selects the guidance type (pose, depth, edge...).
+	PreprocessorID int
+	// Strength is the weight of the guidance, between 0 and 2.
+	Strength float64
+}
+
+func (cn *ControlNet) validate() error {
+	if cn.InitImageID == "" {
+		return errors.New("leonardo: controlnet init image id is empty")
+	}
+	switch cn.InitImageType {
+	case "", InitImageUploaded, InitImageGenerated:
+	default:
+		return fmt.Errorf("leonardo: invalid controlnet init image type %q", cn.InitImageType)
+	}
+	if cn.PreprocessorID <= 0 {
+		return fmt.Errorf("leonardo: invalid controlnet preprocessor id %d", cn.PreprocessorID)
+	}
+	if cn.Strength <= minControlNetStrength || cn.Strength > maxControlNetStrength {
+		return fmt.Errorf("leonardo: invalid controlnet strength %v, must be greater than %v and at most %v", cn.Strength, minControlNetStrength, maxControlNetStrength)
+	}
+	return nil
+}
+
+func (cn *ControlNet) variables() map[string]any {
+	initImageType := cn.InitImageType
+	if initImageType == "" {
+		initImageType = InitImageUploaded
+	}
+	return map[string]any{
+		"initImageId":    cn.InitImageID,
+		"initImageType":  initImageType,
+		"preprocessorId": cn.PreprocessorID,
+		"weight":         cn.Strength,
+	}
+}
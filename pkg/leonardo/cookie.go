@@ -2,9 +2,12 @@ package leonardo
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type sessionData struct {
@@ -41,6 +44,48 @@ func NewMemCookieStore(cookie string) CookieStore {
 	return &memCookieStore{cookie: cookie}
 }
 
+// NewMemCookieStoreChecked is like NewMemCookieStore but returns an error if
+// the cookie is malformed or doesn't contain a token.
+func NewMemCookieStoreChecked(cookie string) (CookieStore, error) {
+	cookie = strings.TrimSpace(cookie)
+	if cookie == "" {
+		return nil, errors.New("leonardo: cookie is empty")
+	}
+
+	// If cookie is a JSON string, extract the access token
+	if strings.HasPrefix(cookie, "{") {
+		var session sessionData
+		if err := json.Unmarshal([]byte(cookie), &session); err != nil {
+			return nil, fmt.Errorf("leonardo: couldn't parse session json: %w", err)
+		}
+		if session.AccessToken == "" {
+			return nil, errors.New("leonardo: session json has no accessToken")
+		}
+		cookie = session.AccessToken
+	}
+
+	// Check the name=value pairs are well formed
+	if strings.Contains(cookie, "=") {
+		var hasValue bool
+		for _, pair := range strings.Split(cookie, ";") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			name, value, ok := strings.Cut(pair, "=")
+			if !ok || name == "" {
+				return nil, fmt.Errorf("leonardo: invalid cookie pair %q", pair)
+			}
+			hasValue = hasValue || value != ""
+		}
+		if !hasValue {
+			return nil, errors.New("leonardo: cookie has no values")
+		}
+	}
+
+	return NewMemCookieStore(cookie), nil
+}
+
 func (s *memCookieStore) GetCookie(ctx context.Context) (string, error) {
 	if s.cookie == "" {
 		return "", fmt.Errorf("cookie is not set")
@@ -52,3 +97,111 @@ func (s *memCookieStore) SetCookie(ctx context.Context, cookie string) error {
 	s.cookie = cookie
 	return nil
 }
+
+// Cookie formats reported by InspectCookie.
+const (
+	CookieFormatSession = "session JSON"
+	CookieFormatHeader  = "cookie header"
+	CookieFormatToken   = "token"
+)
+
+// CookieInfo describes a cookie without contacting Leonardo. The fields that
+// can't be read from the cookie are left empty.
+type CookieInfo struct {
+	Format    string
+	Email     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Expired reports whether the cookie expiry is known and before now.
+func (i *CookieInfo) Expired(now time.Time) bool {
+	return !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt)
+}
+
+// InspectCookie validates the cookie like NewMemCookieStoreChecked and
+// returns what it tells about the session: the email and the token issue and
+// expiry times from the session JSON or the token claims, if it's a JWT.
+func InspectCookie(cookie string) (*CookieInfo, error) {
+	if _, err := NewMemCookieStoreChecked(cookie); err != nil {
+		return nil, err
+	}
+	cookie = strings.TrimSpace(cookie)
+
+	info := &CookieInfo{Format: CookieFormatToken}
+	token := cookie
+	switch {
+	case strings.HasPrefix(cookie, "{"):
+		var session sessionData
+		if err := json.Unmarshal([]byte(cookie), &session); err != nil {
+			return nil, fmt.Errorf("leonardo: couldn't parse session json: %w", err)
+		}
+		info.Format = CookieFormatSession
+		info.Email = session.User.Email
+		info.IssuedAt = unixTime(int64(session.AccessTokenIssuedAt))
+		info.ExpiresAt = sessionExpiry(session.AccessTokenExpiry, session.Expires)
+		token = session.AccessToken
+	case strings.Contains(cookie, "="):
+		info.Format = CookieFormatHeader
+		token = ""
+		for _, pair := range strings.Split(cookie, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if name == "__Secure-next-auth.session-token" {
+				token = value
+			}
+		}
+	}
+
+	// Fill the missing fields from the token claims, session tokens may be
+	// encrypted in which case they can't be read
+	var tokenClaims struct {
+		Email string `json:"email"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	if parts := strings.Split(token, "."); len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+			_ = json.Unmarshal(payload, &tokenClaims)
+		}
+	}
+	if info.Email == "" {
+		info.Email = tokenClaims.Email
+	}
+	if info.IssuedAt.IsZero() {
+		info.IssuedAt = unixTime(tokenClaims.Iat)
+	}
+	if info.ExpiresAt.IsZero() {
+		info.ExpiresAt = unixTime(tokenClaims.Exp)
+	}
+	return info, nil
+}
+
+// sessionExpiry returns the expiry of the session data, from the Unix time of
+// the access token expiry, in seconds or milliseconds, or else from the RFC
+// 3339 expires date. It's zero if neither is set.
+func sessionExpiry(expiry int, expires string) time.Time {
+	if t := accessTokenExpiry(expiry); !t.IsZero() {
+		return t
+	}
+	if t, err := time.Parse(time.RFC3339, expires); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// accessTokenExpiry converts the Unix time of the access token expiry, in
+// seconds or milliseconds, zero meaning unknown.
+func accessTokenExpiry(expiry int) time.Time {
+	if expiry > 1e12 {
+		return time.UnixMilli(int64(expiry))
+	}
+	return unixTime(int64(expiry))
+}
+
+// unixTime converts the seconds to a time, zero meaning unknown.
+func unixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
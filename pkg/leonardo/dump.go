@@ -0,0 +1,82 @@
+package leonardo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// redactedHeaders are the headers replaced in the dumps, since they contain
+// the session credentials.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// dump is a GraphQL request and its response, as written to the dump
+// directory.
+type dump struct {
+	Time            time.Time       `json:"time"`
+	Operation       string          `json:"operation"`
+	Method          string          `json:"method"`
+	URL             string          `json:"url"`
+	RequestHeaders  http.Header     `json:"request_headers"`
+	Request         *graphqlRequest `json:"request"`
+	Status          int             `json:"status"`
+	ResponseHeaders http.Header     `json:"response_headers"`
+	Response        json.RawMessage `json:"response"`
+}
+
+// unsafeFilename matches the characters replaced in the dump filenames.
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// dumpResponse writes the GraphQL request and its response to the dump
+// directory. Failures are only logged, so they don't fail the request.
+func (c *Client) dumpResponse(in *graphqlRequest, req *http.Request, resp *http.Response, body []byte) {
+	now := time.Now()
+	d := dump{
+		Time:            now.UTC(),
+		Operation:       in.OperationName,
+		Method:          req.Method,
+		URL:             req.URL.String(),
+		RequestHeaders:  redact(req.Header),
+		Request:         in,
+		Status:          resp.StatusCode,
+		ResponseHeaders: redact(resp.Header),
+		Response:        json.RawMessage(body),
+	}
+	// Keep the invalid JSON responses, such as HTML error pages, as strings
+	if !json.Valid(body) {
+		d.Response, _ = json.Marshal(string(body))
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		c.info("leonardo: couldn't marshal response dump: %v", err)
+		return
+	}
+
+	op := unsafeFilename.ReplaceAllString(in.OperationName, "_")
+	if op == "" {
+		op = "unnamed"
+	}
+	name := fmt.Sprintf("%s_%04d_%s.json", now.Format("20060102_150405.000"), c.dumpSeq.Add(1), op)
+	if err := os.MkdirAll(c.dumpDir, 0755); err != nil {
+		c.info("leonardo: couldn't create response dump directory: %v", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(c.dumpDir, name), data, 0600); err != nil {
+		c.info("leonardo: couldn't write response dump: %v", err)
+	}
+}
+
+// redact returns a copy of the headers with the credentials replaced.
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if _, ok := h[k]; ok {
+			h[k] = []string{"REDACTED"}
+		}
+	}
+	return h
+}
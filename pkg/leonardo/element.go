@@ -0,0 +1,38 @@
+package leonardo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Range of the Element weight.
+const (
+	minElementWeight = -1.0
+	maxElementWeight = 2.0
+)
+
+// Element applies a trained style or concept (LoRA) to the generation.
+type Element struct {
+	// AkUUID is the ID of the element.
+	AkUUID string `json:"akUUID"`
+	// Weight is the influence of the element, between -1 and 2. Negative
+	// weights steer the generation away from it.
+	Weight float64 `json:"weight"`
+}
+
+func (e *Element) validate() error {
+	if e.AkUUID == "" {
+		return errors.New("leonardo: element akUUID is empty")
+	}
+	if e.Weight < minElementWeight || e.Weight > maxElementWeight || e.Weight == 0 {
+		return fmt.Errorf("leonardo: invalid element weight %v, must be between %v and %v and not zero", e.Weight, minElementWeight, maxElementWeight)
+	}
+	return nil
+}
+
+func (e *Element) variables() map[string]any {
+	return map[string]any{
+		"akUUID": e.AkUUID,
+		"weight": e.Weight,
+	}
+}
@@ -0,0 +1,64 @@
+package leonardo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the client, to be checked with errors.Is.
+var (
+	// ErrAuth is returned when the client can't authenticate with the
+	// session cookie. Retrying won't help until the cookie is renewed.
+	ErrAuth = errors.New("leonardo: authentication failed")
+	// ErrRateLimited is returned when Leonardo keeps rejecting requests with
+	// status 429 after the retries.
+	ErrRateLimited = errors.New("leonardo: rate limited")
+	// ErrGenerationFailed is returned when a generation or variation finishes
+	// with a failed status.
+	ErrGenerationFailed = errors.New("leonardo: generation failed")
+	// ErrTimeout is returned when a generation doesn't complete within the
+	// configured GenerationTimeout. The error is a *TimeoutError.
+	ErrTimeout = errors.New("leonardo: generation timed out")
+	// ErrContentBlocked is returned when Leonardo's content moderation
+	// rejects the prompt or the generation. Retrying the same prompt won't
+	// help. The error is a *ContentBlockedError.
+	ErrContentBlocked = errors.New("leonardo: content blocked by moderation")
+	// ErrInsufficientCredits is returned when the account doesn't have
+	// enough credits left for the request. Retrying won't help until the
+	// credits are renewed.
+	ErrInsufficientCredits = errors.New("leonardo: insufficient credits")
+)
+
+// ContentBlockedError is returned when the prompt is rejected by the content
+// moderation, either when the generation is created or with a moderation
+// status while it's polled.
+type ContentBlockedError struct {
+	// GenerationID is empty if the generation wasn't created.
+	GenerationID string
+	// Status is the generation status or the error code.
+	Status string
+	// Reason is the explanation sent by Leonardo, if any.
+	Reason string
+}
+
+func (e *ContentBlockedError) Error() string {
+	msg := fmt.Sprintf("leonardo: prompt blocked by moderation with status: %s", e.Status)
+	if e.GenerationID != "" {
+		msg = fmt.Sprintf("leonardo: generation %s blocked by moderation with status: %s", e.GenerationID, e.Status)
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+func (e *ContentBlockedError) Is(target error) bool {
+	return target == ErrContentBlocked
+}
+
+// blockedStatuses are the generation statuses set by the content moderation.
+var blockedStatuses = map[string]bool{
+	"BLOCKED":   true,
+	"MODERATED": true,
+	"REJECTED":  true,
+}
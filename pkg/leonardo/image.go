@@ -2,8 +2,14 @@ package leonardo
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"automation/leoverse/pkg/metrics"
 )
 
 const generateImageQuery = `mutation CreateSDGenerationJob($arg1: SDGenerationInput!) {
@@ -13,6 +19,14 @@ const generateImageQuery = `mutation CreateSDGenerationJob($arg1: SDGenerationIn
 	}
 }`
 
+// Limits for the generation input accepted by Leonardo.
+const (
+	minSteps        = 10
+	maxSteps        = 60
+	maxPromptLength = 1500
+	maxNumImages    = 8
+)
+
 type GenerateImageInput struct {
 	Prompt         string
 	NegativePrompt string
@@ -32,65 +46,429 @@ type GenerateImageInput struct {
 	Contrast       float64
 	EnhancePrompt  bool
 	Weighting      float64
+	Alchemy        bool
+	// Seed makes the generation reproducible, zero picks a random seed.
+	Seed int64
+	// ControlNets guide the generation with existing images.
+	ControlNets []ControlNet
+	// Elements apply trained styles or concepts (LoRAs) with a weight.
+	Elements []Element
+	// Tiling generates seamless textures.
+	Tiling bool
+
+	// PhotoRealVersion is the PhotoReal version, defaults to "v2".
+	// PhotoRealStrength is only supported by v1 and must be 0.45, 0.5 or
+	// 0.55.
+	PhotoRealVersion  string
+	PhotoRealStrength float64
+
+	// PromptMagicStrength and PromptMagicVersion tune the prompt magic
+	// enabled by EnhancePrompt. The strength must be between 0.1 and 1 and
+	// the version "v2" or "v3"; zero values leave them to Leonardo. They are
+	// ignored without EnhancePrompt.
+	PromptMagicStrength float64
+	PromptMagicVersion  string
 }
 
+// Limits of the prompt magic settings.
+const (
+	minPromptMagicStrength = 0.1
+	maxPromptMagicStrength = 1
+)
+
+// promptMagicVersions are the accepted prompt magic versions.
+var promptMagicVersions = []string{"v2", "v3"}
+
+// Defaults for PhotoReal generations.
+const (
+	defaultPhotoRealVersion = "v2"
+	defaultPhotoRealStyle   = "CINEMATIC"
+)
+
+// Validate checks the input before it's sent to Leonardo. Leading and
+// trailing whitespace in the prompt is ignored.
+func (in *GenerateImageInput) Validate() error {
+	prompt := strings.TrimSpace(in.Prompt)
+	if prompt == "" {
+		return errors.New("leonardo: prompt is empty")
+	}
+	if n := utf8.RuneCountInString(prompt); n > maxPromptLength {
+		return fmt.Errorf("leonardo: prompt is too long (%d characters), maximum is %d", n, maxPromptLength)
+	}
+	if in.Steps < minSteps || in.Steps > maxSteps {
+		return fmt.Errorf("leonardo: invalid steps %d, must be between %d and %d", in.Steps, minSteps, maxSteps)
+	}
+	if in.NumImages < 0 || in.NumImages > maxNumImages {
+		return fmt.Errorf("leonardo: invalid number of images %d, maximum is %d", in.NumImages, maxNumImages)
+	}
+	for i := range in.ControlNets {
+		if err := in.ControlNets[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range in.Elements {
+		if err := in.Elements[i].validate(); err != nil {
+			return err
+		}
+	}
+	if err := in.validateContrast(); err != nil {
+		return err
+	}
+	if err := in.validatePromptMagic(); err != nil {
+		return err
+	}
+	return in.validatePhotoReal()
+}
+
+// validatePromptMagic checks the prompt magic settings, which are only sent
+// with EnhancePrompt and ignored otherwise.
+func (in *GenerateImageInput) validatePromptMagic() error {
+	if !in.EnhancePrompt {
+		return nil
+	}
+	if s := in.PromptMagicStrength; s != 0 && (s < minPromptMagicStrength || s > maxPromptMagicStrength) {
+		return fmt.Errorf("leonardo: invalid prompt magic strength %v, must be between %v and %v", s, minPromptMagicStrength, maxPromptMagicStrength)
+	}
+	if v := in.PromptMagicVersion; v != "" && !slices.Contains(promptMagicVersions, v) {
+		return fmt.Errorf("leonardo: invalid prompt magic version %q, must be one of %v", v, promptMagicVersions)
+	}
+	return nil
+}
+
+// contrastValues are the contrast values accepted by the SD versions that
+// take the contrast as an enum instead of a ratio.
+var contrastValues = map[string][]float64{
+	"PHOENIX":  {1, 1.3, 1.8, 2.5, 3, 3.5, 4, 4.5},
+	"FLUX_DEV": {1, 1.3, 1.8, 2.5, 3, 3.5, 4, 4.5},
+}
+
+// minPhoenixAlchemyContrast is the minimum contrast of Phoenix generations
+// with Alchemy.
+const minPhoenixAlchemyContrast = 2.5
+
+// validateContrast checks the contrast against the values allowed by the SD
+// version. Zero leaves the contrast to Leonardo.
+func (in *GenerateImageInput) validateContrast() error {
+	allowed, ok := contrastValues[in.SDVersion]
+	if !ok || in.Contrast == 0 {
+		return nil
+	}
+	if !slices.Contains(allowed, in.Contrast) {
+		return fmt.Errorf("leonardo: invalid contrast %v for %s, must be one of %v", in.Contrast, in.SDVersion, allowed)
+	}
+	if in.SDVersion == "PHOENIX" && in.Alchemy && in.Contrast < minPhoenixAlchemyContrast {
+		return fmt.Errorf("leonardo: contrast %v is too low for phoenix with alchemy, minimum is %v", in.Contrast, minPhoenixAlchemyContrast)
+	}
+	return nil
+}
+
+// validatePhotoReal checks the PhotoReal fields, which replace the model
+// selection.
+func (in *GenerateImageInput) validatePhotoReal() error {
+	if !in.PhotoReal {
+		if in.PhotoRealVersion != "" || in.PhotoRealStrength != 0 {
+			return errors.New("leonardo: photoreal version and strength require photoreal")
+		}
+		return nil
+	}
+	if in.ModelID != "" {
+		return errors.New("leonardo: photoreal can't be used with a model ID")
+	}
+	if in.SDVersion != "" {
+		return errors.New("leonardo: photoreal can't be used with an SD version")
+	}
+	switch in.photoRealVersion() {
+	case "v1":
+		switch in.PhotoRealStrength {
+		case 0, 0.45, 0.5, 0.55:
+		default:
+			return fmt.Errorf("leonardo: invalid photoreal strength %v, must be 0.45, 0.5 or 0.55", in.PhotoRealStrength)
+		}
+	case "v2":
+		if in.PhotoRealStrength != 0 {
+			return errors.New("leonardo: photoreal strength is only supported by photoreal v1")
+		}
+	default:
+		return fmt.Errorf("leonardo: invalid photoreal version %q", in.PhotoRealVersion)
+	}
+	return nil
+}
+
+func (in *GenerateImageInput) photoRealVersion() string {
+	if in.PhotoRealVersion == "" {
+		return defaultPhotoRealVersion
+	}
+	return in.PhotoRealVersion
+}
+
+// GenerateImage generates images and returns their URLs.
 func (c *Client) GenerateImage(ctx context.Context, input *GenerateImageInput) ([]string, error) {
+	images, err := c.GenerateImageDetailed(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	var urls []string
+	for _, img := range images {
+		urls = append(urls, img.URL)
+	}
+	return urls, nil
+}
+
+// GenerateImageDetailed generates images and returns them with their
+// metadata, such as the NSFW flag.
+func (c *Client) GenerateImageDetailed(ctx context.Context, input *GenerateImageInput) ([]GeneratedImage, error) {
 	// Authenticate if necessary
 	if err := c.Auth(ctx); err != nil {
 		return nil, err
 	}
 
-	c.log("Creating generation job...")
-	generationID, err := c.createGeneration(ctx, input)
+	c.info("Creating generation job...")
+	generationID, err := c.CreateGeneration(ctx, input)
 	if err != nil {
 		return nil, err
 	}
-	c.log("Generation job created with ID: %s", generationID)
+	c.info("Generation job created with ID: %s", generationID)
 
 	// Wait for generation to complete
-	statusReq := &graphqlRequest{
-		OperationName: "GetAIGenerationFeedStatuses",
-		Variables: map[string]any{
-			"where": map[string]any{
-				"status": map[string]any{
-					"_in": []string{"COMPLETE", "FAILED"},
-				},
-				"id": map[string]any{
-					"_in": []string{generationID},
-				},
-			},
-		},
-		Query: statusQuery,
+	c.info("Waiting for generation to complete...")
+	images, err := c.WaitForGeneration(ctx, generationID)
+	if err != nil {
+		return nil, err
 	}
 
-	c.log("Waiting for generation to complete...")
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(5 * time.Second):
+	c.info("Found %d generated images", len(images))
+	return images, nil
+}
+
+// CreateGeneration submits a generation job and returns its ID without waiting
+// for it to complete.
+func (c *Client) CreateGeneration(ctx context.Context, input *GenerateImageInput) (string, error) {
+	if err := input.Validate(); err != nil {
+		return "", err
+	}
+	if err := c.blocklist.check(input.Prompt); err != nil {
+		return "", err
+	}
+
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return "", err
+	}
+
+	c.log("leonardo: generating with %d steps", input.Steps)
+
+	// Prepare variables
+	arg := map[string]any{
+		"prompt":              strings.TrimSpace(input.Prompt),
+		"negative_prompt":     input.NegativePrompt,
+		"modelId":             input.ModelID,
+		"width":               input.Width,
+		"height":              input.Height,
+		"num_images":          input.NumImages,
+		"guidance_scale":      input.GuidanceScale,
+		"presetStyle":         input.PresetStyle,
+		"scheduler":           input.Scheduler,
+		"sd_version":          input.SDVersion,
+		"num_inference_steps": input.Steps,
+		"public":              input.Public,
+		"highContrast":        input.HighContrast,
+		"photoReal":           input.PhotoReal,
+		"nsfw":                input.NSFW,
+		"contrast":            input.Contrast,
+		"enhancePrompt":       input.EnhancePrompt,
+		"weighting":           input.Weighting,
+	}
+	if input.Alchemy {
+		arg["alchemy"] = true
+	}
+	if input.Seed != 0 {
+		arg["seed"] = input.Seed
+	}
+	if input.Tiling {
+		arg["tiling"] = true
+	}
+	if input.EnhancePrompt && input.PromptMagicStrength != 0 {
+		arg["promptMagicStrength"] = input.PromptMagicStrength
+	}
+	if input.EnhancePrompt && input.PromptMagicVersion != "" {
+		arg["promptMagicVersion"] = input.PromptMagicVersion
+	}
+	if len(input.ControlNets) > 0 {
+		controlNets := make([]map[string]any, len(input.ControlNets))
+		for i := range input.ControlNets {
+			controlNets[i] = input.ControlNets[i].variables()
+		}
+		arg["controlnets"] = controlNets
+	}
+	if len(input.Elements) > 0 {
+		elements := make([]map[string]any, len(input.Elements))
+		for i := range input.Elements {
+			elements[i] = input.Elements[i].variables()
+		}
+		arg["elements"] = elements
+	}
+	if input.PhotoReal {
+		// PhotoReal picks its own model and requires alchemy
+		delete(arg, "modelId")
+		delete(arg, "sd_version")
+		arg["alchemy"] = true
+		arg["photoRealVersion"] = input.photoRealVersion()
+		if input.PhotoRealStrength != 0 {
+			arg["photoRealStrength"] = input.PhotoRealStrength
+		}
+		if input.PresetStyle == "" {
+			arg["presetStyle"] = defaultPhotoRealStyle
+		}
+	}
+	vars := map[string]any{"arg1": arg}
+
+	// Create GraphQL request
+	req := &graphqlRequest{
+		OperationName: "CreateSDGenerationJob",
+		Variables:     vars,
+		Query:         generateImageQuery,
+	}
+
+	// Execute request
+	var resp createGenerationResponse
+	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && errors.Is(apiErr, ErrContentBlocked) {
+			return "", &ContentBlockedError{Status: apiErr.Code, Reason: apiErr.Error()}
 		}
+		return "", fmt.Errorf("leonardo: couldn't create generation: %w", err)
+	}
+
+	generationID := resp.Data.SDGenerationJob.GenerationID
+	if generationID == "" {
+		c.log("leonardo: received empty generation ID from response: %+v", resp)
+		return "", fmt.Errorf("leonardo: empty generation ID received")
+	}
+
+	c.log("leonardo: generation ID received: %s", generationID)
+	c.metrics.IncCounter(metrics.GenerationsStarted, 1)
+	return generationID, nil
+}
 
-		var statusResp statusResponse
-		if _, err := c.do(ctx, "POST", "graphql", statusReq, &statusResp); err != nil {
-			return nil, fmt.Errorf("couldn't get status: %w", err)
+// WaitForGeneration waits for the generation to complete and returns its
+// images.
+func (c *Client) WaitForGeneration(ctx context.Context, generationID string) ([]GeneratedImage, error) {
+	start := time.Now()
+	gen, err := c.pollGeneration(ctx, "Generation", generationID, c.generationTimeout)
+	if err != nil {
+		// The generations abandoned by the caller didn't fail
+		if ctx.Err() == nil {
+			c.metrics.IncCounter(metrics.GenerationsFailed, 1)
+		} else if c.cancelOnExit {
+			c.cancelAbandoned(ctx, generationID)
 		}
+		return nil, err
+	}
+	c.metrics.IncCounter(metrics.GenerationsSucceeded, 1)
+	c.metrics.ObserveHistogram(metrics.GenerationDuration, time.Since(start).Seconds())
+	return gen.toGeneration().Images, nil
+}
+
+// cancelTimeout bounds the cancellation of an abandoned generation, which runs
+// after the parent context is done.
+const cancelTimeout = 30 * time.Second
+
+// cancelAbandoned cancels the generation after the parent context was
+// cancelled, so the remote job stops consuming credits.
+func (c *Client) cancelAbandoned(ctx context.Context, generationID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cancelTimeout)
+	defer cancel()
+	if err := c.CancelGeneration(ctx, generationID); err != nil {
+		c.info("leonardo: couldn't cancel generation %s: %v", generationID, err)
+		return
+	}
+	c.info("leonardo: cancelled generation %s", generationID)
+}
 
-		if len(statusResp.Data.Generations) > 0 {
-			status := statusResp.Data.Generations[0]
-			c.log("Generation status: %s", status.Status)
+// pollGeneration polls the feed until the generation completes, fails or the
+// timeout is reached. The kind names the generation in the progress reports.
+func (c *Client) pollGeneration(ctx context.Context, kind, generationID string, timeout time.Duration) (*generation, error) {
+	pollCtx, cancel := generationContext(ctx, timeout)
+	defer cancel()
+	wait := c.newPollBackoff()
+	start := time.Now()
+	for {
+		select {
+		case <-pollCtx.Done():
+			return nil, pollError(ctx, pollCtx, generationID, timeout)
+		case <-time.After(wait.next()):
+		}
 
-			if status.Status == "FAILED" {
-				return nil, fmt.Errorf("generation failed")
+		gen, err := c.getGeneration(pollCtx, generationID)
+		if err != nil {
+			if pollCtx.Err() != nil {
+				return nil, pollError(ctx, pollCtx, generationID, timeout)
 			}
-			if status.Status == "COMPLETE" {
-				break
+			return nil, err
+		}
+		if gen == nil {
+			continue
+		}
+
+		c.progress(kind, generationID, gen.Status, start)
+		wait.observe(gen.Status)
+		switch gen.Status {
+		case "PENDING", "IN_PROGRESS":
+			continue
+		case "COMPLETE":
+			return gen, nil
+		default:
+			if blockedStatuses[gen.Status] {
+				return nil, &ContentBlockedError{GenerationID: generationID, Status: gen.Status}
 			}
+			return nil, fmt.Errorf("%w with status: %s", ErrGenerationFailed, gen.Status)
 		}
 	}
+}
+
+// progress reports the status of the generation or variation to the
+// OnProgress callback, or logs it if there's no callback.
+func (c *Client) progress(kind, id, status string, start time.Time) {
+	if c.onProgress == nil {
+		c.info("%s status: %s", kind, status)
+		return
+	}
+	c.onProgress(id, status, time.Since(start))
+}
+
+// GetGeneration returns the current status and images of the generation
+// without waiting for it to complete.
+func (c *Client) GetGeneration(ctx context.Context, generationID string) (*Generation, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
 
-	// Get generated images
-	feedReq := &graphqlRequest{
+	gen, err := c.getGeneration(ctx, generationID)
+	if err != nil {
+		return nil, err
+	}
+	if gen == nil {
+		return nil, fmt.Errorf("leonardo: generation %s not found", generationID)
+	}
+	g := gen.toGeneration()
+	return &g, nil
+}
+
+// findGeneration authenticates if necessary and fetches the generation from
+// the feed, returning nil if it isn't found.
+func (c *Client) findGeneration(ctx context.Context, generationID string) (*generation, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
+	return c.getGeneration(ctx, generationID)
+}
+
+// getGeneration fetches the generation from the feed, returning nil if it
+// isn't found.
+func (c *Client) getGeneration(ctx context.Context, generationID string) (*generation, error) {
+	req := &graphqlRequest{
 		OperationName: "GetAIGenerationFeed",
 		Variables: map[string]any{
 			"where": map[string]any{
@@ -102,132 +480,297 @@ func (c *Client) GenerateImage(ctx context.Context, input *GenerateImageInput) (
 		Query: feedQuery,
 	}
 
-	c.log("Fetching generated images...")
-	var feedResp feedResponse
-	if _, err := c.do(ctx, "POST", "graphql", feedReq, &feedResp); err != nil {
-		return nil, fmt.Errorf("couldn't get feed: %w", err)
+	var resp feedResponse
+	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
+		return nil, fmt.Errorf("leonardo: couldn't get generation: %w", err)
+	}
+	if len(resp.Data.Generations) == 0 {
+		return nil, nil
 	}
+	return &resp.Data.Generations[0], nil
+}
 
-	var urls []string
-	if len(feedResp.Data.Generations) > 0 {
-		gen := feedResp.Data.Generations[0]
-		for _, img := range gen.GeneratedImages {
-			urls = append(urls, img.URL)
-		}
+// pollBackoff computes the delay between generation status checks. The delay
+// grows while the status stays the same and is reset when it changes.
+type pollBackoff struct {
+	min, max time.Duration
+	current  time.Duration
+	status   string
+}
+
+func (c *Client) newPollBackoff() *pollBackoff {
+	return &pollBackoff{
+		min:     c.pollInterval,
+		max:     c.maxPollInterval,
+		current: c.pollInterval,
 	}
+}
 
-	c.log("Found %d generated images", len(urls))
-	return urls, nil
+// next returns the delay before the next check and increases the following
+// one.
+func (b *pollBackoff) next() time.Duration {
+	d := b.current
+	b.current = min(b.current*3/2, b.max)
+	return d
 }
 
-// Move existing GenerateImage implementation to this function
-func (c *Client) createGeneration(ctx context.Context, input *GenerateImageInput) (string, error) {
-    // Authenticate if necessary
-    if err := c.Auth(ctx); err != nil {
-        return "", err
-    }
-
-    // Prepare variables
-    vars := map[string]any{
-        "arg1": map[string]any{
-            "prompt":              input.Prompt,
-            "negative_prompt":     input.NegativePrompt,
-            "modelId":             input.ModelID,
-            "width":               input.Width,
-            "height":              input.Height,
-            "num_images":          input.NumImages,
-            "guidance_scale":      input.GuidanceScale,
-            "presetStyle":         input.PresetStyle,
-            "scheduler":           input.Scheduler,
-            "sd_version":          input.SDVersion,
-            "num_inference_steps": input.Steps,
-            "public":              input.Public,
-            "highContrast":        input.HighContrast,
-            "photoReal":           input.PhotoReal,
-            "nsfw":                input.NSFW,
-            "contrast":            input.Contrast,
-            "enhancePrompt":       input.EnhancePrompt,
-            "weighting":           input.Weighting,
-        },
-    }
-
-    // Create GraphQL request
-    req := &graphqlRequest{
-        OperationName: "CreateSDGenerationJob",
-        Variables:     vars,
-        Query:         generateImageQuery,
-    }
-
-    // Execute request
-    var resp createGenerationResponse
-    if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
-        return "", fmt.Errorf("leonardo: couldn't create generation: %w", err)
-    }
-
-    generationID := resp.Data.SDGenerationJob.GenerationID
-    if generationID == "" {
-        c.log("leonardo: received empty generation ID from response: %+v", resp)
-        return "", fmt.Errorf("leonardo: empty generation ID received")
-    }
-
-    c.log("leonardo: generation ID received: %s", generationID)
-    return generationID, nil
+// observe resets the delay if the status changed.
+func (b *pollBackoff) observe(status string) {
+	if status != b.status {
+		b.status = status
+		b.current = b.min
+	}
 }
 
-func (c *Client) WaitForGeneration(ctx context.Context, generationID string) ([]GeneratedImage, error) {
-	req := &graphqlRequest{
-		OperationName: "GetAIGenerationFeed",
-		Variables: map[string]any{
-			"where": map[string]any{
-				"id": map[string]any{
-					"_eq": generationID,
-				},
-			},
+// TimeoutError is returned when a generation doesn't complete within the
+// configured GenerationTimeout.
+type TimeoutError struct {
+	GenerationID string
+	Timeout      time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("leonardo: generation %s timed out after %s", e.GenerationID, e.Timeout)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// generationContext bounds the context with the generation timeout, zero
+// meaning no timeout.
+func generationContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// pollError returns the error for a finished polling context, distinguishing
+// the generation timeout from the parent context being done.
+func pollError(ctx, pollCtx context.Context, generationID string, timeout time.Duration) error {
+	if ctx.Err() == nil && errors.Is(pollCtx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{GenerationID: generationID, Timeout: timeout}
+	}
+	return ctx.Err()
+}
+
+type GeneratedImage struct {
+	ID           string  `json:"id"`
+	URL          string  `json:"url"`
+	NSFW         bool    `json:"nsfw"`
+	Seed         int64   `json:"seed"`
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	LikeCount    int     `json:"likeCount"`
+	MotionMP4URL *string `json:"motionMP4URL,omitempty"`
+	MotionGIFURL *string `json:"motionGIFURL,omitempty"`
+	Typename     string  `json:"__typename"`
+}
+
+// Generation is a generation job and its images.
+type Generation struct {
+	ID        string           `json:"id"`
+	Prompt    string           `json:"prompt"`
+	Status    string           `json:"status"`
+	CreatedAt string           `json:"createdAt"`
+	ModelID   string           `json:"modelId,omitempty"`
+	Images    []GeneratedImage `json:"images"`
+}
+
+func (g *generation) toGeneration() Generation {
+	images := make([]GeneratedImage, len(g.GeneratedImages))
+	for i, img := range g.GeneratedImages {
+		images[i] = GeneratedImage{
+			ID:           img.ID,
+			URL:          img.URL,
+			NSFW:         img.Nsfw,
+			Seed:         g.Seed,
+			Width:        g.ImageWidth,
+			Height:       g.ImageHeight,
+			LikeCount:    img.LikeCount,
+			MotionMP4URL: img.MotionMP4URL,
+			MotionGIFURL: img.MotionGIFURL,
+			Typename:     img.Typename,
+		}
+	}
+	// The model is null for generations without a fine-tuned model
+	modelID, _ := g.ModelId.(string)
+	return Generation{
+		ID:        g.ID,
+		Prompt:    g.Prompt,
+		Status:    g.Status,
+		CreatedAt: g.CreatedAt,
+		ModelID:   modelID,
+		Images:    images,
+	}
+}
+
+// userFeedWhere returns the feed filter matching the user's own generations.
+func userFeedWhere(userID string) map[string]any {
+	return map[string]any{
+		"userId": map[string]any{
+			"_eq": userID,
 		},
-		Query: feedQuery,
+		"teamId": map[string]any{
+			"_is_null": true,
+		},
+		"canvasRequest": map[string]any{
+			"_eq": false,
+		},
+		"universalUpscaler": map[string]any{
+			"_is_null": true,
+		},
+		"isStoryboard": map[string]any{
+			"_eq": false,
+		},
+	}
+}
+
+// ListGenerations returns the user's past generations, most recent first.
+func (c *Client) ListGenerations(ctx context.Context, limit, offset int) ([]Generation, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("leonardo: invalid limit %d", limit)
+	}
+	return c.ListGenerationsFiltered(ctx, GenerationFilter{}, limit, offset)
+}
+
+// feedPageSize is the maximum number of generations fetched per request.
+const feedPageSize = 50
+
+// feedTimeFormat is the format of the generation creation times, in UTC.
+const feedTimeFormat = "2006-01-02T15:04:05.000"
+
+// GenerationFilter selects the generations returned by
+// ListGenerationsFiltered. The zero value matches every generation.
+type GenerationFilter struct {
+	// Since and Until restrict the creation time to [Since, Until). A zero
+	// time leaves that end of the range open.
+	Since time.Time
+	Until time.Time
+	// Status only keeps the generations with the status, such as
+	// "COMPLETE" or "FAILED".
+	Status string
+}
+
+// where adds the conditions of the filter to the feed conditions.
+func (f *GenerationFilter) where(where map[string]any) map[string]any {
+	createdAt := map[string]any{}
+	if !f.Since.IsZero() {
+		createdAt["_gte"] = f.Since.UTC().Format(feedTimeFormat)
 	}
+	if !f.Until.IsZero() {
+		createdAt["_lt"] = f.Until.UTC().Format(feedTimeFormat)
+	}
+	if len(createdAt) > 0 {
+		where["createdAt"] = createdAt
+	}
+	if f.Status != "" {
+		where["status"] = map[string]any{"_eq": strings.ToUpper(f.Status)}
+	}
+	return where
+}
 
+// ListGenerationsFiltered returns the user's past generations matching the
+// filter, most recent first. The feed is fetched page by page until limit
+// generations are found; a zero limit returns every matching generation.
+func (c *Client) ListGenerationsFiltered(ctx context.Context, filter GenerationFilter, limit, offset int) ([]Generation, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
+
+	if limit < 0 {
+		return nil, fmt.Errorf("leonardo: invalid limit %d", limit)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("leonardo: invalid offset %d", offset)
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Until.After(filter.Since) {
+		return nil, fmt.Errorf("leonardo: invalid date range, %s is not before %s", filter.Since.Format(time.DateOnly), filter.Until.Format(time.DateOnly))
+	}
+	userID := c.userID
+	if userID == "" {
+		return nil, errors.New("leonardo: empty user id")
+	}
+	where := filter.where(userFeedWhere(userID))
+
+	var gens []Generation
 	for {
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(5 * time.Second):
+		pageSize := feedPageSize
+		if limit > 0 {
+			pageSize = min(pageSize, limit-len(gens))
+		}
+		req := &graphqlRequest{
+			OperationName: "GetAIGenerationFeed",
+			Variables: map[string]any{
+				"where":  where,
+				"offset": offset,
+				"limit":  pageSize,
+			},
+			Query: feedQuery,
 		}
-
 		var resp feedResponse
 		if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
-			return nil, fmt.Errorf("couldn't get generation status: %w", err)
+			return nil, fmt.Errorf("leonardo: couldn't get feed: %w", err)
 		}
-
-		if len(resp.Data.Generations) == 0 {
-			continue
+		for i := range resp.Data.Generations {
+			gens = append(gens, resp.Data.Generations[i].toGeneration())
 		}
 
-		gen := resp.Data.Generations[0]
-		switch gen.Status {
-		case "PENDING", "IN_PROGRESS":
-			fmt.Printf("Generation status: %s\n", gen.Status)
-			continue
-		case "COMPLETE":
-			images := make([]GeneratedImage, len(gen.GeneratedImages))
-			for i, img := range gen.GeneratedImages {
-				images[i] = GeneratedImage{
-					ID:       img.ID,
-					URL:      img.URL,
-					NSFW:     img.Nsfw,
-					Typename: img.Typename,
-				}
-			}
-			return images, nil
-		default:
-			return nil, fmt.Errorf("generation failed with status: %s", gen.Status)
+		// A short page is the last one
+		n := len(resp.Data.Generations)
+		if n < pageSize || (limit > 0 && len(gens) >= limit) {
+			return gens, nil
 		}
+		offset += n
 	}
 }
 
-type GeneratedImage struct {
-	ID       string `json:"id"`
-	URL      string `json:"url"`
-	NSFW     bool   `json:"nsfw"`
-	Typename string `json:"__typename"`
+// CancelGeneration stops an in-flight generation. Leonardo has no dedicated
+// cancellation, so the pending generation is deleted.
+func (c *Client) CancelGeneration(ctx context.Context, generationID string) error {
+	if err := c.DeleteGeneration(ctx, generationID); err != nil {
+		return fmt.Errorf("leonardo: couldn't cancel generation %s: %w", generationID, err)
+	}
+	return nil
+}
+
+type deleteGenerationResponse struct {
+	Data struct {
+		DeleteGenerationsByPK *struct {
+			ID       string `json:"id"`
+			Typename string `json:"__typename"`
+		} `json:"delete_generations_by_pk"`
+	} `json:"data"`
+}
+
+// DeleteGeneration deletes the generation and its images.
+func (c *Client) DeleteGeneration(ctx context.Context, generationID string) error {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return err
+	}
+
+	if generationID == "" {
+		return errors.New("leonardo: empty generation id")
+	}
+
+	req := &graphqlRequest{
+		OperationName: "DeleteGeneration",
+		Variables: map[string]any{
+			"id": generationID,
+		},
+		Query: deleteGenerationQuery,
+	}
+
+	var resp deleteGenerationResponse
+	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
+		return fmt.Errorf("leonardo: couldn't delete generation: %w", err)
+	}
+	deleted := resp.Data.DeleteGenerationsByPK
+	if deleted == nil || deleted.ID != generationID {
+		return fmt.Errorf("leonardo: generation %s wasn't deleted", generationID)
+	}
+	return nil
 }
@@ -16,26 +16,118 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"automation/leoverse/pkg/metrics"
 	"automation/leoverse/pkg/ratelimit"
 
 	"automation/leoverse/pkg/session"
 )
 
+// DefaultUserAgent is the browser User-Agent sent when Config.UserAgent is not
+// set.
+const DefaultUserAgent = `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36`
+
+// Default hosts of the Leonardo API and web app.
+const (
+	DefaultBaseURL = "https://api.leonardo.ai/v1"
+	DefaultAppURL  = "https://app.leonardo.ai"
+)
+
 type Client struct {
-	client          *http.Client
-	debug           bool
-	ratelimit       ratelimit.Lock
-	token           string
-	tokenExpiration time.Time
-	cookieStore     CookieStore
-	userID          string
+	client            *http.Client
+	baseURL           string
+	appURL            string
+	userAgent         string
+	extraHeaders      map[string]string
+	debug             bool
+	verbose           bool
+	ratelimit         ratelimit.Lock
+	pollInterval      time.Duration
+	maxPollInterval   time.Duration
+	generationTimeout time.Duration
+	motionTimeout     time.Duration
+	cancelOnExit      bool
+	metrics           metrics.Metrics
+	requestTimeout    time.Duration
+	onProgress        func(generationID, status string, elapsed time.Duration)
+	dumpDir           string
+	blocklist         *blocklist
+	dumpSeq           atomic.Int64
+	token             string
+	tokenExpiration   time.Time
+	tokenExpiry       time.Time
+	cookieStore       CookieStore
+	userID            string
+
+	// lifecycle guards started, which is set by Start and cleared by Stop
+	lifecycle sync.Mutex
+	started   bool
+
+	// auth serializes the authentications and tokenMu guards the token, so
+	// the client can be shared by concurrent generations
+	auth    sync.Mutex
+	tokenMu sync.RWMutex
 }
 
 type Config struct {
-	Wait        time.Duration
-	Debug       bool
+	// Wait is the minimum delay between consecutive requests to Leonardo.
+	// It's applied by the rate limiter with a random jitter of ±15%.
+	Wait time.Duration
+	// PollInterval is the initial delay between generation status checks.
+	// The delay grows while the status doesn't change, up to
+	// MaxPollInterval, and is reset when the status changes.
+	PollInterval time.Duration
+	// MaxPollInterval caps the delay between generation status checks.
+	MaxPollInterval time.Duration
+	// GenerationTimeout aborts waiting for a generation after the given
+	// duration. Zero means no timeout other than the context.
+	GenerationTimeout time.Duration
+	// MotionTimeout aborts waiting for a motion generation, which takes
+	// much longer than an image. Zero means the larger of GenerationTimeout
+	// and DefaultMotionTimeout, or no timeout if GenerationTimeout is zero.
+	MotionTimeout time.Duration
+	// CancelOnExit cancels the remote generation when the context is
+	// cancelled while waiting for it, instead of letting it complete and
+	// consume credits.
+	CancelOnExit bool
+	// Metrics receives the generation and rate limit metrics. Defaults to
+	// metrics.Nop.
+	Metrics metrics.Metrics
+	// RequestTimeout limits the duration of each request to Leonardo,
+	// excluding the rate limit wait. Defaults to one minute.
+	RequestTimeout time.Duration
+	// OnProgress is called with the status of the generation after each poll.
+	// If nil, the status is logged in verbose mode.
+	OnProgress func(generationID, status string, elapsed time.Duration)
+	// UserAgent overrides DefaultUserAgent.
+	UserAgent string
+	// ExtraHeaders are added to every request to Leonardo, overriding the
+	// default ones. They aren't sent with the uploads to S3.
+	ExtraHeaders map[string]string
+	// Debug logs the raw requests and responses, Verbose only logs the
+	// progress: authentication, generation jobs, polling and retries. Debug
+	// implies Verbose.
+	Debug   bool
+	Verbose bool
+	// BlockedTerms are rejected locally with a *ContentBlockedError when a
+	// prompt contains one of them, ignoring the case and matching whole
+	// words, before the generation is sent.
+	BlockedTerms []string
+	// ResponseDumpDir, if set, is the directory each GraphQL request and
+	// its response are written to, with the credentials redacted, to
+	// investigate or report misbehaving generations.
+	ResponseDumpDir string
+	// BaseURL is the base of the API requests, such as the GraphQL endpoint.
+	// Defaults to DefaultBaseURL.
+	BaseURL string
+	// AppURL is the base of the authentication requests, and the URL the
+	// session cookie is set for. Defaults to DefaultAppURL.
+	AppURL string
+	// Client is used for every request, including authentication. Its
+	// Transport can be replaced to serve canned responses in tests.
 	Client      *http.Client
 	CookieStore CookieStore
 }
@@ -81,24 +173,78 @@ func New(cfg *Config) *Client {
 			Timeout: 2 * time.Minute,
 		}
 	}
+	pollInterval := cfg.PollInterval
+	if pollInterval == 0 {
+		pollInterval = 2 * time.Second
+	}
+	maxPollInterval := cfg.MaxPollInterval
+	if maxPollInterval == 0 {
+		maxPollInterval = 15 * time.Second
+	}
+	if maxPollInterval < pollInterval {
+		maxPollInterval = pollInterval
+	}
+	requestTimeout := cfg.RequestTimeout
+	if requestTimeout == 0 {
+		requestTimeout = time.Minute
+	}
+	motionTimeout := cfg.MotionTimeout
+	if motionTimeout == 0 && cfg.GenerationTimeout > 0 {
+		motionTimeout = max(cfg.GenerationTimeout, DefaultMotionTimeout)
+	}
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	baseURL := cfg.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	appURL := cfg.AppURL
+	if appURL == "" {
+		appURL = DefaultAppURL
+	}
 	return &Client{
-		client:      client,
-		ratelimit:   ratelimit.New(wait),
-		debug:       cfg.Debug,
-		cookieStore: cfg.CookieStore,
+		client:            client,
+		baseURL:           strings.TrimSuffix(baseURL, "/"),
+		appURL:            strings.TrimSuffix(appURL, "/"),
+		userAgent:         userAgent,
+		extraHeaders:      cfg.ExtraHeaders,
+		ratelimit:         ratelimit.New(wait),
+		pollInterval:      pollInterval,
+		maxPollInterval:   maxPollInterval,
+		generationTimeout: cfg.GenerationTimeout,
+		motionTimeout:     motionTimeout,
+		cancelOnExit:      cfg.CancelOnExit,
+		metrics:           metrics.OrNop(cfg.Metrics),
+		requestTimeout:    requestTimeout,
+		onProgress:        cfg.OnProgress,
+		dumpDir:           cfg.ResponseDumpDir,
+		blocklist:         newBlocklist(cfg.BlockedTerms),
+		debug:             cfg.Debug,
+		verbose:           cfg.Verbose || cfg.Debug,
+		cookieStore:       cfg.CookieStore,
 	}
 }
 
+// Start loads the cookie and authenticates the client. Calling Start on a
+// started client is a no-op.
 func (c *Client) Start(ctx context.Context) error {
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if c.started {
+		return nil
+	}
+
 	// Get cookie
 	cookie, err := c.cookieStore.GetCookie(ctx)
 	if err != nil {
 		return err
 	}
 	if cookie == "" {
-		return fmt.Errorf("leonardo: cookie is empty")
+		return fmt.Errorf("%w: cookie is empty", ErrAuth)
 	}
-	if err := session.SetCookies(c.client, "https://app.leonardo.ai", cookie, nil); err != nil {
+	if err := session.SetCookies(c.client, c.appURL, cookie, nil); err != nil {
 		return fmt.Errorf("leonardo: couldn't set cookie: %w", err)
 	}
 
@@ -108,7 +254,7 @@ func (c *Client) Start(ctx context.Context) error {
 	}
 
 	// Get user id
-	cls, err := toClaims(c.token)
+	cls, err := toClaims(c.accessToken())
 	if err != nil {
 		return err
 	}
@@ -117,29 +263,180 @@ func (c *Client) Start(ctx context.Context) error {
 		return err
 	}
 	if userID != cls.HasuraClaims.XHasuraUserID {
-		return fmt.Errorf("leonardo: user id mismatch: %s != %s", userID, cls.HasuraClaims.XHasuraUserID)
+		return fmt.Errorf("%w: user id mismatch: %s != %s", ErrAuth, userID, cls.HasuraClaims.XHasuraUserID)
 	}
 	c.userID = userID
+	c.started = true
+	c.info("leonardo: authenticated as user %s", userID)
 
 	return nil
 }
 
+// Auth gets a new access token if the current one has expired.
 func (c *Client) Auth(ctx context.Context) error {
-	if c.token != "" && time.Now().Before(c.tokenExpiration) {
+	c.auth.Lock()
+	defer c.auth.Unlock()
+
+	c.tokenMu.RLock()
+	valid := c.token != "" && time.Now().Before(c.tokenExpiration)
+	c.tokenMu.RUnlock()
+	if valid {
 		return nil
 	}
-	token, expiration, err := c.session(ctx)
-	if err != nil {
+	return c.renewToken(ctx)
+}
+
+// refreshToken gets a new access token after the stale one was rejected,
+// even if it hasn't expired yet, and saves the refreshed session cookie to the
+// cookie store. It's a no-op if another request already replaced the stale
+// token.
+func (c *Client) refreshToken(ctx context.Context, stale string) error {
+	c.auth.Lock()
+	defer c.auth.Unlock()
+
+	if c.accessToken() != stale {
+		return nil
+	}
+	if err := c.renewToken(ctx); err != nil {
 		return err
 	}
+
+	// The session endpoint may rotate the session cookie
+	cookie, err := session.GetCookies(c.client, c.appURL)
+	if err != nil {
+		return fmt.Errorf("leonardo: couldn't get cookie: %w", err)
+	}
+	if err := c.cookieStore.SetCookie(ctx, cookie); err != nil {
+		return fmt.Errorf("leonardo: couldn't save cookie: %w", err)
+	}
+	return nil
+}
+
+// renewToken gets a new access token from the session endpoint, retrying
+// with backoff on network and server errors. Other failures, such as a
+// rejected cookie, are returned at once as ErrAuth. The caller must hold the
+// auth lock.
+func (c *Client) renewToken(ctx context.Context) error {
+	var token string
+	var expiration, sessionExpiration time.Time
+	for attempt := 0; ; attempt++ {
+		var err error
+		token, expiration, sessionExpiration, err = c.session(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		// Invalid credentials won't be accepted by retrying
+		if !isTransient(err) {
+			return fmt.Errorf("%w: %w", ErrAuth, err)
+		}
+		if attempt >= len(authBackoff) {
+			return fmt.Errorf("leonardo: couldn't authenticate after %d attempts: %w", attempt+1, err)
+		}
+		wait := authBackoff[attempt]
+		c.info("leonardo: authentication failed, retrying in %s: %v", wait, err)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
 	c.token = token
+	c.tokenExpiry = sessionExpiration
+	if expiration.IsZero() {
+		expiration = time.Now().Add(defaultTokenLifetime)
+	}
 	// Set token expiration to 90% of the actual expiration
 	c.tokenExpiration = time.Now().Add(expiration.Sub(time.Now().UTC()) * 90 / 100).UTC()
 	return nil
 }
 
+// defaultTokenLifetime is the assumed lifetime of the access tokens whose
+// expiry isn't known.
+const defaultTokenLifetime = 24 * time.Hour
+
+// TokenTimeToLive returns the time left before the access token expires,
+// negative if it has already expired, so long batches can refresh the session
+// before starting rather than failing midway. The expiry comes from the
+// session once the client is authenticated, and from the cookie of the cookie
+// store before. It's an error if the expiry isn't known.
+func (c *Client) TokenTimeToLive(ctx context.Context) (time.Duration, error) {
+	c.tokenMu.RLock()
+	expiry := c.tokenExpiry
+	c.tokenMu.RUnlock()
+	if expiry.IsZero() {
+		cookie, err := c.cookieStore.GetCookie(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("leonardo: couldn't get cookie: %w", err)
+		}
+		info, err := InspectCookie(cookie)
+		if err != nil {
+			return 0, err
+		}
+		expiry = info.ExpiresAt
+	}
+	if expiry.IsZero() {
+		return 0, errors.New("leonardo: token expiry is unknown")
+	}
+	return time.Until(expiry), nil
+}
+
+// accessToken returns the current access token.
+func (c *Client) accessToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+// Session is the authenticated session of a client.
+type Session struct {
+	UserID      string `json:"user_id"`
+	AccessToken string `json:"access_token"`
+	// ExpiresAt is zero if the session doesn't tell the token expiry
+	ExpiresAt time.Time `json:"expires_at"`
+	// Cookie is the session cookie, as refreshed by Leonardo
+	Cookie string `json:"cookie"`
+}
+
+// Session returns the current session, renewing the access token first if
+// it's close to expiring. The token and cookie grant access to the account.
+func (c *Client) Session(ctx context.Context) (*Session, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
+
+	cookie, err := session.GetCookies(c.client, c.appURL)
+	if err != nil {
+		return nil, fmt.Errorf("leonardo: couldn't get cookie: %w", err)
+	}
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return &Session{
+		UserID:      c.userID,
+		AccessToken: c.token,
+		ExpiresAt:   c.tokenExpiry.UTC(),
+		Cookie:      cookie,
+	}, nil
+}
+
+// Stop saves the session cookie to the cookie store. It's a no-op if the
+// client wasn't started, so it's safe to defer even if Start failed.
 func (c *Client) Stop(ctx context.Context) error {
-	cookie, err := session.GetCookies(c.client, "https://app.leonardo.ai")
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if !c.started {
+		return nil
+	}
+	c.started = false
+
+	cookie, err := session.GetCookies(c.client, c.appURL)
 	if err != nil {
 		return fmt.Errorf("leonardo: couldn't get cookie: %w", err)
 	}
@@ -200,17 +497,23 @@ func toClaims(token string) (*claims, error) {
 	return &c, nil
 }
 
-func (c *Client) session(ctx context.Context) (string, time.Time, error) {
+const sessionPath = "api/auth/session"
+
+// session returns the access token of the session with its expiry, zero if
+// unknown, and the expiry of the session, which falls back to the expires
+// date of the session when the token expiry isn't known.
+func (c *Client) session(ctx context.Context) (string, time.Time, time.Time, error) {
+	// The attempts are retried by renewToken
 	var resp sessionResponse
-	if _, err := c.do(ctx, "GET", "api/auth/session", nil, &resp); err != nil {
-		return "", time.Time{}, fmt.Errorf("leonardo: couldn't get session: %w", err)
+	if _, err := c.doAttempt(ctx, "GET", sessionPath, nil, &resp); err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("leonardo: couldn't get session: %w", err)
 	}
 
 	// Extract token from cookie if response token is empty
 	if resp.AccessToken == "" {
 		cookie, err := c.cookieStore.GetCookie(ctx)
 		if err != nil {
-			return "", time.Time{}, fmt.Errorf("leonardo: couldn't get cookie: %w", err)
+			return "", time.Time{}, time.Time{}, fmt.Errorf("leonardo: couldn't get cookie: %w", err)
 		}
 		parts := strings.Split(cookie, "=")
 		if len(parts) > 1 {
@@ -221,14 +524,9 @@ func (c *Client) session(ctx context.Context) (string, time.Time, error) {
 	}
 
 	if resp.AccessToken == "" {
-		return "", time.Time{}, errors.New("leonardo: empty access token")
+		return "", time.Time{}, time.Time{}, errors.New("leonardo: empty access token")
 	}
-
-	expiration := time.Unix(int64(resp.AccessTokenExpiry), 0)
-	if expiration.IsZero() {
-		expiration = time.Now().Add(24 * time.Hour)
-	}
-	return resp.AccessToken, expiration, nil
+	return resp.AccessToken, accessTokenExpiry(resp.AccessTokenExpiry), sessionExpiry(resp.AccessTokenExpiry, resp.Expires), nil
 }
 
 type graphqlRequest struct {
@@ -278,6 +576,22 @@ type userResponse struct {
 }
 
 func (c *Client) user(ctx context.Context, sub string) (string, error) {
+	u, err := c.userDetails(ctx, sub)
+	if err != nil {
+		return "", err
+	}
+	return u.ID, nil
+}
+
+// User describes the account the client is logged in with.
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Plan     string `json:"plan"`
+}
+
+func (c *Client) userDetails(ctx context.Context, sub string) (*User, error) {
 	req := &graphqlRequest{
 		OperationName: "GetUserDetails",
 		Variables: map[string]any{
@@ -288,15 +602,43 @@ func (c *Client) user(ctx context.Context, sub string) (string, error) {
 
 	var resp userResponse
 	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(resp.Data.Users) == 0 {
-		return "", errors.New("leonardo: no users found")
+		return nil, fmt.Errorf("%w: no users found", ErrAuth)
+	}
+	u := resp.Data.Users[0]
+	if u.ID == "" {
+		return nil, errors.New("leonardo: empty user id")
+	}
+	user := &User{ID: u.ID, Username: u.Username}
+	if len(u.UserDetails) > 0 {
+		user.Email = u.UserDetails[0].Auth0Email
+		user.Plan = u.UserDetails[0].Plan
 	}
-	if resp.Data.Users[0].ID == "" {
-		return "", errors.New("leonardo: empty user id")
+	return user, nil
+}
+
+// WhoAmI returns the account of the session cookie.
+func (c *Client) WhoAmI(ctx context.Context) (*User, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
+
+	cls, err := toClaims(c.accessToken())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuth, err)
 	}
-	return resp.Data.Users[0].ID, nil
+	return c.userDetails(ctx, cls.Sub)
+}
+
+// Ping checks that the session cookie is valid with a cheap authenticated
+// query, so long batches can fail fast. Invalid cookies return an error
+// matching ErrAuth.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.WhoAmI(ctx)
+	return err
 }
 
 type createUploadResponse struct {
@@ -523,173 +865,16 @@ type generation struct {
 	Typename              string        `json:"__typename"`
 }
 
-type statusResponse struct {
-	Data struct {
-		Generations []generationStatus `json:"generations"`
-	} `json:"data"`
-}
-
-type generationStatus struct {
-	ID       string `json:"id"`
-	Status   string `json:"status"`
-	Typename string `json:"__typename"`
-}
-
-func (c *Client) CreateMotion(ctx context.Context, id string, motionStrength int) (string, string, error) {
-	// Authenticate if necessary
-	if err := c.Auth(ctx); err != nil {
-		return "", "", err
-	}
-
-	if motionStrength == 0 {
-		motionStrength = 5
-	}
-	userID := c.userID
-	if userID == "" {
-		return "", "", errors.New("leonardo: empty user id")
-	}
-
-	createReq := &graphqlRequest{
-		OperationName: "CreatedGenerationJob",
-		Variables: map[string]any{
-			"arg1": map[string]any{
-				"imageId":        id,
-				"isPublic":       false,
-				"isInitImage":    true,
-				"isVariation":    false,
-				"motionStrength": motionStrength,
-			},
-		},
-		Query: createQuery,
-	}
-
-	var createResp createGenerationResponse
-	if _, err := c.do(ctx, "POST", "graphql", createReq, &createResp); err != nil {
-		return "", "", fmt.Errorf("leonardo: couldn't create motion: %w", err)
-	}
-	generationID := createResp.Data.SDGenerationJob.GenerationID
-	if generationID == "" {
-		return "", "", fmt.Errorf("leonardo: couldn't get generation id")
-	}
-
-	statusReq := &graphqlRequest{
-		OperationName: "GetAIGenerationFeedStatuses",
-		Variables: map[string]any{
-			"where": map[string]any{
-				"status": map[string]any{
-					"_in": []string{"COMPLETE", "FAILED"},
-				},
-				"id": map[string]any{
-					"_in": []string{generationID},
-				},
-			},
-		},
-		Query: statusQuery,
-	}
-
-	var last []byte
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("leonardo: context done, last response:", string(last))
-			return "", "", ctx.Err()
-		case <-time.After(5 * time.Second):
-		}
-		var statusResp statusResponse
-		b, err := c.do(ctx, "POST", "graphql", statusReq, &statusResp)
-		if err != nil {
-			return "", "", fmt.Errorf("leonardo: couldn't get status: %w", err)
-		}
-		last = b
-		if len(statusResp.Data.Generations) == 0 {
-			continue
-		}
-		s := statusResp.Data.Generations[0]
-		if s.Status != "COMPLETE" {
-			return "", "", fmt.Errorf("leonardo: status generation %s", s.Status)
-		}
-		break
-	}
-
-	feedReq := &graphqlRequest{
-		OperationName: "GetAIGenerationFeed",
-		Variables: map[string]any{
-			"where": map[string]any{
-				"userId": map[string]any{
-					"_eq": userID,
-				},
-				"teamId": map[string]any{
-					"_is_null": true,
-				},
-				"canvasRequest": map[string]any{
-					"_eq": false,
-				},
-				"universalUpscaler": map[string]any{
-					"_is_null": true,
-				},
-				"isStoryboard": map[string]any{
-					"_eq": false,
-				},
-			},
-			"offset": 0,
-			"limit":  10,
-		},
-		Query: feedQuery,
-	}
-
-	wait := 1 * time.Second
-	var gen *generation
-	for {
-		select {
-		case <-ctx.Done():
-			return "", "", fmt.Errorf("leonardo: pending generation: %w", ctx.Err())
-		case <-time.After(wait):
-		}
-		wait = 5 * time.Second
-		var feedResp feedResponse
-		if _, err := c.do(ctx, "POST", "graphql", feedReq, &feedResp); err != nil {
-			return "", "", fmt.Errorf("leonardo: couldn't get feed: %w", err)
-		}
-		if len(feedResp.Data.Generations) == 0 {
-			return "", "", errors.New("leonardo: no generations found")
-		}
-		var candidate *generation
-		for _, g := range feedResp.Data.Generations {
-			if g.ID != generationID {
-				continue
-			}
-			candidate = &g
-			break
-		}
-		if candidate == nil {
-			return "", "", fmt.Errorf("leonardo: couldn't find generation %s", generationID)
-		}
-		switch candidate.Status {
-		case "PENDING":
-			continue
-		case "COMPLETE":
-		default:
-			return "", "", fmt.Errorf("leonardo: feed generation %s", candidate.Status)
-		}
-		gen = candidate
-		break
-	}
-	if len(gen.GeneratedImages) == 0 {
-		return "", "", fmt.Errorf("leonardo: couldn't get generated images")
-	}
-	u := gen.GeneratedImages[0].MotionMP4URL
-	if u == nil || *u == "" {
-		return "", "", fmt.Errorf("leonardo: empty motion mp4 url")
-	}
-	id = gen.GeneratedImages[0].ID
-	if id == "" {
-		return "", "", fmt.Errorf("leonardo: empty generated image id")
+func (c *Client) log(format string, args ...interface{}) {
+	if c.debug {
+		format += "\n"
+		log.Printf(format, args...)
 	}
-	return id, *u, nil
 }
 
-func (c *Client) log(format string, args ...interface{}) {
-	if c.debug {
+// info logs high level progress in verbose mode.
+func (c *Client) info(format string, args ...interface{}) {
+	if c.verbose {
 		format += "\n"
 		log.Printf(format, args...)
 	}
@@ -701,19 +886,85 @@ var backoff = []time.Duration{
 	2 * time.Minute,
 }
 
+// authBackoff are the delays between the attempts to get an access token
+// after a transient failure.
+var authBackoff = []time.Duration{
+	1 * time.Second,
+	2 * time.Second,
+	4 * time.Second,
+	8 * time.Second,
+}
+
+// isTransient reports whether the request failed because of the network or
+// the server, so it may succeed if retried.
+func isTransient(err error) bool {
+	var status errStatusCode
+	if errors.As(err, &status) {
+		return status >= 500 || status == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Do sends a GraphQL operation to Leonardo and decodes the data of the
+// response into out, for the operations the client doesn't wrap yet. It's a
+// lower-level API: the query and variables are sent as is, and out must match
+// the shape of the response, e.g. a struct with a Data field.
+//
+// Like the other methods, the request is authenticated, rate limited and
+// retried, and GraphQL errors are returned as an *APIError.
+func (c *Client) Do(ctx context.Context, operationName, query string, variables map[string]any, out any) error {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return err
+	}
+
+	req := &graphqlRequest{
+		OperationName: operationName,
+		Variables:     variables,
+		Query:         query,
+	}
+	if _, err := c.do(ctx, "POST", "graphql", req, out); err != nil {
+		return fmt.Errorf("leonardo: %s failed: %w", operationName, err)
+	}
+	return nil
+}
+
 func (c *Client) do(ctx context.Context, method, path string, in, out any) ([]byte, error) {
 	maxAttempts := 3
 	attempts := 0
+	refreshed := false
 	var err error
 	for {
 		if err != nil {
 			log.Println("retrying...", err)
 		}
+		token := c.accessToken()
 		var b []byte
 		b, err = c.doAttempt(ctx, method, path, in, out)
 		if err == nil {
 			return b, nil
 		}
+
+		// If the access token was rejected, refresh it and retry once
+		if errors.Is(err, ErrAuth) {
+			if refreshed {
+				return nil, err
+			}
+			refreshed = true
+			c.info("leonardo: access token rejected, refreshing")
+			if err := c.refreshToken(ctx, token); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The same prompt would be rejected again, and the credits won't be
+		// renewed by retrying
+		if errors.Is(err, ErrContentBlocked) || errors.Is(err, ErrInsufficientCredits) {
+			return nil, err
+		}
+
 		// Increase attempts and check if we should stop
 		attempts++
 		if attempts >= maxAttempts {
@@ -732,7 +983,10 @@ func (c *Client) do(ctx context.Context, method, path string, in, out any) ([]by
 		var errStatus errStatusCode
 		if errors.As(err, &errStatus) {
 			switch int(errStatus) {
-			case http.StatusBadGateway, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+			case http.StatusTooManyRequests:
+				c.metrics.IncCounter(metrics.LeonardoRateLimited, 1)
+				retry = true
+			case http.StatusBadGateway, http.StatusGatewayTimeout:
 				// Retry on these status codes
 				retry = true
 			default:
@@ -741,14 +995,8 @@ func (c *Client) do(ctx context.Context, method, path string, in, out any) ([]by
 		}
 
 		// Check API error
-		var errAPI errAPI
-		if errors.As(err, &errAPI) {
-			if errAPI.code == invalidJWTCode {
-				// If the JWT is invalid we should re-authenticate
-				if err := c.Auth(ctx); err != nil {
-					return nil, err
-				}
-			}
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
 			// Retry on any API error
 			retry = true
 		}
@@ -763,7 +1011,7 @@ func (c *Client) do(ctx context.Context, method, path string, in, out any) ([]by
 			idx = len(backoff) - 1
 		}
 		wait := backoff[idx]
-		c.log("server seems to be down, waiting %s before retrying\n", wait)
+		c.info("leonardo: server seems to be down, waiting %s before retrying", wait)
 		t := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
@@ -793,17 +1041,100 @@ func (e errStatusCode) Error() string {
 	return fmt.Sprintf("%d", e)
 }
 
+func (e errStatusCode) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return e == http.StatusTooManyRequests
+	case ErrAuth:
+		return e == http.StatusUnauthorized
+	case ErrInsufficientCredits:
+		return e == http.StatusPaymentRequired
+	}
+	return false
+}
+
 // Known error codes
 const (
 	invalidJWTCode = "invalid-jwt"
 )
 
-type errAPI struct {
-	code string
+// moderationCodes are the error codes of the prompts rejected by the content
+// moderation.
+var moderationCodes = map[string]bool{
+	"content-moderation-filter": true,
+	"content-moderation":        true,
+	"moderation-failed":         true,
+}
+
+// creditsCodes are the error codes of the requests rejected because the
+// account ran out of credits.
+var creditsCodes = map[string]bool{
+	"insufficient-credits": true,
+	"insufficient-tokens":  true,
+	"not-enough-tokens":    true,
+}
+
+// creditsMessages are the messages of the requests rejected because the
+// account ran out of credits, which are sometimes sent with a generic code.
+var creditsMessages = []string{
+	"not enough tokens",
+	"insufficient tokens",
+	"insufficient credits",
+}
+
+// APIError contains the GraphQL errors returned by Leonardo, which are sent
+// with a successful status code.
+type APIError struct {
+	// Code is the extension code of the first error.
+	Code     string
+	Messages []string
+}
+
+func (e *APIError) Error() string {
+	return strings.Join(e.Messages, ", ")
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrAuth:
+		return e.Code == invalidJWTCode
+	case ErrContentBlocked:
+		return moderationCodes[e.Code]
+	case ErrInsufficientCredits:
+		if creditsCodes[e.Code] {
+			return true
+		}
+		for _, msg := range e.Messages {
+			msg = strings.ToLower(msg)
+			for _, m := range creditsMessages {
+				if strings.Contains(msg, m) {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
 
-func (e errAPI) Error() string {
-	return e.code
+// parseAPIError returns the GraphQL errors of the response body, or nil if
+// there are none.
+func parseAPIError(body []byte) *APIError {
+	var errResp errorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || len(errResp.Errors) == 0 {
+		return nil
+	}
+	apiErr := &APIError{Code: errResp.Errors[0].Extensions.Code}
+	for _, e := range errResp.Errors {
+		msg := e.Message
+		if msg == "" {
+			msg = "unknown error"
+		}
+		if e.Extensions.Code != "" {
+			msg = fmt.Sprintf("%s (%s)", msg, e.Extensions.Code)
+		}
+		apiErr.Messages = append(apiErr.Messages, msg)
+	}
+	return apiErr
 }
 
 func (c *Client) doAttempt(ctx context.Context, method, path string, in, out any) ([]byte, error) {
@@ -828,9 +1159,9 @@ func (c *Client) doAttempt(ctx context.Context, method, path string, in, out any
 	c.log("leonardo: do %s %s %s", method, path, logBody)
 
 	// Check if path is absolute
-	u := fmt.Sprintf("https://api.leonardo.ai/v1/%s", path)
+	u := fmt.Sprintf("%s/%s", c.baseURL, path)
 	if strings.HasPrefix(path, "api") {
-		u = fmt.Sprintf("https://app.leonardo.ai/%s", path)
+		u = fmt.Sprintf("%s/%s", c.appURL, path)
 	}
 	if strings.HasPrefix(path, "http") {
 		u = path
@@ -844,6 +1175,11 @@ func (c *Client) doAttempt(ctx context.Context, method, path string, in, out any
 	unlock := c.ratelimit.Lock(ctx)
 	defer unlock()
 
+	// Limit the request duration, excluding the rate limit wait
+	reqCtx, cancel := context.WithTimeout(ctx, c.requestTimeout)
+	defer cancel()
+	req = req.WithContext(reqCtx)
+
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("leonardo: couldn't %s %s: %w", method, u, err)
@@ -854,24 +1190,28 @@ func (c *Client) doAttempt(ctx context.Context, method, path string, in, out any
 		return nil, fmt.Errorf("leonardo: couldn't read response body: %w", err)
 	}
 	c.log("leonardo: response %s %s %d %s", method, path, resp.StatusCode, string(respBody))
+	if gql, ok := in.(*graphqlRequest); ok && c.dumpDir != "" {
+		c.dumpResponse(gql, req, resp, respBody)
+	}
+	apiErr := parseAPIError(respBody)
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		_ = os.WriteFile(fmt.Sprintf("logs/debug_%s.json", time.Now().Format("20060102_150405")), respBody, 0644)
+		if apiErr != nil {
+			return nil, fmt.Errorf("leonardo: %s %s returned (%w): %w", method, u, apiErr, errStatusCode(resp.StatusCode))
+		}
 		errMessage := string(respBody)
 		if len(errMessage) > 100 {
 			errMessage = errMessage[:100] + "..."
 		}
-		_ = os.WriteFile(fmt.Sprintf("logs/debug_%s.json", time.Now().Format("20060102_150405")), respBody, 0644)
 		return nil, fmt.Errorf("leonardo: %s %s returned (%s): %w", method, u, errMessage, errStatusCode(resp.StatusCode))
 	}
+	// GraphQL errors are returned with a 200 status code, so they must be
+	// checked before decoding the data
+	if apiErr != nil {
+		_ = os.WriteFile(fmt.Sprintf("logs/debug_%s.json", time.Now().Format("20060102_150405")), respBody, 0644)
+		return nil, fmt.Errorf("leonardo: %w", apiErr)
+	}
 	if out != nil {
-		var errResp errorResponse
-		if err := json.Unmarshal(respBody, &errResp); err == nil && len(errResp.Errors) > 0 {
-			var msgs []string
-			for _, e := range errResp.Errors {
-				msgs = append(msgs, fmt.Sprintf("%s (%s)", e.Message, e.Extensions.Code))
-			}
-			_ = os.WriteFile(fmt.Sprintf("logs/debug_%s.json", time.Now().Format("20060102_150405")), respBody, 0644)
-			return nil, fmt.Errorf("leonardo: %s: %w", strings.Join(msgs, ", "), errAPI{code: errResp.Errors[0].Extensions.Code})
-		}
 		if err := json.Unmarshal(respBody, out); err != nil {
 			// Write response body to file for debugging.
 			_ = os.WriteFile(fmt.Sprintf("logs/debug_%s.json", time.Now().Format("20060102_150405")), respBody, 0644)
@@ -892,7 +1232,7 @@ func (c *Client) addHeaders(req *http.Request, path, contentType string) {
 		req.Header.Set("Referer", "https://app.leonardo.ai/")
 		req.Header.Set("Sec-Fetch-Dest", "empty")
 		req.Header.Set("Sec-Fetch-Mode", "cors")
-		req.Header.Set("User-Agent", `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36`)
+		req.Header.Set("User-Agent", c.userAgent)
 		req.Header.Set("sec-ch-ua", `"Not A(Brand";v="99", "Google Chrome";v="121", "Chromium";v="121"`)
 		req.Header.Set("sec-ch-ua-mobile", "?0")
 		req.Header.Set("sec-ch-ua-platform", `"Windows"`)
@@ -913,21 +1253,29 @@ func (c *Client) addHeaders(req *http.Request, path, contentType string) {
 		req.Header.Set("sec-fetch-site", "same-origin")
 		// TODO: Check if this is necessary
 		// req.Header.Set("sentry-trace", "")
-		req.Header.Set("user-agent", `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36`)
+		req.Header.Set("user-agent", c.userAgent)
 	default:
 		req.Header.Set("authority", "api.leonardo.ai")
 		req.Header.Set("accept", "*/*")
 		req.Header.Set("accept-language", "en-US,en;q=0.9")
-		req.Header.Set("authorization", fmt.Sprintf("Bearer %s", c.token))
+		req.Header.Set("authorization", fmt.Sprintf("Bearer %s", c.accessToken()))
 		req.Header.Set("content-yype", contentType)
 		req.Header.Set("origin", "https://app.leonardo.ai")
 		req.Header.Set("Referer", "https://app.leonardo.ai/")
 		req.Header.Set("sec-fetch-dest", "empty")
 		req.Header.Set("sec-fetch-mode", "cors")
 		req.Header.Set("sec-fetch-site", "same-site")
-		req.Header.Set("user-agent", `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/121.0.0.0 Safari/537.36`)
+		req.Header.Set("user-agent", c.userAgent)
 		req.Header.Set("sec-ch-ua", `"Not A(Brand";v="99", "Google Chrome";v="121", "Chromium";v="121"`)
 		req.Header.Set("sec-ch-ua-mobile", "?0")
 		req.Header.Set("sec-ch-ua-platform", `"Windows"`)
 	}
+	// The absolute URLs are the presigned S3 uploads, which aren't sent to
+	// Leonardo
+	if strings.HasPrefix(path, "http") {
+		return
+	}
+	for k, v := range c.extraHeaders {
+		req.Header.Set(k, v)
+	}
 }
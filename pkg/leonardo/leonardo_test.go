@@ -1,8 +1,24 @@
 package leonardo
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"automation/leoverse/pkg/metrics"
+	"automation/leoverse/pkg/metrics/metricstest"
 )
 
 func TestFeedResponse(t *testing.T) {
@@ -79,6 +95,33 @@ func TestFeedResponse(t *testing.T) {
 	}
 }
 
+func TestFeedImageMetadata(t *testing.T) {
+	data := `{"data":{"generations":[{
+		"id": "generation",
+		"status": "COMPLETE",
+		"imageHeight": 576,
+		"imageWidth": 1024,
+		"seed": 6000000000000000,
+		"generated_images": [{
+			"id": "image",
+			"url": "https://cdn.leonardo.ai/1.jpg",
+			"motionGIFURL": null,
+			"motionMP4URL": "https://cdn.leonardo.ai/1.mp4"
+		}]
+	}]}}`
+	var response feedResponse
+	if err := json.Unmarshal([]byte(data), &response); err != nil {
+		t.Fatal(err)
+	}
+	img := response.Data.Generations[0].toGeneration().Images[0]
+	if img.Width != 1024 || img.Height != 576 || img.Seed != 6000000000000000 {
+		t.Errorf("unexpected image metadata: %+v", img)
+	}
+	if img.MotionMP4URL == nil || *img.MotionMP4URL != "https://cdn.leonardo.ai/1.mp4" || img.MotionGIFURL != nil {
+		t.Errorf("unexpected motion urls: %v, %v", img.MotionMP4URL, img.MotionGIFURL)
+	}
+}
+
 func TestUserResponse(t *testing.T) {
 	data := `{
 	"data": {
@@ -132,3 +175,1142 @@ func TestUserResponse(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestParseAPIError(t *testing.T) {
+	body := `{"errors":[{"message":"Not enough tokens","extensions":{"code":"validation-failed"}},{"message":"Invalid model"}],"data":null}`
+	apiErr := parseAPIError([]byte(body))
+	if apiErr == nil {
+		t.Fatal("expected api error")
+	}
+	if apiErr.Code != "validation-failed" {
+		t.Errorf("unexpected code %q", apiErr.Code)
+	}
+	if want := "Not enough tokens (validation-failed), Invalid model"; apiErr.Error() != want {
+		t.Errorf("unexpected message %q, want %q", apiErr.Error(), want)
+	}
+	if errors.Is(apiErr, ErrAuth) {
+		t.Error("unexpected auth error")
+	}
+	if !errors.Is(&APIError{Code: invalidJWTCode}, ErrAuth) {
+		t.Error("expected invalid jwt to be an auth error")
+	}
+	if parseAPIError([]byte(feedJSON("COMPLETE"))) != nil {
+		t.Error("unexpected api error for a successful response")
+	}
+}
+
+func TestInspectCookie(t *testing.T) {
+	payload, _ := json.Marshal(map[string]any{"email": "email@example.com", "iat": 1700000000, "exp": 1700003600})
+	token := "header." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+
+	info, err := InspectCookie("__Secure-next-auth.session-token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != CookieFormatHeader || info.Email != "email@example.com" || info.ExpiresAt.Unix() != 1700003600 || info.IssuedAt.Unix() != 1700000000 {
+		t.Errorf("unexpected cookie info %+v", info)
+	}
+	if !info.Expired(time.Unix(1700003600, 0)) || info.Expired(time.Unix(1700000000, 0)) {
+		t.Error("unexpected expiration")
+	}
+
+	session := `{"user":{"email":"session@example.com"},"accessToken":"opaque","accessTokenIssuedAt":1700000000,"accessTokenExpiry":1700086400}`
+	info, err = InspectCookie(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != CookieFormatSession || info.Email != "session@example.com" || info.ExpiresAt.Unix() != 1700086400 {
+		t.Errorf("unexpected session info %+v", info)
+	}
+
+	info, err = InspectCookie("opaque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != CookieFormatToken || info.Email != "" || !info.ExpiresAt.IsZero() || info.Expired(time.Now()) {
+		t.Errorf("unexpected token info %+v", info)
+	}
+
+	if _, err := InspectCookie(`{"user":{}`); err == nil {
+		t.Error("expected error for malformed session json")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newTestClient returns an authenticated client whose GraphQL requests are
+// answered by the handler, which receives the operation name and returns the
+// response body.
+func newTestClient(t *testing.T, handler func(operation string) string) *Client {
+	t.Helper()
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var req graphqlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("couldn't decode request: %v", err)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(bytes.NewBufferString(handler(req.OperationName))),
+			Request:    r,
+		}, nil
+	})
+	c := New(&Config{
+		Wait:         time.Millisecond,
+		PollInterval: time.Millisecond,
+		Client:       &http.Client{Transport: transport},
+		CookieStore:  NewMemCookieStore("token"),
+	})
+	c.token = "token"
+	c.tokenExpiration = time.Now().Add(time.Hour)
+	return c
+}
+
+// newTestServer returns a started client whose requests, including the
+// authentication ones, are served by an httptest server. GraphQL requests other
+// than the user lookup are answered by the handler.
+func newTestServer(t *testing.T, handler func(operation string) string) *Client {
+	t.Helper()
+	return newRequestTestServer(t, func(req *graphqlRequest) string {
+		return handler(req.OperationName)
+	})
+}
+
+// newRequestTestServer is like newTestServer but passes the whole GraphQL
+// request to the handler.
+func newRequestTestServer(t *testing.T, handler func(req *graphqlRequest) string) *Client {
+	t.Helper()
+	hasura, _ := json.Marshal(map[string]string{"x-hasura-user-id": "user"})
+	payload, _ := json.Marshal(map[string]string{"sub": "sub", "https://hasura.io/jwt/claims": string(hasura)})
+	token := "header." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/auth/session" {
+			if _, err := r.Cookie("__Secure-next-auth.session-token"); err != nil {
+				t.Errorf("session cookie not sent: %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"accessToken":       token,
+				"accessTokenExpiry": time.Now().Add(time.Hour).Unix(),
+			})
+			return
+		}
+		if r.URL.Path != "/v1/graphql" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var req graphqlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("couldn't decode request: %v", err)
+		}
+		if req.OperationName == "GetUserDetails" {
+			fmt.Fprint(w, `{"data":{"users":[{"id":"user","username":"username","user_details":[{"auth0Email":"email@example.com","plan":"BASIC"}]}]}}`)
+			return
+		}
+		fmt.Fprint(w, handler(&req))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := New(&Config{
+		Wait:         time.Millisecond,
+		PollInterval: time.Millisecond,
+		BaseURL:      srv.URL + "/v1",
+		AppURL:       srv.URL,
+		Client:       srv.Client(),
+		CookieStore:  NewMemCookieStore("__Secure-next-auth.session-token=token"),
+	})
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAuthRetry(t *testing.T) {
+	defer func(b []time.Duration) { authBackoff = b }(authBackoff)
+	authBackoff = []time.Duration{time.Millisecond, time.Millisecond}
+	// The server fails the first attempts with the status
+	var status, failures, attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failures {
+			w.WriteHeader(status)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"accessToken":       "token",
+			"accessTokenExpiry": time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	defer srv.Close()
+	c := New(&Config{
+		Wait:        time.Millisecond,
+		AppURL:      srv.URL,
+		Client:      srv.Client(),
+		CookieStore: NewMemCookieStore("token"),
+	})
+
+	// Server errors are retried
+	failures, status = 2, http.StatusServiceUnavailable
+	if err := c.Auth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+
+	// Invalid credentials fail at once
+	c.token = ""
+	attempts, failures, status = 0, 10, http.StatusUnauthorized
+	if err := c.Auth(context.Background()); !errors.Is(err, ErrAuth) {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+
+	// Persistent server errors aren't reported as invalid credentials
+	attempts, status = 0, http.StatusBadGateway
+	err := c.Auth(context.Background())
+	if err == nil || errors.Is(err, ErrAuth) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+func TestGenerateImage(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		switch operation {
+		case "CreateSDGenerationJob":
+			return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+		case "GetAIGenerationFeed":
+			return feedJSON("COMPLETE", "https://cdn.leonardo.ai/1.jpg")
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	urls, err := c.GenerateImage(context.Background(), &GenerateImageInput{Prompt: "a cat", Steps: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != "https://cdn.leonardo.ai/1.jpg" {
+		t.Errorf("unexpected urls %v", urls)
+	}
+}
+
+// generationArgs returns the arguments of the generation job created for the
+// input.
+func generationArgs(t *testing.T, input *GenerateImageInput) map[string]any {
+	t.Helper()
+	var arg map[string]any
+	c := newRequestTestServer(t, func(req *graphqlRequest) string {
+		if req.OperationName != "CreateSDGenerationJob" {
+			t.Errorf("unexpected operation %s", req.OperationName)
+			return "{}"
+		}
+		arg, _ = req.Variables["arg1"].(map[string]any)
+		return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+	})
+	if _, err := c.CreateGeneration(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	return arg
+}
+
+func TestPromptMagicVariables(t *testing.T) {
+	input := &GenerateImageInput{Prompt: "a cat", Steps: 10, EnhancePrompt: true, PromptMagicStrength: 0.5, PromptMagicVersion: "v3"}
+	arg := generationArgs(t, input)
+	if arg["promptMagicStrength"] != 0.5 || arg["promptMagicVersion"] != "v3" {
+		t.Errorf("prompt magic settings not sent: %v", arg)
+	}
+
+	input.EnhancePrompt = false
+	arg = generationArgs(t, input)
+	if _, ok := arg["promptMagicStrength"]; ok {
+		t.Errorf("prompt magic strength sent without enhance prompt: %v", arg)
+	}
+	if _, ok := arg["promptMagicVersion"]; ok {
+		t.Errorf("prompt magic version sent without enhance prompt: %v", arg)
+	}
+}
+
+func TestUploadExtraHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "init.png")
+	if err := os.WriteFile(path, []byte("image data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := json.Marshal(map[string]string{"key": "uploads/init.png", "bucket": "bucket"})
+	upload, _ := json.Marshal(map[string]any{"data": map[string]any{"uploadInitImage": map[string]any{
+		"id":     "image",
+		"fields": string(fields),
+		"url":    "https://bucket.s3.amazonaws.com/",
+	}}})
+	var uploaded bool
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := string(upload)
+		if r.URL.Host == "bucket.s3.amazonaws.com" {
+			uploaded = true
+			if got := r.Header.Get("X-Custom"); got != "" {
+				t.Errorf("extra header sent to S3: %q", got)
+			}
+			body = ""
+		} else if got := r.Header.Get("X-Custom"); got != "value" {
+			t.Errorf("extra header = %q on %s, want value", got, r.URL)
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	c := New(&Config{
+		Wait:         time.Millisecond,
+		Client:       &http.Client{Transport: transport},
+		CookieStore:  NewMemCookieStore("token"),
+		ExtraHeaders: map[string]string{"X-Custom": "value"},
+	})
+	c.token = "token"
+	c.tokenExpiration = time.Now().Add(time.Hour)
+	id, err := c.Upload(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "image" || !uploaded {
+		t.Errorf("got image %q, uploaded %v", id, uploaded)
+	}
+}
+
+func TestTilingVariable(t *testing.T) {
+	input := &GenerateImageInput{Prompt: "a cat", Steps: 10, Tiling: true}
+	if tiling := generationArgs(t, input)["tiling"]; tiling != true {
+		t.Errorf("tiling = %v, want true", tiling)
+	}
+	input.Tiling = false
+	if tiling, ok := generationArgs(t, input)["tiling"]; ok {
+		t.Errorf("tiling sent without tiling: %v", tiling)
+	}
+}
+
+func TestElementVariables(t *testing.T) {
+	input := &GenerateImageInput{Prompt: "a cat", Steps: 10, Elements: []Element{{AkUUID: "element", Weight: 0.8}, {AkUUID: "other", Weight: -0.5}}}
+	arg := generationArgs(t, input)
+	want := []any{
+		map[string]any{"akUUID": "element", "weight": 0.8},
+		map[string]any{"akUUID": "other", "weight": -0.5},
+	}
+	if !reflect.DeepEqual(arg["elements"], want) {
+		t.Errorf("elements = %v, want %v", arg["elements"], want)
+	}
+
+	input.Elements = nil
+	if elements, ok := generationArgs(t, input)["elements"]; ok {
+		t.Errorf("elements sent without elements: %v", elements)
+	}
+}
+
+func TestGenerateWithSuffixes(t *testing.T) {
+	generations := 0
+	c := newTestServer(t, func(operation string) string {
+		switch operation {
+		case "CreateSDGenerationJob":
+			generations++
+			return fmt.Sprintf(`{"data":{"sdGenerationJob":{"generationId":"generation%d"}}}`, generations)
+		case "GetAIGenerationFeed":
+			return feedJSON("COMPLETE", fmt.Sprintf("https://cdn.leonardo.ai/%d.jpg", generations))
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	base := GenerateImageInput{Prompt: "a cat", Steps: 10}
+	results, err := c.GenerateWithSuffixes(context.Background(), base, 42, []string{"", "at night"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generations != 2 {
+		t.Errorf("expected 2 generations, got %d", generations)
+	}
+	if len(results[""]) != 1 || results[""][0].URL != "https://cdn.leonardo.ai/1.jpg" {
+		t.Errorf("unexpected images for the base prompt %v", results[""])
+	}
+	if len(results["at night"]) != 1 || results["at night"][0].URL != "https://cdn.leonardo.ai/2.jpg" {
+		t.Errorf("unexpected images for the suffix %v", results["at night"])
+	}
+
+	if _, err := c.GenerateWithSuffixes(context.Background(), base, 0, []string{"a"}); err == nil {
+		t.Error("expected error without a seed")
+	}
+	if _, err := c.GenerateWithSuffixes(context.Background(), base, 42, []string{"a", "a"}); err == nil {
+		t.Error("expected error for duplicate suffixes")
+	}
+}
+
+func TestGenerateMotion(t *testing.T) {
+	polls := 0
+	c := newTestServer(t, func(operation string) string {
+		switch operation {
+		case "CreateMotionSvdGenerationJob":
+			return `{"data":{"motionSvdGenerationJob":{"generationId":"generation"}}}`
+		case "GetAIGenerationFeed":
+			polls++
+			if polls < 2 {
+				return feedJSON("PENDING")
+			}
+			return `{"data":{"generations":[{"id":"generation","status":"COMPLETE","generated_images":[{"id":"image","url":"https://cdn.leonardo.ai/1.jpg","motionMP4URL":"https://cdn.leonardo.ai/1.mp4"}]}]}}`
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	u, err := c.GenerateMotion(context.Background(), "image", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://cdn.leonardo.ai/1.mp4" {
+		t.Errorf("unexpected url %s", u)
+	}
+
+	if _, err := c.GenerateMotion(context.Background(), "image", 11); err == nil {
+		t.Error("expected error for an invalid motion strength")
+	}
+}
+
+func TestCancelOnExit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	deleted := false
+	c := newTestClient(t, func(operation string) string {
+		switch operation {
+		case "GetAIGenerationFeed":
+			cancel()
+			return feedJSON("PENDING")
+		case "DeleteGeneration":
+			deleted = true
+			return `{"data":{"delete_generations_by_pk":{"id":"generation"}}}`
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	c.cancelOnExit = true
+	if _, err := c.WaitForGeneration(ctx, "generation"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+	if !deleted {
+		t.Error("expected the generation to be cancelled")
+	}
+}
+
+func TestGenerateImageFailed(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		switch operation {
+		case "CreateSDGenerationJob":
+			return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+		case "GetAIGenerationFeed":
+			return feedJSON("FAILED")
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	_, err := c.GenerateImage(context.Background(), &GenerateImageInput{Prompt: "a cat", Steps: 10})
+	if err == nil || !strings.Contains(err.Error(), "FAILED") {
+		t.Fatalf("expected failed generation error, got %v", err)
+	}
+}
+
+func TestGenerateImageBlocked(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		switch operation {
+		case "CreateSDGenerationJob":
+			return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+		case "GetAIGenerationFeed":
+			return feedJSON("MODERATED")
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	_, err := c.GenerateImage(context.Background(), &GenerateImageInput{Prompt: "a cat", Steps: 10})
+	var blocked *ContentBlockedError
+	if !errors.Is(err, ErrContentBlocked) || !errors.As(err, &blocked) || blocked.GenerationID != "generation" {
+		t.Fatalf("expected content blocked error, got %v", err)
+	}
+	if errors.Is(err, ErrGenerationFailed) {
+		t.Error("blocked generation shouldn't be a failed generation")
+	}
+
+	creates := 0
+	c = newTestServer(t, func(operation string) string {
+		creates++
+		return `{"errors":[{"message":"Prompt flagged as inappropriate","extensions":{"code":"content-moderation-filter"}}],"data":null}`
+	})
+	_, err = c.GenerateImage(context.Background(), &GenerateImageInput{Prompt: "a cat", Steps: 10})
+	if !errors.As(err, &blocked) || !strings.Contains(blocked.Reason, "Prompt flagged as inappropriate") {
+		t.Fatalf("expected content blocked error with the reason, got %v", err)
+	}
+	if creates != 1 {
+		t.Errorf("blocked prompt was sent %d times", creates)
+	}
+}
+
+func TestRotatingClientForgetsFinished(t *testing.T) {
+	status := "FAILED"
+	c := newTestServer(t, func(operation string) string {
+		if operation == "CreateSDGenerationJob" {
+			return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+		}
+		return feedJSON(status)
+	})
+	r := NewRotatingClient(time.Hour, c)
+	ctx := context.Background()
+	if err := r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	wait := func(ctx context.Context) error {
+		id, err := r.CreateGeneration(ctx, &GenerateImageInput{Prompt: "a cat", Steps: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.WaitForGeneration(ctx, id)
+		return err
+	}
+
+	if err := wait(ctx); !errors.Is(err, ErrGenerationFailed) {
+		t.Fatalf("expected failed generation, got %v", err)
+	}
+	if n := len(r.owners); n != 0 {
+		t.Errorf("got %d owners after the generation failed, want 0", n)
+	}
+
+	status = "PENDING"
+	cancelled, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := wait(cancelled); err == nil {
+		t.Fatal("expected cancelled generation")
+	}
+	if n := len(r.owners); n != 0 {
+		t.Errorf("got %d owners after the wait was cancelled, want 0", n)
+	}
+}
+
+func TestRotatingClient(t *testing.T) {
+	var exhausted, fallback int
+	first := newTestServer(t, func(operation string) string {
+		exhausted++
+		return `{"errors":[{"message":"Not enough tokens","extensions":{"code":"validation-failed"}}],"data":null}`
+	})
+	second := newTestServer(t, func(operation string) string {
+		fallback++
+		switch operation {
+		case "CreateSDGenerationJob":
+			return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+		case "GetAIGenerationFeed":
+			return feedJSON("COMPLETE", "https://cdn.leonardo.ai/1.jpg")
+		}
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	r := NewRotatingClient(time.Hour, first, second)
+	ctx := context.Background()
+	if err := r.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		images, err := r.GenerateImageDetailed(ctx, &GenerateImageInput{Prompt: "a cat", Steps: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(images) != 1 {
+			t.Fatalf("expected 1 image, got %d", len(images))
+		}
+	}
+	// The exhausted account is cooling down after the first generation
+	if exhausted != 1 {
+		t.Errorf("exhausted account was used %d times", exhausted)
+	}
+	if fallback != 4 {
+		t.Errorf("expected 4 requests to the fallback account, got %d", fallback)
+	}
+
+	// The completed generations are forgotten, and looked up when needed
+	if n := len(r.owners); n != 0 {
+		t.Errorf("got %d owners after the generations completed, want 0", n)
+	}
+	if _, err := r.GetGeneration(ctx, "generation"); err != nil {
+		t.Errorf("couldn't find the completed generation: %v", err)
+	}
+
+	// Once every account is cooling down, the generation fails
+	r = NewRotatingClient(time.Hour, first)
+	_, err := r.CreateGeneration(ctx, &GenerateImageInput{Prompt: "a cat", Steps: 10})
+	if !errors.Is(err, ErrInsufficientCredits) {
+		t.Fatalf("expected insufficient credits error, got %v", err)
+	}
+}
+
+func TestBlockedTerms(t *testing.T) {
+	c := newTestClient(t, func(operation string) string {
+		return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+	})
+	c.blocklist = newBlocklist([]string{"cat", "#tag", "café", " "})
+	tests := []struct {
+		prompt  string
+		blocked bool
+	}{
+		{"a CAT on a mat", true},
+		{"cat", true},
+		{"a catalog", false},
+		{"a photo #tag", true},
+		{"Café au lait", true},
+		{"two cafés", false},
+		{"a dog", false},
+	}
+	for _, tt := range tests {
+		_, err := c.CreateGeneration(context.Background(), &GenerateImageInput{Prompt: tt.prompt, Steps: 10})
+		var blocked *ContentBlockedError
+		if got := errors.As(err, &blocked); got != tt.blocked {
+			t.Errorf("prompt %q: blocked = %v, want %v (error %v)", tt.prompt, got, tt.blocked, err)
+		}
+		if !tt.blocked && err != nil {
+			t.Errorf("prompt %q: unexpected error %v", tt.prompt, err)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		if operation != "GetModels" {
+			t.Errorf("unexpected operation %s", operation)
+		}
+		return `{"data":{"custom_models":[{"id":"model","name":"Model"}]}}`
+	})
+	var resp struct {
+		Data struct {
+			Models []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"custom_models"`
+		} `json:"data"`
+	}
+	if err := c.Do(context.Background(), "GetModels", "query GetModels { custom_models { id name } }", nil, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Models) != 1 || resp.Data.Models[0].ID != "model" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestResponseDump(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		return `{"data":{"custom_models":[]}}`
+	})
+	dir := filepath.Join(t.TempDir(), "dumps")
+	c.dumpDir = dir
+	if err := c.Do(context.Background(), "GetModels", "query GetModels { custom_models { id } }", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), "_GetModels.json") {
+		t.Fatalf("unexpected dump files %v", entries)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), c.accessToken()) {
+		t.Error("dump contains the access token")
+	}
+	var d dump
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+	var response bytes.Buffer
+	if err := json.Compact(&response, d.Response); err != nil {
+		t.Fatal(err)
+	}
+	if d.Operation != "GetModels" || d.Status != http.StatusOK || response.String() != `{"data":{"custom_models":[]}}` {
+		t.Errorf("unexpected dump %s", data)
+	}
+	if got := d.RequestHeaders.Get("Authorization"); got != "REDACTED" {
+		t.Errorf("Authorization header = %q, want REDACTED", got)
+	}
+}
+
+func TestListGenerationsFiltered(t *testing.T) {
+	const total = feedPageSize + 10
+	var requests []map[string]any
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var req graphqlRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("couldn't decode request: %v", err)
+		}
+		requests = append(requests, req.Variables)
+		offset := int(req.Variables["offset"].(float64))
+		limit := int(req.Variables["limit"].(float64))
+		var gens []map[string]any
+		for i := offset; i < min(offset+limit, total); i++ {
+			gens = append(gens, map[string]any{"id": fmt.Sprintf("generation-%d", i), "status": "COMPLETE"})
+		}
+		b, _ := json.Marshal(map[string]any{"data": map[string]any{"generations": gens}})
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(b)),
+			Request:    r,
+		}, nil
+	})
+	c := New(&Config{
+		Wait:        time.Millisecond,
+		Client:      &http.Client{Transport: transport},
+		CookieStore: NewMemCookieStore("token"),
+	})
+	c.token = "token"
+	c.tokenExpiration = time.Now().Add(time.Hour)
+	c.userID = "user"
+
+	filter := GenerationFilter{
+		Since:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Until:  time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		Status: "complete",
+	}
+	gens, err := c.ListGenerationsFiltered(context.Background(), filter, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != total || len(requests) != 2 {
+		t.Fatalf("got %d generations in %d requests, want %d in 2", len(gens), len(requests), total)
+	}
+	where := requests[0]["where"].(map[string]any)
+	createdAt := where["createdAt"].(map[string]any)
+	if createdAt["_gte"] != "2024-01-01T00:00:00.000" || createdAt["_lt"] != "2024-02-01T00:00:00.000" {
+		t.Errorf("unexpected createdAt condition %v", createdAt)
+	}
+	if status := where["status"].(map[string]any); status["_eq"] != "COMPLETE" {
+		t.Errorf("unexpected status condition %v", status)
+	}
+	if requests[1]["offset"] != float64(feedPageSize) {
+		t.Errorf("second page offset = %v, want %d", requests[1]["offset"], feedPageSize)
+	}
+
+	// The limit caps the number of generations
+	requests = nil
+	gens, err = c.ListGenerationsFiltered(context.Background(), GenerationFilter{}, 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 5 || len(requests) != 1 {
+		t.Errorf("got %d generations in %d requests, want 5 in 1", len(gens), len(requests))
+	}
+
+	if _, err := c.ListGenerationsFiltered(context.Background(), GenerationFilter{Since: filter.Until, Until: filter.Since}, 0, 0); err == nil {
+		t.Error("expected error for an empty date range")
+	}
+}
+
+func TestImprovePrompt(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		if operation != "PromptImprove" {
+			t.Errorf("unexpected operation %s", operation)
+		}
+		return `{"data":{"promptImprove":{"prompt":"a fluffy cat, cinematic lighting"}}}`
+	})
+	improved, err := c.ImprovePrompt(context.Background(), " a cat ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if improved != "a fluffy cat, cinematic lighting" {
+		t.Errorf("unexpected prompt %q", improved)
+	}
+}
+
+func TestRefreshRejectedToken(t *testing.T) {
+	calls := 0
+	c := newTestServer(t, func(operation string) string {
+		calls++
+		if calls == 1 {
+			return `{"errors":[{"message":"Could not verify JWT","extensions":{"code":"invalid-jwt"}}]}`
+		}
+		return `{"data":{"promptImprove":{"prompt":"a fluffy cat"}}}`
+	})
+	// The token hasn't expired but the server rejects it
+	token := c.accessToken()
+	c.token = "stale"
+	if _, err := c.ImprovePrompt(context.Background(), "a cat"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+	if c.accessToken() != token {
+		t.Errorf("token wasn't refreshed")
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	user, err := c.WhoAmI(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := User{ID: "user", Username: "username", Email: "email@example.com", Plan: "BASIC"}
+	if *user != want {
+		t.Errorf("user = %+v, want %+v", *user, want)
+	}
+}
+
+func TestSession(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	s, err := c.Session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.UserID != "user" || s.AccessToken != c.accessToken() {
+		t.Errorf("unexpected session %+v", s)
+	}
+	if until := time.Until(s.ExpiresAt); until <= 50*time.Minute || until > time.Hour {
+		t.Errorf("expires in %s, want an hour", until)
+	}
+	if s.Cookie != "__Secure-next-auth.session-token=token" {
+		t.Errorf("cookie = %q", s.Cookie)
+	}
+}
+
+func TestTokenTimeToLive(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	ttl, err := c.TokenTimeToLive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 50*time.Minute || ttl > time.Hour {
+		t.Errorf("ttl = %s, want an hour", ttl)
+	}
+
+	// Before authenticating, the expiry is read from the cookie
+	payload, _ := json.Marshal(map[string]any{"exp": time.Now().Add(-time.Minute).Unix()})
+	token := "header." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+	c = New(&Config{CookieStore: NewMemCookieStore(token)})
+	if ttl, err := c.TokenTimeToLive(context.Background()); err != nil || ttl >= 0 {
+		t.Errorf("got %s, %v, want a negative ttl for an expired token", ttl, err)
+	}
+	c = New(&Config{CookieStore: NewMemCookieStore("opaque")})
+	if _, err := c.TokenTimeToLive(context.Background()); err == nil {
+		t.Error("expected error for an unknown expiry")
+	}
+}
+
+func TestSessionExpiresRefresh(t *testing.T) {
+	// The session outlives its access token, whose expiry isn't known
+	expires := time.Now().Add(30 * 24 * time.Hour).UTC()
+	transport := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, _ := json.Marshal(map[string]any{"accessToken": "token", "expires": expires.Format(time.RFC3339)})
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	c := New(&Config{
+		AppURL:      "https://app.leonardo.ai",
+		Client:      &http.Client{Transport: transport},
+		CookieStore: NewMemCookieStore("__Secure-next-auth.session-token=token"),
+	})
+	if err := c.renewToken(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if refresh := time.Until(c.tokenExpiration); refresh > defaultTokenLifetime {
+		t.Errorf("token refreshed in %s, want at most %s", refresh, defaultTokenLifetime)
+	}
+	ttl, err := c.TokenTimeToLive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl < 29*24*time.Hour {
+		t.Errorf("ttl = %s, want the session expiry", ttl)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	want := time.Unix(1700086400, 0)
+	tests := []struct {
+		name    string
+		expiry  int
+		expires string
+	}{
+		{"seconds", 1700086400, ""},
+		{"milliseconds", 1700086400000, ""},
+		{"date", 0, "2023-11-15T22:13:20.000Z"},
+	}
+	for _, tt := range tests {
+		if got := sessionExpiry(tt.expiry, tt.expires); !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, want)
+		}
+	}
+	if got := sessionExpiry(0, ""); !got.IsZero() {
+		t.Errorf("got %s, want zero", got)
+	}
+}
+
+func TestStartTwice(t *testing.T) {
+	c := newTestServer(t, func(operation string) string {
+		t.Errorf("unexpected operation %s", operation)
+		return "{}"
+	})
+	token := c.token
+	c.token = ""
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.token != "" {
+		t.Error("second start authenticated again")
+	}
+	c.token = token
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	c := New(&Config{CookieStore: NewMemCookieStore("token")})
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func feedJSON(status string, urls ...string) string {
+	var images []map[string]any
+	for i, u := range urls {
+		images = append(images, map[string]any{"id": fmt.Sprintf("image-%d", i), "url": u})
+	}
+	b, _ := json.Marshal(map[string]any{
+		"data": map[string]any{
+			"generations": []map[string]any{
+				{"id": "generation", "status": status, "generated_images": images},
+			},
+		},
+	})
+	return string(b)
+}
+
+func TestPollGenerationComplete(t *testing.T) {
+	polls := 0
+	c := newTestClient(t, func(operation string) string {
+		polls++
+		if polls < 3 {
+			return feedJSON("PENDING")
+		}
+		return feedJSON("COMPLETE", "https://cdn.leonardo.ai/1.jpg", "https://cdn.leonardo.ai/2.jpg")
+	})
+	var statuses []string
+	c.onProgress = func(generationID, status string, elapsed time.Duration) {
+		if generationID != "generation" {
+			t.Errorf("unexpected generation id %s", generationID)
+		}
+		statuses = append(statuses, status)
+	}
+	images, err := c.WaitForGeneration(context.Background(), "generation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	if images[1].URL != "https://cdn.leonardo.ai/2.jpg" {
+		t.Errorf("unexpected url %s", images[1].URL)
+	}
+	if polls != 3 {
+		t.Errorf("expected 3 polls, got %d", polls)
+	}
+	if strings.Join(statuses, ",") != "PENDING,PENDING,COMPLETE" {
+		t.Errorf("unexpected progress %v", statuses)
+	}
+}
+
+func TestPollGenerationFailed(t *testing.T) {
+	c := newTestClient(t, func(operation string) string {
+		return feedJSON("FAILED")
+	})
+	_, err := c.WaitForGeneration(context.Background(), "generation")
+	if !errors.Is(err, ErrGenerationFailed) {
+		t.Fatalf("expected generation failed error, got %v", err)
+	}
+}
+
+func TestGenerationMetrics(t *testing.T) {
+	status := "COMPLETE"
+	c := newTestClient(t, func(operation string) string {
+		if operation == "CreateSDGenerationJob" {
+			return `{"data":{"sdGenerationJob":{"generationId":"generation"}}}`
+		}
+		return feedJSON(status, "https://cdn.leonardo.ai/1.jpg")
+	})
+	m := metricstest.NewRecorder()
+	c.metrics = m
+	ctx := context.Background()
+	if _, err := c.GenerateImageDetailed(ctx, &GenerateImageInput{Prompt: "a cat", Steps: 10}); err != nil {
+		t.Fatal(err)
+	}
+	status = "FAILED"
+	if _, err := c.WaitForGeneration(ctx, "generation"); err == nil {
+		t.Fatal("expected failed generation")
+	}
+	// The cancelled generations aren't counted as failed
+	status = "PENDING"
+	cancelled, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.WaitForGeneration(cancelled, "generation"); err == nil {
+		t.Fatal("expected cancelled generation")
+	}
+
+	want := map[string]float64{
+		metrics.GenerationsStarted:   1,
+		metrics.GenerationsSucceeded: 1,
+		metrics.GenerationsFailed:    1,
+	}
+	for name, v := range want {
+		if got := m.Counter(name); got != v {
+			t.Errorf("%s = %v, want %v", name, got, v)
+		}
+	}
+	if n := len(m.Observations(metrics.GenerationDuration)); n != 1 {
+		t.Errorf("got %d generation durations, want 1", n)
+	}
+}
+
+func TestPollGenerationTimeout(t *testing.T) {
+	c := newTestClient(t, func(operation string) string {
+		return feedJSON("PENDING")
+	})
+	c.generationTimeout = 50 * time.Millisecond
+	_, err := c.WaitForGeneration(context.Background(), "generation")
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("expected error to match ErrTimeout")
+	}
+}
+
+func TestGenerateImageInputValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   GenerateImageInput
+		wantErr bool
+	}{
+		{"valid", GenerateImageInput{Prompt: "a cat", Steps: 10}, false},
+		{"surrounding whitespace", GenerateImageInput{Prompt: "  a cat\n", Steps: 10}, false},
+		{"empty prompt", GenerateImageInput{Prompt: " \t\n", Steps: 10}, true},
+		{"long prompt", GenerateImageInput{Prompt: strings.Repeat("a", maxPromptLength+1), Steps: 10}, true},
+		{"zero steps", GenerateImageInput{Prompt: "a cat"}, true},
+		{"too many steps", GenerateImageInput{Prompt: "a cat", Steps: maxSteps + 1}, true},
+		{"phoenix contrast", GenerateImageInput{Prompt: "a cat", Steps: 10, SDVersion: "PHOENIX", Contrast: 3.5}, false},
+		{"invalid phoenix contrast", GenerateImageInput{Prompt: "a cat", Steps: 10, SDVersion: "PHOENIX", Contrast: 2}, true},
+		{"low phoenix alchemy contrast", GenerateImageInput{Prompt: "a cat", Steps: 10, SDVersion: "PHOENIX", Contrast: 1.8, Alchemy: true}, true},
+		{"contrast ratio", GenerateImageInput{Prompt: "a cat", Steps: 10, SDVersion: "SDXL_LIGHTNING", Contrast: 2}, false},
+		{"too many images", GenerateImageInput{Prompt: "a cat", Steps: 10, NumImages: maxNumImages + 1}, true},
+		{"photoreal", GenerateImageInput{Prompt: "a cat", Steps: 10, PhotoReal: true}, false},
+		{"photoreal v1 strength", GenerateImageInput{Prompt: "a cat", Steps: 10, PhotoReal: true, PhotoRealVersion: "v1", PhotoRealStrength: 0.5}, false},
+		{"photoreal with model", GenerateImageInput{Prompt: "a cat", Steps: 10, PhotoReal: true, ModelID: "model"}, true},
+		{"photoreal v2 strength", GenerateImageInput{Prompt: "a cat", Steps: 10, PhotoReal: true, PhotoRealStrength: 0.5}, true},
+		{"strength without photoreal", GenerateImageInput{Prompt: "a cat", Steps: 10, PhotoRealStrength: 0.5}, true},
+		{"controlnet", GenerateImageInput{Prompt: "a cat", Steps: 10, ControlNets: []ControlNet{{InitImageID: "image", PreprocessorID: 67, Strength: 1}}}, false},
+		{"controlnet without image", GenerateImageInput{Prompt: "a cat", Steps: 10, ControlNets: []ControlNet{{PreprocessorID: 67, Strength: 1}}}, true},
+		{"controlnet strength", GenerateImageInput{Prompt: "a cat", Steps: 10, ControlNets: []ControlNet{{InitImageID: "image", PreprocessorID: 67, Strength: 3}}}, true},
+		{"element", GenerateImageInput{Prompt: "a cat", Steps: 10, Elements: []Element{{AkUUID: "element", Weight: 0.8}}}, false},
+		{"negative element", GenerateImageInput{Prompt: "a cat", Steps: 10, Elements: []Element{{AkUUID: "element", Weight: -0.5}}}, false},
+		{"element without id", GenerateImageInput{Prompt: "a cat", Steps: 10, Elements: []Element{{Weight: 1}}}, true},
+		{"element weight", GenerateImageInput{Prompt: "a cat", Steps: 10, Elements: []Element{{AkUUID: "element", Weight: 2.5}}}, true},
+		{"zero element weight", GenerateImageInput{Prompt: "a cat", Steps: 10, Elements: []Element{{AkUUID: "element"}}}, true},
+		{"prompt magic", GenerateImageInput{Prompt: "a cat", Steps: 10, EnhancePrompt: true, PromptMagicStrength: 0.5, PromptMagicVersion: "v3"}, false},
+		{"prompt magic strength", GenerateImageInput{Prompt: "a cat", Steps: 10, EnhancePrompt: true, PromptMagicStrength: 1.5}, true},
+		{"prompt magic version", GenerateImageInput{Prompt: "a cat", Steps: 10, EnhancePrompt: true, PromptMagicVersion: "v9"}, true},
+		{"prompt magic without enhance", GenerateImageInput{Prompt: "a cat", Steps: 10, PromptMagicStrength: 1.5, PromptMagicVersion: "v9"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.input.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDimensionsForAspect(t *testing.T) {
+	tests := []struct {
+		ratio  string
+		target int
+		w, h   int
+	}{
+		{"16:9", 1472, 1472, 832},
+		{"9:16", 1472, 832, 1472},
+		{"1:1", 1024, 1024, 1024},
+		{"3:2", 1536, 1536, 1024},
+	}
+	for _, tt := range tests {
+		w, h, err := DimensionsForAspect(tt.ratio, tt.target)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.ratio, err)
+		}
+		if w != tt.w || h != tt.h {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.ratio, w, h, tt.w, tt.h)
+		}
+	}
+	for _, ratio := range []string{"", "16", "16:0", "a:b", "100:1"} {
+		if _, _, err := DimensionsForAspect(ratio, 1024); err == nil {
+			t.Errorf("%q: expected error", ratio)
+		}
+	}
+	if _, _, err := DimensionsForAspect("1:1", 4096); err == nil {
+		t.Error("expected error for target above the maximum")
+	}
+}
+
+func TestNewMemCookieStoreChecked(t *testing.T) {
+	valid := []string{
+		"token",
+		"__Secure-next-auth.session-token=token\n",
+		"a=b; __Secure-next-auth.session-token=token",
+		`{"accessToken": "token"}`,
+	}
+	for _, cookie := range valid {
+		if _, err := NewMemCookieStoreChecked(cookie); err != nil {
+			t.Errorf("%q: %v", cookie, err)
+		}
+	}
+	invalid := []string{
+		"",
+		" \n",
+		`{"accessToken": `,
+		`{"expires": "2020-01-01"}`,
+		"=token",
+		"a=; b=",
+	}
+	for _, cookie := range invalid {
+		if _, err := NewMemCookieStoreChecked(cookie); err == nil {
+			t.Errorf("%q: expected error", cookie)
+		}
+	}
+}
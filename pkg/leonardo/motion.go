@@ -0,0 +1,103 @@
+package leonardo
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultMotionTimeout is the minimum motion timeout when a generation timeout
+// is set, as motion generations take several minutes.
+const DefaultMotionTimeout = 20 * time.Minute
+
+// Motion strength range accepted by Leonardo.
+const (
+	minMotionStrength     = 1
+	maxMotionStrength     = 10
+	defaultMotionStrength = 5
+)
+
+type createMotionResponse struct {
+	Data struct {
+		MotionSvdGenerationJob struct {
+			GenerationID string `json:"generationId"`
+		} `json:"motionSvdGenerationJob"`
+	} `json:"data"`
+}
+
+// GenerateMotion animates a generated image, waits for the motion generation
+// to complete and returns the URL of the MP4 video. A zero motion strength
+// uses the default of 5.
+func (c *Client) GenerateMotion(ctx context.Context, imageID string, motionStrength int) (string, error) {
+	img, err := c.motion(ctx, imageID, motionStrength, false)
+	if err != nil {
+		return "", err
+	}
+	return *img.MotionMP4URL, nil
+}
+
+// CreateMotion animates an uploaded init image and returns the ID of the
+// generated image and the URL of the MP4 video.
+func (c *Client) CreateMotion(ctx context.Context, id string, motionStrength int) (string, string, error) {
+	img, err := c.motion(ctx, id, motionStrength, true)
+	if err != nil {
+		return "", "", err
+	}
+	if img.ID == "" {
+		return "", "", fmt.Errorf("leonardo: empty generated image id")
+	}
+	return img.ID, *img.MotionMP4URL, nil
+}
+
+// motion submits the motion generation job and polls it until the video is
+// available.
+func (c *Client) motion(ctx context.Context, imageID string, motionStrength int, initImage bool) (*GeneratedImage, error) {
+	if motionStrength == 0 {
+		motionStrength = defaultMotionStrength
+	}
+	if motionStrength < minMotionStrength || motionStrength > maxMotionStrength {
+		return nil, fmt.Errorf("leonardo: motion strength must be between %d and %d, got %d", minMotionStrength, maxMotionStrength, motionStrength)
+	}
+
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
+
+	req := &graphqlRequest{
+		OperationName: "CreateMotionSvdGenerationJob",
+		Variables: map[string]any{
+			"arg1": map[string]any{
+				"imageId":        imageID,
+				"isPublic":       false,
+				"isInitImage":    initImage,
+				"isVariation":    false,
+				"motionStrength": motionStrength,
+			},
+		},
+		Query: motionQuery,
+	}
+	var resp createMotionResponse
+	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
+		return nil, fmt.Errorf("leonardo: couldn't create motion: %w", err)
+	}
+	generationID := resp.Data.MotionSvdGenerationJob.GenerationID
+	if generationID == "" {
+		return nil, fmt.Errorf("leonardo: empty motion generation ID received")
+	}
+	c.info("leonardo: motion generation ID received: %s", generationID)
+
+	gen, err := c.pollGeneration(ctx, "Motion", generationID, c.motionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	images := gen.toGeneration().Images
+	if len(images) == 0 {
+		return nil, fmt.Errorf("leonardo: motion generation %s has no images", generationID)
+	}
+	img := images[0]
+	if img.MotionMP4URL == nil || *img.MotionMP4URL == "" {
+		return nil, fmt.Errorf("leonardo: empty motion mp4 url")
+	}
+	return &img, nil
+}
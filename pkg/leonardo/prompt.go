@@ -0,0 +1,51 @@
+package leonardo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type improvePromptResponse struct {
+	Data struct {
+		PromptImprove struct {
+			Prompt   string `json:"prompt"`
+			Typename string `json:"__typename"`
+		} `json:"promptImprove"`
+	} `json:"data"`
+}
+
+// ImprovePrompt returns the prompt enhanced by Leonardo, the same enhancement
+// applied by GenerateImageInput.EnhancePrompt.
+func (c *Client) ImprovePrompt(ctx context.Context, prompt string) (string, error) {
+	prompt = strings.TrimSpace(prompt)
+	if prompt == "" {
+		return "", errors.New("leonardo: prompt is empty")
+	}
+
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return "", err
+	}
+
+	req := &graphqlRequest{
+		OperationName: "PromptImprove",
+		Variables: map[string]any{
+			"arg1": map[string]any{
+				"prompt": prompt,
+			},
+		},
+		Query: improvePromptQuery,
+	}
+
+	var resp improvePromptResponse
+	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
+		return "", fmt.Errorf("leonardo: couldn't improve prompt: %w", err)
+	}
+	improved := resp.Data.PromptImprove.Prompt
+	if improved == "" {
+		return "", errors.New("leonardo: empty improved prompt")
+	}
+	return improved, nil
+}
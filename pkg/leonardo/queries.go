@@ -10,7 +10,7 @@ var uploadQuery = `mutation CreateUploadInitImage($arg1: InitImageUploadInput!)
   }
 }`
 
-var createQuery = `mutation CreateMotionSvdGenerationJob($arg1: MotionSvdGenerationInput!) {
+var motionQuery = `mutation CreateMotionSvdGenerationJob($arg1: MotionSvdGenerationInput!) {
   motionSvdGenerationJob(arg1: $arg1) {
     apiCreditCost
     generationId
@@ -18,14 +18,6 @@ var createQuery = `mutation CreateMotionSvdGenerationJob($arg1: MotionSvdGenerat
   }
 }`
 
-var statusQuery = `query GetAIGenerationFeedStatuses($where: generations_bool_exp = {}) {
-  generations(where: $where) {
-    id
-    status
-    __typename
-  }
-}`
-
 var feedQuery = `query GetAIGenerationFeed($where: generations_bool_exp = {}, $userId: uuid, $limit: Int, $offset: Int = 0) {
   generations(
     limit: $limit
@@ -151,6 +143,52 @@ var feedQuery = `query GetAIGenerationFeed($where: generations_bool_exp = {}, $u
   }
 }`
 
+var deleteGenerationQuery = `mutation DeleteGeneration($id: uuid!) {
+  delete_generations_by_pk(id: $id) {
+    id
+    __typename
+  }
+}`
+
+var unzoomQuery = `mutation CreateUnzoomJob($arg1: SDUnzoomInput!) {
+  sdUnzoomJob(arg1: $arg1) {
+    id
+    __typename
+  }
+}`
+
+var upscaleQuery = `mutation CreateUpscaleJob($arg1: SDUpscaleInput!) {
+  sdUpscaleJob(arg1: $arg1) {
+    id
+    __typename
+  }
+}`
+
+var noBGQuery = `mutation CreateNoBGJob($arg1: SDNobgInput!) {
+  sdNobgJob(arg1: $arg1) {
+    id
+    __typename
+  }
+}`
+
+var improvePromptQuery = `mutation PromptImprove($arg1: PromptImproveInput!) {
+  promptImprove(arg1: $arg1) {
+    prompt
+    __typename
+  }
+}`
+
+var variationQuery = `query GetImageVariations($where: generated_image_variation_generic_bool_exp = {}) {
+  generated_image_variation_generic(where: $where) {
+    id
+    status
+    url
+    transformType
+    createdAt
+    __typename
+  }
+}`
+
 var userQuery = `query GetUserDetails($userSub: String) {
   users(where: {user_details: {cognitoId: {_eq: $userSub}}}) {
     id
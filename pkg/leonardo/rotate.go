@@ -0,0 +1,225 @@
+package leonardo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCooldown is how long an account is skipped by a RotatingClient after
+// it's rate limited or runs out of credits.
+const DefaultCooldown = 15 * time.Minute
+
+// RotatingClient spreads the generations among several accounts, each with
+// its own client and cookie store. When an account is rate limited or runs
+// out of credits, it's put in cooldown and the generation is submitted with
+// the next account, so a batch keeps running when one account is exhausted.
+// It's safe for concurrent use.
+type RotatingClient struct {
+	accounts []*account
+	cooldown time.Duration
+
+	mu   sync.Mutex
+	next int
+	// owners maps the pending generations to the account that created them,
+	// which is the only one allowed to poll or delete them. The entries are
+	// dropped once the generations are waited for, so it doesn't grow with
+	// the number of generations; the owners of the finished ones are looked
+	// up.
+	owners map[string]*account
+}
+
+type account struct {
+	client *Client
+	// disabled is set if the client couldn't be started
+	disabled bool
+	// until is the end of the cooldown
+	until time.Time
+}
+
+// NewRotatingClient returns a client rotating among the given clients, which
+// should use different cookie stores. Accounts are skipped for the cooldown
+// after they're rate limited or run out of credits; DefaultCooldown is used if
+// it's not positive.
+func NewRotatingClient(cooldown time.Duration, clients ...*Client) *RotatingClient {
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	r := &RotatingClient{
+		cooldown: cooldown,
+		owners:   make(map[string]*account),
+	}
+	for _, c := range clients {
+		r.accounts = append(r.accounts, &account{client: c})
+	}
+	return r
+}
+
+// Start starts the clients. The accounts that can't be started are skipped,
+// so it only fails if none of them could be started.
+func (r *RotatingClient) Start(ctx context.Context) error {
+	if len(r.accounts) == 0 {
+		return fmt.Errorf("%w: no accounts", ErrAuth)
+	}
+	var errs []error
+	for i, a := range r.accounts {
+		if err := a.client.Start(ctx); err != nil {
+			a.client.info("leonardo: skipping account %d: %v", i+1, err)
+			r.mu.Lock()
+			a.disabled = true
+			r.mu.Unlock()
+			errs = append(errs, fmt.Errorf("account %d: %w", i+1, err))
+		}
+	}
+	if len(errs) == len(r.accounts) {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// Stop stops the clients, saving their session cookies.
+func (r *RotatingClient) Stop(ctx context.Context) error {
+	var errs []error
+	for i, a := range r.accounts {
+		if err := a.client.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("account %d: %w", i+1, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// GenerateImageDetailed generates images with the next available account and
+// returns them with their metadata.
+func (r *RotatingClient) GenerateImageDetailed(ctx context.Context, input *GenerateImageInput) ([]GeneratedImage, error) {
+	generationID, err := r.CreateGeneration(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return r.WaitForGeneration(ctx, generationID)
+}
+
+// CreateGeneration submits a generation job with the next available account
+// and returns its ID without waiting for it to complete. If the account is
+// rate limited or out of credits, it's put in cooldown and the next one is
+// tried.
+func (r *RotatingClient) CreateGeneration(ctx context.Context, input *GenerateImageInput) (string, error) {
+	var lastErr error
+	for {
+		a, ok := r.pick()
+		if !ok {
+			if lastErr != nil {
+				return "", fmt.Errorf("leonardo: all accounts are cooling down: %w", lastErr)
+			}
+			return "", fmt.Errorf("%w: all accounts are cooling down", ErrRateLimited)
+		}
+		generationID, err := a.client.CreateGeneration(ctx, input)
+		if err == nil {
+			r.mu.Lock()
+			r.owners[generationID] = a
+			r.mu.Unlock()
+			return generationID, nil
+		}
+		if !errors.Is(err, ErrRateLimited) && !errors.Is(err, ErrInsufficientCredits) {
+			return "", err
+		}
+		a.client.info("leonardo: account %s cooling down for %s: %v", a.client.userID, r.cooldown, err)
+		r.mu.Lock()
+		a.until = time.Now().Add(r.cooldown)
+		r.mu.Unlock()
+		lastErr = err
+	}
+}
+
+// WaitForGeneration waits for a generation created by CreateGeneration to
+// complete with the account that created it.
+func (r *RotatingClient) WaitForGeneration(ctx context.Context, generationID string) ([]GeneratedImage, error) {
+	c, err := r.owner(ctx, generationID)
+	if err != nil {
+		return nil, err
+	}
+	// The generation is done with whether it completed, failed or was
+	// cancelled, and is looked up if it's needed again
+	defer func() {
+		r.mu.Lock()
+		delete(r.owners, generationID)
+		r.mu.Unlock()
+	}()
+	return c.WaitForGeneration(ctx, generationID)
+}
+
+// GetGeneration returns the current status and images of a generation created
+// by CreateGeneration with the account that created it.
+func (r *RotatingClient) GetGeneration(ctx context.Context, generationID string) (*Generation, error) {
+	c, err := r.owner(ctx, generationID)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetGeneration(ctx, generationID)
+}
+
+// DeleteGeneration deletes a generation created by CreateGeneration with the
+// account that created it.
+func (r *RotatingClient) DeleteGeneration(ctx context.Context, generationID string) error {
+	c, err := r.owner(ctx, generationID)
+	if err != nil {
+		return err
+	}
+	if err := c.DeleteGeneration(ctx, generationID); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	delete(r.owners, generationID)
+	r.mu.Unlock()
+	return nil
+}
+
+// pick returns the next account that isn't disabled or cooling down, in
+// round-robin order.
+func (r *RotatingClient) pick() (*account, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for range r.accounts {
+		a := r.accounts[r.next]
+		r.next = (r.next + 1) % len(r.accounts)
+		if !a.disabled && !now.Before(a.until) {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// owner returns the client of the account that created the generation. The
+// completed generations are looked up in the feed of each account.
+func (r *RotatingClient) owner(ctx context.Context, generationID string) (*Client, error) {
+	r.mu.Lock()
+	a, ok := r.owners[generationID]
+	r.mu.Unlock()
+	if ok {
+		return a.client, nil
+	}
+
+	var errs []error
+	for i, a := range r.accounts {
+		r.mu.Lock()
+		disabled := a.disabled
+		r.mu.Unlock()
+		if disabled {
+			continue
+		}
+		gen, err := a.client.findGeneration(ctx, generationID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("account %d: %w", i+1, err))
+			continue
+		}
+		if gen != nil {
+			return a.client, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("leonardo: couldn't find generation %s: %w", generationID, errors.Join(errs...))
+	}
+	return nil, fmt.Errorf("leonardo: unknown generation %s", generationID)
+}
@@ -0,0 +1,39 @@
+package leonardo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GenerateWithSuffixes generates the base input once per suffix, appending the
+// suffix to the base prompt while keeping the seed and every other parameter
+// constant, so the images can be compared side by side. The images are
+// returned keyed by suffix. If a generation fails, the images generated so far
+// are returned with the error.
+func (c *Client) GenerateWithSuffixes(ctx context.Context, base GenerateImageInput, seed int64, suffixes []string) (map[string][]GeneratedImage, error) {
+	if seed == 0 {
+		return nil, errors.New("leonardo: a fixed seed is required")
+	}
+	seen := make(map[string]bool)
+	for _, suffix := range suffixes {
+		if seen[suffix] {
+			return nil, fmt.Errorf("leonardo: duplicate suffix %q", suffix)
+		}
+		seen[suffix] = true
+	}
+
+	results := make(map[string][]GeneratedImage)
+	for _, suffix := range suffixes {
+		input := base
+		input.Seed = seed
+		input.Prompt = strings.TrimSpace(base.Prompt + " " + suffix)
+		images, err := c.GenerateImageDetailed(ctx, &input)
+		if err != nil {
+			return results, fmt.Errorf("leonardo: suffix %q: %w", suffix, err)
+		}
+		results[suffix] = images
+	}
+	return results, nil
+}
@@ -0,0 +1,145 @@
+package leonardo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Variation types supported by CreateVariation.
+const (
+	VariationUnzoom  = "UNZOOM"
+	VariationUpscale = "UPSCALE"
+	VariationNoBG    = "NOBG"
+)
+
+// Variation is a variation job created from a generated image.
+type Variation struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	URL           string `json:"url"`
+	TransformType string `json:"transformType"`
+	CreatedAt     string `json:"createdAt"`
+}
+
+// createVariationResponse is keyed by the mutation field, which depends on the
+// variation type.
+type createVariationResponse struct {
+	Data map[string]struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+type variationResponse struct {
+	Data struct {
+		Variations []Variation `json:"generated_image_variation_generic"`
+	} `json:"data"`
+}
+
+// CreateVariation starts a variation job of the given type for a generated
+// image and returns the variation ID.
+func (c *Client) CreateVariation(ctx context.Context, imageID string, variationType string) (string, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return "", err
+	}
+
+	if imageID == "" {
+		return "", errors.New("leonardo: empty image id")
+	}
+
+	var operation, field, query string
+	switch variationType {
+	case VariationUnzoom:
+		operation, field, query = "CreateUnzoomJob", "sdUnzoomJob", unzoomQuery
+	case VariationUpscale:
+		operation, field, query = "CreateUpscaleJob", "sdUpscaleJob", upscaleQuery
+	case VariationNoBG:
+		operation, field, query = "CreateNoBGJob", "sdNobgJob", noBGQuery
+	default:
+		return "", fmt.Errorf("leonardo: unsupported variation type: %s", variationType)
+	}
+
+	req := &graphqlRequest{
+		OperationName: operation,
+		Variables: map[string]any{
+			"arg1": map[string]any{
+				"id":          imageID,
+				"isVariation": false,
+			},
+		},
+		Query: query,
+	}
+
+	var resp createVariationResponse
+	if _, err := c.do(ctx, "POST", "graphql", req, &resp); err != nil {
+		return "", fmt.Errorf("leonardo: couldn't create variation: %w", err)
+	}
+	id := resp.Data[field].ID
+	if id == "" {
+		return "", errors.New("leonardo: empty variation id")
+	}
+	c.info("leonardo: variation ID received: %s", id)
+	return id, nil
+}
+
+// WaitForVariation waits for the variation to complete and returns it.
+// Variations are tracked separately from generations, so they are polled
+// using their own query.
+func (c *Client) WaitForVariation(ctx context.Context, variationID string) (*Variation, error) {
+	// Authenticate if necessary
+	if err := c.Auth(ctx); err != nil {
+		return nil, err
+	}
+
+	req := &graphqlRequest{
+		OperationName: "GetImageVariations",
+		Variables: map[string]any{
+			"where": map[string]any{
+				"id": map[string]any{
+					"_eq": variationID,
+				},
+			},
+		},
+		Query: variationQuery,
+	}
+
+	pollCtx, cancel := generationContext(ctx, c.generationTimeout)
+	defer cancel()
+	wait := c.newPollBackoff()
+	start := time.Now()
+	for {
+		select {
+		case <-pollCtx.Done():
+			return nil, pollError(ctx, pollCtx, variationID, c.generationTimeout)
+		case <-time.After(wait.next()):
+		}
+
+		var resp variationResponse
+		if _, err := c.do(pollCtx, "POST", "graphql", req, &resp); err != nil {
+			if pollCtx.Err() != nil {
+				return nil, pollError(ctx, pollCtx, variationID, c.generationTimeout)
+			}
+			return nil, fmt.Errorf("leonardo: couldn't get variation status: %w", err)
+		}
+		if len(resp.Data.Variations) == 0 {
+			continue
+		}
+
+		v := resp.Data.Variations[0]
+		c.progress("Variation", variationID, v.Status, start)
+		wait.observe(v.Status)
+		switch v.Status {
+		case "PENDING", "IN_PROGRESS":
+			continue
+		case "COMPLETE":
+			if v.URL == "" {
+				return nil, errors.New("leonardo: empty variation url")
+			}
+			return &v, nil
+		default:
+			return nil, fmt.Errorf("%w: variation status: %s", ErrGenerationFailed, v.Status)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Package metrics defines the hooks the clients report their metrics to, so
+// they can be exported to Prometheus or another backend without depending on
+// it.
+package metrics
+
+// Metric names reported by the clients. Counters end with _total and
+// histograms with the unit of the observed values.
+const (
+	GenerationsStarted   = "leonardo_generations_started_total"
+	GenerationsSucceeded = "leonardo_generations_succeeded_total"
+	GenerationsFailed    = "leonardo_generations_failed_total"
+	GenerationDuration   = "leonardo_generation_duration_seconds"
+	LeonardoRateLimited  = "leonardo_rate_limited_total"
+	DownloadBytes        = "leoverse_download_bytes_total"
+	AirtableRequests     = "airtable_requests_total"
+	AirtableRateLimited  = "airtable_rate_limited_total"
+)
+
+// Metrics receives the metrics of the clients. Implementations must be safe
+// for concurrent use.
+type Metrics interface {
+	// IncCounter adds delta to the counter.
+	IncCounter(name string, delta float64)
+	// ObserveHistogram records the value in the histogram.
+	ObserveHistogram(name string, value float64)
+}
+
+// Nop discards the metrics. It's used when no Metrics are configured.
+type Nop struct{}
+
+func (Nop) IncCounter(name string, delta float64)       {}
+func (Nop) ObserveHistogram(name string, value float64) {}
+
+// OrNop returns m, or Nop if m is nil.
+func OrNop(m Metrics) Metrics {
+	if m == nil {
+		return Nop{}
+	}
+	return m
+}
@@ -0,0 +1,43 @@
+// Package metricstest provides a metrics.Metrics recording the metrics, for
+// the tests of the clients.
+package metricstest
+
+import "sync"
+
+// Recorder records the counters and histogram observations it receives.
+type Recorder struct {
+	mu         sync.Mutex
+	counters   map[string]float64
+	histograms map[string][]float64
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{counters: map[string]float64{}, histograms: map[string][]float64{}}
+}
+
+func (r *Recorder) IncCounter(name string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *Recorder) ObserveHistogram(name string, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.histograms[name] = append(r.histograms[name], value)
+}
+
+// Counter returns the value of the counter.
+func (r *Recorder) Counter(name string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+// Observations returns the values observed in the histogram.
+func (r *Recorder) Observations(name string) []float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]float64(nil), r.histograms[name]...)
+}
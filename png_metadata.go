@@ -0,0 +1,56 @@
+package leoverse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// pngText is a text entry embedded into the downloaded PNG images.
+type pngText struct {
+	keyword string
+	text    string
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// ihdrEnd is the offset following the IHDR chunk, which must be the first
+// chunk: signature, length, type, 13 bytes of data and the CRC.
+const ihdrEnd = 8 + 4 + 4 + 13 + 4
+
+// embedPNGText returns the PNG image with the texts inserted as iTXt chunks
+// after the IHDR chunk. iTXt is used instead of tEXt as prompts aren't limited
+// to Latin-1. If the data isn't a PNG image it's returned unchanged with false.
+func embedPNGText(data []byte, texts []pngText) ([]byte, bool) {
+	if len(data) < ihdrEnd || !bytes.HasPrefix(data, pngSignature) || string(data[12:16]) != "IHDR" {
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 256)
+	buf.Write(data[:ihdrEnd])
+	for _, t := range texts {
+		// Keyword, compression flag and method, empty language tag and
+		// translated keyword, followed by the UTF-8 text
+		var chunk bytes.Buffer
+		chunk.WriteString(t.keyword)
+		chunk.Write([]byte{0, 0, 0, 0, 0})
+		chunk.WriteString(t.text)
+		writePNGChunk(&buf, "iTXt", chunk.Bytes())
+	}
+	buf.Write(data[ihdrEnd:])
+	return buf.Bytes(), true
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	buf.Write(n[:])
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	buf.Write(n[:])
+}
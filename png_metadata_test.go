@@ -0,0 +1,32 @@
+package leoverse
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestEmbedPNGText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	data, ok := embedPNGText(buf.Bytes(), []pngText{{"Prompt", "a café at night"}, {"Seed", "42"}})
+	if !ok {
+		t.Fatal("expected the metadata to be embedded")
+	}
+	if !bytes.Contains(data, []byte("iTXtPrompt\x00\x00\x00\x00\x00a café at night")) {
+		t.Error("prompt chunk not found")
+	}
+	// The decoder checks the chunk CRCs
+	if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Errorf("invalid png: %v", err)
+	}
+
+	jpeg := []byte("\xff\xd8\xff\xe0")
+	if out, ok := embedPNGText(jpeg, []pngText{{"Seed", "42"}}); ok || !bytes.Equal(out, jpeg) {
+		t.Error("expected non-png data to be unchanged")
+	}
+}
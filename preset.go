@@ -0,0 +1,165 @@
+package leoverse
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+
+	"automation/leoverse/pkg/leonardo"
+)
+
+// DefaultPreset is the preset used when Config.Preset is not set.
+const DefaultPreset = "default"
+
+// Preset is a named set of generation settings. Config fields that are set,
+// such as Steps or Width and Height, override the preset.
+type Preset struct {
+	ModelID        string  `json:"model_id,omitempty"`
+	SDVersion      string  `json:"sd_version,omitempty"`
+	PresetStyle    string  `json:"preset_style,omitempty"`
+	Scheduler      string  `json:"scheduler,omitempty"`
+	Width          int     `json:"width,omitempty"`
+	Height         int     `json:"height,omitempty"`
+	Steps          int     `json:"steps,omitempty"`
+	GuidanceScale  float64 `json:"guidance_scale,omitempty"`
+	Contrast       float64 `json:"contrast,omitempty"`
+	NegativePrompt string  `json:"negative_prompt,omitempty"`
+	Alchemy        bool    `json:"alchemy,omitempty"`
+	PhotoReal      bool    `json:"photoreal,omitempty"`
+
+	// Elements apply trained styles or concepts (LoRAs) with a weight.
+	Elements []leonardo.Element `json:"elements,omitempty"`
+}
+
+// phoenixModelID is the ID of the Leonardo Phoenix model.
+const phoenixModelID = "6b645e3a-d64f-4341-a6d8-7a3690fbf042"
+
+var builtinPresets = map[string]Preset{
+	DefaultPreset: {
+		ModelID:       phoenixModelID,
+		SDVersion:     "PHOENIX",
+		PresetStyle:   "LEONARDO",
+		Scheduler:     "LEONARDO",
+		Width:         DefaultWidth,
+		Height:        DefaultHeight,
+		Steps:         DefaultSteps,
+		GuidanceScale: 7.0,
+		Contrast:      3.5,
+	},
+	"cinematic": {
+		ModelID:       phoenixModelID,
+		SDVersion:     "PHOENIX",
+		PresetStyle:   "CINEMATIC",
+		Scheduler:     "LEONARDO",
+		Width:         1472,
+		Height:        624,
+		Steps:         DefaultSteps,
+		GuidanceScale: 7.0,
+		Contrast:      3.5,
+	},
+	"anime": {
+		ModelID:       phoenixModelID,
+		SDVersion:     "PHOENIX",
+		PresetStyle:   "ANIME",
+		Scheduler:     "LEONARDO",
+		Width:         832,
+		Height:        1216,
+		Steps:         DefaultSteps,
+		GuidanceScale: 7.0,
+		Contrast:      3.5,
+	},
+	"photoreal": {
+		Width:     1024,
+		Height:    768,
+		Steps:     DefaultSteps,
+		PhotoReal: true,
+	},
+}
+
+// LoadPresets returns the built-in presets merged with the presets of the JSON
+// file, which maps preset names to their settings. The settings of a user
+// preset override those of the built-in preset with the same name, or else of
+// the photoreal preset for PhotoReal presets and of the default preset for
+// the others, so partial presets are complete. An empty path only returns the
+// built-in presets.
+func LoadPresets(path string) (map[string]Preset, error) {
+	presets := make(map[string]Preset, len(builtinPresets))
+	for name, p := range builtinPresets {
+		presets[name] = p
+	}
+	if path == "" {
+		return presets, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read presets file: %w", err)
+	}
+	var user map[string]json.RawMessage
+	if err := json.Unmarshal(b, &user); err != nil {
+		return nil, fmt.Errorf("couldn't parse presets file %s: %w", path, err)
+	}
+	for name, raw := range user {
+		var probe Preset
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return nil, fmt.Errorf("couldn't parse preset %q of %s: %w", name, path, err)
+		}
+		base, ok := builtinPresets[name]
+		switch {
+		case ok:
+		case probe.PhotoReal:
+			// PhotoReal picks its own model, the default one would be rejected
+			base = builtinPresets["photoreal"]
+		default:
+			base = builtinPresets[DefaultPreset]
+		}
+		// Only the fields set in the file replace the base settings
+		p := base
+		p.Elements = slices.Clone(base.Elements)
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, fmt.Errorf("couldn't parse preset %q of %s: %w", name, path, err)
+		}
+		presets[name] = p
+	}
+	return presets, nil
+}
+
+// FindPreset returns the named preset from LoadPresets.
+func FindPreset(name, path string) (*Preset, error) {
+	presets, err := LoadPresets(path)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := presets[name]
+	if !ok {
+		names := make([]string, 0, len(presets))
+		for n := range presets {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown preset %q, available presets: %v", name, names)
+	}
+	return &p, nil
+}
+
+// input returns the generation input for the prompt with the preset settings.
+func (p *Preset) input(prompt string) *leonardo.GenerateImageInput {
+	return &leonardo.GenerateImageInput{
+		Prompt:         prompt,
+		NegativePrompt: p.NegativePrompt,
+		ModelID:        p.ModelID,
+		Width:          p.Width,
+		Height:         p.Height,
+		GuidanceScale:  p.GuidanceScale,
+		PresetStyle:    p.PresetStyle,
+		Scheduler:      p.Scheduler,
+		SDVersion:      p.SDVersion,
+		Steps:          p.Steps,
+		Contrast:       p.Contrast,
+		Alchemy:        p.Alchemy,
+		PhotoReal:      p.PhotoReal,
+		Elements:       p.Elements,
+	}
+}
@@ -0,0 +1,67 @@
+package leoverse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPresets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	data := `{"anime": {"preset_style": "ANIME", "width": 512, "height": 512, "steps": 20}, "mine": {"photoreal": true}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	anime, err := FindPreset("anime", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anime.Width != 512 || anime.Steps != 20 {
+		t.Errorf("user preset didn't replace the built-in one: %+v", anime)
+	}
+	mine, err := FindPreset("mine", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mine.PhotoReal {
+		t.Errorf("unexpected user preset: %+v", mine)
+	}
+	if anime.PresetStyle != "ANIME" || anime.ModelID != phoenixModelID {
+		t.Errorf("user preset didn't keep the built-in settings: %+v", anime)
+	}
+	if _, err := FindPreset("cinematic", path); err != nil {
+		t.Errorf("built-in preset not found: %v", err)
+	}
+	if _, err := FindPreset("unknown", ""); err == nil {
+		t.Error("expected error for unknown preset")
+	}
+}
+
+func TestPartialPresets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presets.json")
+	data := `{"mine": {"photoreal": true}, "style": {"preset_style": "DYNAMIC", "alchemy": true}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mine", "style"} {
+		p, err := FindPreset(name, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := p.input("a cat")
+		if err := input.Validate(); err != nil {
+			t.Errorf("%s: invalid input from partial preset: %v", name, err)
+		}
+		if input.Steps != DefaultSteps || input.Width == 0 || input.Height == 0 {
+			t.Errorf("%s: missing default settings: %+v", name, input)
+		}
+	}
+	style, err := FindPreset("style", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if style.PresetStyle != "DYNAMIC" || !style.Alchemy || style.ModelID != phoenixModelID {
+		t.Errorf("unexpected merged preset: %+v", style)
+	}
+}
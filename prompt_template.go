@@ -0,0 +1,99 @@
+package leoverse
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultMaxPrompts is the maximum number of prompts expanded from a template
+// by ExpandPrompts when the given maximum is not positive.
+const DefaultMaxPrompts = 100
+
+// templateVar matches the {name} variables of a prompt template.
+var templateVar = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandPrompt replaces the {name} variables of the prompt template with the
+// values. Variables without a value are an error.
+func ExpandPrompt(tmpl string, values map[string]string) (string, error) {
+	var missing string
+	prompt := templateVar.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		v, ok := values[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return v
+	})
+	if missing != "" {
+		return "", fmt.Errorf("no value for template variable {%s}", missing)
+	}
+	return prompt, nil
+}
+
+// ExpandKnownVariables replaces the {name} variables of the prompt that have
+// a value and leaves the others untouched, so prompts containing literal
+// braces are kept as they are.
+func ExpandKnownVariables(prompt string, values map[string]string) string {
+	return templateVar.ReplaceAllStringFunc(prompt, func(m string) string {
+		if v, ok := values[m[1:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+}
+
+// ExpandPrompts expands the prompt template for every combination of the
+// values of its variables, e.g. "a {animal} wearing a {hat}" with two animals
+// and three hats returns six prompts. Variables that aren't used by the
+// template are ignored. It fails if there would be more than max prompts.
+func ExpandPrompts(tmpl string, vars map[string][]string, max int) ([]string, error) {
+	if max <= 0 {
+		max = DefaultMaxPrompts
+	}
+
+	// The variables are combined in the order they appear in the template
+	var names []string
+	seen := make(map[string]bool)
+	total := 1
+	for _, m := range templateVar.FindAllStringSubmatch(tmpl, -1) {
+		name := m[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		values, ok := vars[name]
+		if !ok || len(values) == 0 {
+			return nil, fmt.Errorf("no values for template variable {%s}", name)
+		}
+		total *= len(values)
+		if total > max {
+			return nil, fmt.Errorf("template %q expands to more than %d prompts", tmpl, max)
+		}
+		names = append(names, name)
+	}
+
+	prompts := make([]string, 0, total)
+	values := make(map[string]string, len(names))
+	var expand func(i int) error
+	expand = func(i int) error {
+		if i == len(names) {
+			prompt, err := ExpandPrompt(tmpl, values)
+			if err != nil {
+				return err
+			}
+			prompts = append(prompts, prompt)
+			return nil
+		}
+		for _, v := range vars[names[i]] {
+			values[names[i]] = v
+			if err := expand(i + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := expand(0); err != nil {
+		return nil, err
+	}
+	return prompts, nil
+}
@@ -0,0 +1,59 @@
+package leoverse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandPrompts(t *testing.T) {
+	vars := map[string][]string{
+		"animal": {"cat", "dog"},
+		"hat":    {"fedora", "beret", "cap"},
+		"unused": {"x", "y"},
+	}
+	prompts, err := ExpandPrompts("a {animal} wearing a {hat}, {animal} portrait", vars, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"a cat wearing a fedora, cat portrait",
+		"a cat wearing a beret, cat portrait",
+		"a cat wearing a cap, cat portrait",
+		"a dog wearing a fedora, dog portrait",
+		"a dog wearing a beret, dog portrait",
+		"a dog wearing a cap, dog portrait",
+	}
+	if strings.Join(prompts, "|") != strings.Join(want, "|") {
+		t.Errorf("prompts = %q, want %q", prompts, want)
+	}
+
+	if prompts, err := ExpandPrompts("a cat", vars, 0); err != nil || len(prompts) != 1 || prompts[0] != "a cat" {
+		t.Errorf("unexpected expansion without variables: %q, %v", prompts, err)
+	}
+	if _, err := ExpandPrompts("a {animal} wearing a {hat}", vars, 5); err == nil {
+		t.Error("expected error above the maximum")
+	}
+	if _, err := ExpandPrompts("a {bird}", vars, 0); err == nil {
+		t.Error("expected error for a variable without values")
+	}
+}
+
+func TestExpandPrompt(t *testing.T) {
+	prompt, err := ExpandPrompt("a {color} {animal}", map[string]string{"color": "red", "animal": "fox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt != "a red fox" {
+		t.Errorf("unexpected prompt %q", prompt)
+	}
+	if _, err := ExpandPrompt("a {color} {animal}", map[string]string{"color": "red"}); err == nil {
+		t.Error("expected error for a missing value")
+	}
+}
+
+func TestExpandKnownVariables(t *testing.T) {
+	got := ExpandKnownVariables("a {color} fox in {braces}", map[string]string{"color": "red"})
+	if want := "a red fox in {braces}"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package leoverse
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Defaults of the connection pool tuning in Config. The idle connections per
+// host are raised from the net/http default of 2, so concurrent generations
+// and downloads reuse their connections.
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 16
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
+// newTransport returns the transport used for the requests to Leonardo,
+// routed through the configured HTTP(S) or SOCKS5 proxy, or rotating between
+// the proxies of ProxyList. For HTTP proxies the credentials are sent in the
+// Proxy-Authorization header, including for the CONNECT requests used for
+// HTTPS.
+func newTransport(cfg *Config) (http.RoundTripper, error) {
+	if len(cfg.ProxyList) > 0 {
+		if cfg.Proxy != "" {
+			return nil, errors.New("proxy and proxy list are mutually exclusive")
+		}
+		return newRotatingTransport(cfg)
+	}
+	return proxyTransport(cfg, cfg.Proxy)
+}
+
+// proxyTransport returns a transport routed through the proxy, or a direct
+// transport if rawURL is empty.
+func proxyTransport(cfg *Config, rawURL string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cmp.Or(cfg.MaxIdleConns, DefaultMaxIdleConns)
+	transport.MaxIdleConnsPerHost = cmp.Or(cfg.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost)
+	transport.IdleConnTimeout = cmp.Or(cfg.IdleConnTimeout, DefaultIdleConnTimeout)
+	if rawURL == "" {
+		return transport, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme and host are required", rawURL)
+	}
+	if cfg.ProxyUsername != "" || cfg.ProxyPassword != "" {
+		u.User = url.UserPassword(cfg.ProxyUsername, cfg.ProxyPassword)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		transport.Proxy = http.ProxyURL(u)
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 proxy: %w", err)
+		}
+		contextDialer, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("socks5 dialer doesn't support contexts")
+		}
+		transport.Proxy = nil
+		transport.DialContext = contextDialer.DialContext
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	return transport, nil
+}
+
+// sharedTransport is the transport of a config, built on first use.
+type sharedTransport struct {
+	once      sync.Once
+	transport http.RoundTripper
+	err       error
+}
+
+// sharedTransportMu guards the creation of Config.transports.
+var sharedTransportMu sync.Mutex
+
+// sharedTransport returns the shared transport of the config, creating it if
+// needed so the copies of the config share it.
+func (cfg *Config) sharedTransport() *sharedTransport {
+	sharedTransportMu.Lock()
+	defer sharedTransportMu.Unlock()
+	if cfg.transports == nil {
+		cfg.transports = &sharedTransport{}
+	}
+	return cfg.transports
+}
+
+// transport returns the transport built from the config by newTransport. It's
+// built once, so its connection pool is reused by the requests of the config
+// and its copies.
+func (cfg *Config) transport() (http.RoundTripper, error) {
+	t := cfg.sharedTransport()
+	t.once.Do(func() {
+		t.transport, t.err = newTransport(cfg)
+	})
+	return t.transport, t.err
+}
+
+// NewHTTPClient returns a client routed through the configured proxy, for the
+// requests to other services such as Airtable. It shares the transport of the
+// requests to Leonardo, including the health of the proxies of ProxyList.
+func NewHTTPClient(cfg *Config) (*http.Client, error) {
+	transport, err := cfg.transport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,129 @@
+package leoverse
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health tracking of the proxies of Config.ProxyList: a proxy failing
+// proxyMaxFailures requests in a row is skipped for proxyCooldown.
+const (
+	proxyMaxFailures = 3
+	proxyCooldown    = time.Minute
+)
+
+// rotatingTransport sends each request through the next healthy proxy of the
+// list, in round-robin order.
+type rotatingTransport struct {
+	proxies []*proxyState
+
+	mu   sync.Mutex
+	next int
+}
+
+// proxyState is a proxy of the list and its health.
+type proxyState struct {
+	transport *http.Transport
+	// failures is the number of consecutive failed requests
+	failures int
+	// until is the end of the cooldown
+	until time.Time
+}
+
+func newRotatingTransport(cfg *Config) (*rotatingTransport, error) {
+	t := &rotatingTransport{}
+	for _, rawURL := range cfg.ProxyList {
+		transport, err := proxyTransport(cfg, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		t.proxies = append(t.proxies, &proxyState{transport: transport})
+	}
+	return t, nil
+}
+
+func (t *rotatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	i := t.pick(req.Context())
+	p := t.proxies[i]
+	resp, err := p.transport.RoundTrip(req)
+	// A cancelled request says nothing about the proxy
+	if req.Context().Err() == nil {
+		t.report(p, err == nil && !proxyFailed(resp))
+	}
+	return resp, err
+}
+
+// pick returns the index of the proxy pinned in the context, if any and it
+// isn't cooling down, or else of the next proxy that isn't cooling down. If
+// they all are, the one whose cooldown ends first is used rather than failing
+// the request.
+func (t *rotatingTransport) pick(ctx context.Context) int {
+	pin, _ := ctx.Value(proxyPinKey{}).(*proxyPin)
+	if pin != nil {
+		pin.mu.Lock()
+		defer pin.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if pin != nil && pin.set && pin.index < len(t.proxies) && !now.Before(t.proxies[pin.index].until) {
+		return pin.index
+	}
+	earliest := -1
+	for range t.proxies {
+		i := t.next
+		t.next = (t.next + 1) % len(t.proxies)
+		if !now.Before(t.proxies[i].until) {
+			earliest = i
+			break
+		}
+		if earliest == -1 || t.proxies[i].until.Before(t.proxies[earliest].until) {
+			earliest = i
+		}
+	}
+	if pin != nil {
+		pin.index, pin.set = earliest, true
+	}
+	return earliest
+}
+
+// report updates the health of the proxy after a request.
+func (t *rotatingTransport) report(p *proxyState, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ok {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.failures >= proxyMaxFailures {
+		p.failures = 0
+		p.until = time.Now().Add(proxyCooldown)
+	}
+}
+
+// proxyFailed reports whether the response was sent by a failing proxy
+// rather than by the server.
+func proxyFailed(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusProxyAuthRequired || resp.StatusCode == http.StatusBadGateway
+}
+
+// proxyPin is the proxy shared by the requests of a context. It's an index in
+// the proxy list, so the API and download transports built from the same list
+// agree on it.
+type proxyPin struct {
+	mu    sync.Mutex
+	index int
+	set   bool
+}
+
+type proxyPinKey struct{}
+
+// withProxyPin returns a context whose requests go through the same proxy of
+// the list, until it fails and another one is pinned.
+func withProxyPin(ctx context.Context) context.Context {
+	return context.WithValue(ctx, proxyPinKey{}, &proxyPin{})
+}
@@ -0,0 +1,153 @@
+package leoverse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ImageSink stores the downloaded images.
+type ImageSink interface {
+	// Put stores the contents of r under name and returns the location of
+	// the stored object.
+	Put(ctx context.Context, name string, r io.Reader) (string, error)
+}
+
+// LocalSink stores images in a directory of the local filesystem.
+type LocalSink struct {
+	Dir string
+}
+
+// Put writes the image to the directory and returns its path. The image is
+// written to a temporary file that is renamed once complete, so an interrupted
+// download doesn't leave a partial file behind.
+func (s *LocalSink) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return "", fmt.Errorf("couldn't create output directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(s.Dir, "."+name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	// Removing the temporary file fails once it's renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	// CreateTemp restricts the file to the owner
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(s.Dir, name)
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// S3Config configures an S3 compatible bucket (AWS S3, MinIO...).
+type S3Config struct {
+	// Endpoint is the host of the S3 API, e.g. "s3.amazonaws.com" or
+	// "localhost:9000".
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to the object names.
+	Prefix string
+	// Insecure uses plain HTTP instead of HTTPS.
+	Insecure bool
+}
+
+// S3Sink stores images in an S3 compatible bucket.
+type S3Sink struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Sink creates a sink that uploads images to the configured bucket.
+func NewS3Sink(cfg *S3Config) (*S3Sink, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create s3 client: %w", err)
+	}
+	return &S3Sink{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: strings.Trim(cfg.Prefix, "/"),
+	}, nil
+}
+
+// Put uploads the image and returns its object URL.
+func (s *S3Sink) Put(ctx context.Context, name string, r io.Reader) (string, error) {
+	key := path.Join(s.prefix, name)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, key, r, -1, minio.PutObjectOptions{
+		ContentType: contentType,
+	}); err != nil {
+		return "", fmt.Errorf("couldn't upload %s to s3: %w", key, err)
+	}
+	u := *s.client.EndpointURL()
+	u.Path = "/" + path.Join(s.bucket, key)
+	return u.String(), nil
+}
+
+// sink returns the image sink configured in cfg, defaulting to the local
+// output directory.
+func (cfg *Config) sink() (ImageSink, error) {
+	switch {
+	case cfg.Sink != nil:
+		return cfg.Sink, nil
+	case cfg.S3 != nil:
+		return NewS3Sink(cfg.S3)
+	}
+	return &LocalSink{Dir: cfg.outputDir()}, nil
+}
+
+// Subdir returns a copy of the config storing the images in the given
+// subdirectory of the output directory, or under the given prefix for S3.
+// Custom sinks other than LocalSink are kept as is.
+func (cfg *Config) Subdir(dir string) *Config {
+	// The copy shares the transport and its connections
+	cfg.sharedTransport()
+	c := *cfg
+	switch sink := cfg.Sink.(type) {
+	case nil:
+		if cfg.S3 != nil {
+			s3 := *cfg.S3
+			s3.Prefix = path.Join(s3.Prefix, dir)
+			c.S3 = &s3
+		} else {
+			c.Sink = &LocalSink{Dir: filepath.Join(cfg.outputDir(), dir)}
+		}
+	case *LocalSink:
+		c.Sink = &LocalSink{Dir: filepath.Join(sink.Dir, dir)}
+	}
+	return &c
+}
@@ -0,0 +1,26 @@
+package leoverse
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigOutputDir(t *testing.T) {
+	t.Setenv("OUTPUT_DIR", "env")
+	cfg := &Config{OutputDir: "records"}
+	sink, err := cfg.Subdir("rec1").sink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, ok := sink.(*LocalSink)
+	if !ok {
+		t.Fatalf("unexpected sink %T", sink)
+	}
+	if want := filepath.Join("records", "rec1"); local.Dir != want {
+		t.Errorf("dir = %s, want %s", local.Dir, want)
+	}
+
+	if dir := (&Config{}).outputDir(); dir != "env" {
+		t.Errorf("expected OUTPUT_DIR as default, got %s", dir)
+	}
+}
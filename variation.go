@@ -0,0 +1,54 @@
+package leoverse
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+)
+
+// CreateVariation creates a variation of a generated image, waits for it to
+// complete and downloads the result.
+func CreateVariation(ctx context.Context, cfg *Config, imageID, variationType string) error {
+	client, err := StartClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer client.Stop(ctx)
+
+	cfg.printf("Creating %s variation for image %s\n", variationType, imageID)
+	variationID, err := client.CreateVariation(ctx, imageID, variationType)
+	if err != nil {
+		return err
+	}
+	variation, err := client.WaitForVariation(ctx, variationID)
+	if err != nil {
+		return err
+	}
+	cfg.printf("Variation completed: %s\n", variation.URL)
+
+	sink, err := cfg.sink()
+	if err != nil {
+		return err
+	}
+	httpClient, err := cfg.downloadClient()
+	if err != nil {
+		return err
+	}
+	location, _, err := downloadImage(ctx, httpClient, sink, variation.URL, variationName(variation.ID, variation.URL), nil)
+	if err != nil {
+		return fmt.Errorf("couldn't download variation: %w", err)
+	}
+	cfg.printf("Downloaded to: %s\n", location)
+	return nil
+}
+
+// variationName returns the file name of the variation, with the extension of
+// its URL path, ignoring the query, or .png if it has none.
+func variationName(id, rawURL string) string {
+	ext := ".png"
+	if u, err := url.Parse(rawURL); err == nil && path.Ext(u.Path) != "" {
+		ext = path.Ext(u.Path)
+	}
+	return fmt.Sprintf("variation_%s%s", id, ext)
+}
@@ -0,0 +1,107 @@
+package leoverse
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WebhookSignatureHeader contains the hex encoded HMAC-SHA256 of the webhook
+// body, computed with Config.WebhookSecret.
+const WebhookSignatureHeader = "X-Leoverse-Signature"
+
+// webhookBackoff is the delay before each webhook retry.
+var webhookBackoff = []time.Duration{
+	2 * time.Second,
+	10 * time.Second,
+}
+
+type webhookPayload struct {
+	Prompt       string   `json:"prompt"`
+	GenerationID string   `json:"generation_id,omitempty"`
+	URLs         []string `json:"urls"`
+	Status       string   `json:"status"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// notifyWebhook posts the generation outcome to the configured webhook. Errors
+// are reported but never fail the generation.
+func notifyWebhook(ctx context.Context, cfg *Config, prompt string, result *Result, genErr error) {
+	if cfg.WebhookURL == "" {
+		return
+	}
+
+	payload := webhookPayload{
+		Prompt: prompt,
+		Status: "COMPLETE",
+		URLs:   []string{},
+	}
+	if result != nil {
+		payload.GenerationID = result.GenerationID
+		payload.URLs = result.URLs
+	}
+	if genErr != nil {
+		payload.Status = "FAILED"
+		payload.Error = genErr.Error()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		cfg.printf("Warning: couldn't marshal webhook payload: %v\n", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(ctx, cfg, body)
+		if err == nil {
+			return
+		}
+		if attempt >= len(webhookBackoff) || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(webhookBackoff[attempt]):
+		}
+	}
+	cfg.printf("Warning: couldn't notify webhook: %v\n", err)
+}
+
+// webhookTimeout bounds each attempt to notify the webhook.
+const webhookTimeout = 30 * time.Second
+
+func postWebhook(ctx context.Context, cfg *Config, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	// The webhook goes through the configured proxy like the other requests
+	transport, err := cfg.transport()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: transport, Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}